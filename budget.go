@@ -0,0 +1,138 @@
+package ebuf
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// MemoryBudget is a limit of the bytes buffered across many StreamBufs,
+// such as the per-connection buffers of a server. The writes to the
+// StreamBufs generated by NewStreamBufBudgeted take the bytes from
+// the shared budget, and are blocked while it is exhausted, until the reads
+// of any of the StreamBufs give bytes back.
+type MemoryBudget struct {
+	mu    sync.Mutex // guards the following fields
+	max   int64
+	used  int64
+	freed chan struct{} // closed when bytes are given back, made by waiters
+}
+
+// NewBudget generates a new MemoryBudget of maxBytes bytes.
+// NewBudget panics if maxBytes is negative.
+func NewBudget(maxBytes int64) *MemoryBudget {
+	if maxBytes < 0 {
+		panic("ebuf: " + ErrNegativeCapacity.Error())
+	}
+	return &MemoryBudget{max: maxBytes}
+}
+
+// Used returns the number of bytes taken from MemoryBudget. The result is
+// only a snapshot, which may be already stale when it is returned.
+func (m *MemoryBudget) Used() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.used
+}
+
+// take takes n bytes if they are available, or if nothing is taken, so that
+// a write larger than the budget is not blocked forever. Otherwise take
+// returns a channel which is closed when bytes are given back.
+func (m *MemoryBudget) take(n int64) (freed <-chan struct{}, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.used == 0 || m.used+n <= m.max {
+		m.used += n
+		return nil, true
+	}
+	if m.freed == nil {
+		m.freed = make(chan struct{})
+	}
+	return m.freed, false
+}
+
+// give gives n bytes back, and wakes up the waiters of take.
+// A negative n takes the bytes without blocking.
+func (m *MemoryBudget) give(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.used -= n
+	if n > 0 && m.freed != nil {
+		close(m.freed)
+		m.freed = nil
+	}
+}
+
+// NewStreamBufBudgeted generates a new StreamBuf like NewStreamBuf, whose
+// buffered bytes are taken from budget. A write is blocked until budget has
+// the bytes of its length, unless nothing is taken from budget, in the same
+// way as it is blocked by a full buffer: the wait ends with the same errors,
+// and TryWrite returns ErrWouldBlock instead. The bytes are given back as
+// they are read, and CloseRead gives back all the bytes still buffered,
+// which are never read. A StreamBuf abandoned without being drained nor
+// CloseRead keeps its bytes taken from budget, so the owner, such as
+// a connection handler, must call CloseRead when it gives up the reads.
+// NewStreamBufBudgeted panics if nrChunks is negative.
+func NewStreamBufBudgeted(budget *MemoryBudget, nrChunks int, opts ...Option) *StreamBuf {
+	sb := NewStreamBuf(nrChunks, opts...)
+	sb.stats.budget = budget
+	return sb
+}
+
+// detach gives back the bytes buffered to the budget if any, for
+// the buffer which is never read again, and makes the later updates leave
+// the budget alone, except that the bytes of the chunks sent concurrently
+// are given back as well.
+func (s *chunkStats) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.budget != nil && !s.detached {
+		s.detached = true
+		s.budget.give(s.buffered.Load())
+	}
+}
+
+// reserve takes the bytes of a write of n bytes from the budget if any,
+// in the way described in send, by the deadline given by writeDeadline.
+// blocked reports whether reserve had to wait.
+func (c *core) reserve(n int, timeout <-chan time.Time, deadline time.Time) (blocked bool, err error) {
+	if c.stats == nil || c.stats.budget == nil {
+		return false, nil
+	}
+
+	stop := nop
+	defer func() { stop() }()
+	for {
+		freed, ok := c.stats.budget.take(int64(n))
+		if ok {
+			return blocked, nil
+		}
+		if timeout == noWait {
+			return false, ErrWouldBlock
+		}
+		if !blocked {
+			timeout, stop = until(timeout, deadline)
+		}
+		blocked = true
+		select {
+		case <-freed:
+		case <-timeout:
+			return true, &TimeoutError{}
+		case <-c.done:
+			return true, ErrClosed
+		case <-c.rdone:
+			return true, io.ErrClosedPipe
+		}
+	}
+}
+
+// unreserve gives back the bytes taken by reserve for a write given up.
+func (c *core) unreserve(n int) {
+	if c.stats != nil && c.stats.budget != nil {
+		c.stats.budget.give(int64(n))
+	}
+}
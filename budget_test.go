@@ -0,0 +1,88 @@
+package ebuf_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	budget := ebuf.NewBudget(8)
+	a := ebuf.NewStreamBufBudgeted(budget, 4)
+	b := ebuf.NewStreamBufBudgeted(budget, 4)
+
+	if _, err := a.Write([]byte("abcdef")); err != nil {
+		t.Fatalf("[error] [Stream Buffer] [Write]: %v", err)
+	}
+	if _, err := b.TryWrite([]byte("ghij")); err != ebuf.ErrWouldBlock {
+		t.Errorf("expected %v (got %v)", ebuf.ErrWouldBlock, err)
+	}
+
+	// 予算が尽きていると, もう一方のバッファへの書き込みもブロックする
+	written := make(chan error)
+	go func() {
+		_, err := b.Write([]byte("ghij"))
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("expected Write to block (got %v)", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// a を読み切ると予算が戻り, 書き込みが進む
+	a.Close()
+	if actual, err := io.ReadAll(a); string(actual) != "abcdef" || err != nil {
+		t.Errorf("expected abcdef, <nil> (got %s, %v)", actual, err)
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Errorf("[error] [Stream Buffer] [Write]: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected Write to proceed")
+	}
+	if used := budget.Used(); used != 4 {
+		t.Errorf("expected 4 (got %d)", used)
+	}
+
+	b.Close()
+	io.ReadAll(b)
+	if used := budget.Used(); used != 0 {
+		t.Errorf("expected 0 (got %d)", used)
+	}
+}
+
+func TestMemoryBudgetCloseRead(t *testing.T) {
+	budget := ebuf.NewBudget(8)
+	a := ebuf.NewStreamBufBudgeted(budget, 4)
+	b := ebuf.NewStreamBufBudgeted(budget, 4)
+
+	a.Write([]byte("abc"))
+	a.Write([]byte("def"))
+	a.Read(make([]byte, 2))
+	if used := budget.Used(); used != 4 {
+		t.Errorf("expected 4 (got %d)", used)
+	}
+
+	// 読まれなくなったバッファの分は CloseRead で予算に戻る
+	a.CloseRead()
+	if used := budget.Used(); used != 0 {
+		t.Errorf("expected 0 (got %d)", used)
+	}
+	if _, err := b.TryWrite([]byte("ghijklmn")); err != nil {
+		t.Errorf("[error] [Stream Buffer] [TryWrite]: %v", err)
+	}
+
+	// 閉じた後の書き込みは予算を取らない
+	if _, err := a.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("expected %v (got %v)", io.ErrClosedPipe, err)
+	}
+	a.Bytes()
+	if used := budget.Used(); used != 8 {
+		t.Errorf("expected 8 (got %d)", used)
+	}
+}
@@ -0,0 +1,39 @@
+package ebuf
+
+import "sync"
+
+// DoubleBuf is double buffer. Writes are accumulated into the back buffer,
+// and Swap turns the back buffer into the front one for reading.
+// Unlike DatagramBuf and StreamBuf, DoubleBuf is not channel-based,
+// so Write is never blocked.
+type DoubleBuf struct {
+	mu    sync.Mutex // guards front and back
+	front []byte
+	back  []byte
+}
+
+// NewDoubleBuf generates a new DoubleBuf.
+func NewDoubleBuf() *DoubleBuf {
+	return &DoubleBuf{}
+}
+
+// Write implements io.Writer. Write appends p to the back buffer.
+func (b *DoubleBuf) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.back = append(b.back, p...)
+	return len(p), nil
+}
+
+// Swap atomically swaps the back buffer with the front buffer, and returns
+// the new front buffer, which holds all the data written since the previous Swap.
+// The back buffer is reset and reuses the memory of the old front buffer,
+// so the returned slice is valid only until the next call of Swap.
+func (b *DoubleBuf) Swap() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.front, b.back = b.back, b.front[:0]
+	return b.front
+}
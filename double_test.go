@@ -0,0 +1,85 @@
+package ebuf_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestDoubleBufSwap(t *testing.T) {
+	dbuf := ebuf.NewDoubleBuf()
+
+	tests := []struct {
+		inputs   [][]byte
+		expected []byte
+	}{
+		{[][]byte{[]byte("ab"), []byte("cde")}, []byte("abcde")},
+		{nil, []byte{}},
+		{[][]byte{[]byte("f")}, []byte("f")},
+		{[][]byte{[]byte("ghi"), []byte("j")}, []byte("ghij")},
+	}
+
+	for i, test := range tests {
+		for j, in := range test.inputs {
+			if _, err := dbuf.Write(in); err != nil {
+				t.Errorf("[error] [Double Buffer] [Write %d-%d]: %v", i, j, err)
+			}
+		}
+		actual := dbuf.Swap()
+		if !bytes.Equal(test.expected, actual) {
+			t.Errorf("[%d] expected %s (got %s)", i, test.expected, actual)
+		}
+	}
+}
+
+func TestDoubleBufConcurrentSwap(t *testing.T) {
+	const (
+		nrWriters = 8
+		nrWrites  = 1000
+	)
+	dbuf := ebuf.NewDoubleBuf()
+
+	var wg sync.WaitGroup
+	for i := 0; i < nrWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < nrWrites; j++ {
+				if _, err := dbuf.Write([]byte{byte(i)}); err != nil {
+					t.Errorf("[error] [Double Buffer] [Write %d-%d]: %v", i, j, err)
+				}
+			}
+		}(i)
+	}
+
+	// 書き込み中に Swap を繰り返し, 書き込まれたバイトが欠けないことを確認する
+	counts := make([]int, nrWriters)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	count := func(p []byte) {
+		for _, c := range p {
+			counts[c]++
+		}
+	}
+L:
+	for {
+		select {
+		case <-done:
+			break L
+		default:
+			count(dbuf.Swap())
+		}
+	}
+	count(dbuf.Swap())
+
+	for i, c := range counts {
+		if c != nrWrites {
+			t.Errorf("writer %d: expected %d bytes (got %d)", i, nrWrites, c)
+		}
+	}
+}
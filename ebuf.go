@@ -1,50 +1,519 @@
 // Package ebuf provides some enhanced buffer structures, such as
 // channel-based datagram buffer, channel-based byte-stream buffer.
+//
+// The buffers are safe for concurrent use by multiple goroutines.
+// Each Write is sent to the inner channel as one chunk, so the bytes
+// of concurrent Writes are never interleaved with each other: a DatagramBuf
+// returns each of them as one datagram, and a StreamBuf returns the bytes
+// of each of them contiguously, in the order the chunks were sent.
+//
+// The successive Writes of a single writer are read in the order they are
+// written, with no gaps or duplicates, even while DatagramBuf.Grow or
+// WithIdleShrink replaces the inner channel. The exceptions are explicit:
+// DropNewest and DropOldest of WithOverflowPolicy, DatagramBuf.WriteTTL, and
+// WithChecksum discard datagrams, leaving gaps but never reordering the rest,
+// DatagramBuf.Unread lets the reader push a datagram back in front, and
+// PriorityDatagramBuf keeps the order within each of its queues only.
+// The order across writers, and across the inputs of MergeDatagramBufs
+// and SelectRead, is unspecified.
 package ebuf
 
-import "errors"
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"iter"
+	"math"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type chbuf chan chunk
+
+// chunk is an element of the inner channel.
+type chunk struct {
+	data []byte
+	enq  time.Time // when the chunk was written, only with WithLatencyTracking or WithMaxAge
+	meta *Envelope // the metadata of MetaDatagramBuf, whose Data is unused
+
+	expiry time.Time // when the chunk expires, only with DatagramBuf.WriteTTL
+
+	guard guard // the checksum of the data not copied, only in debug builds
+
+	alloced bool // the data is allocated by WithAllocator, and given back to free
+
+	sum    uint32 // the CRC-32 of the data, only with WithChecksum
+	summed bool
+
+	delivered chan struct{} // closed when the chunk is read, only with DatagramBuf.WriteNotify
+}
 
-type chbuf chan []byte
+// noWait is a timeout which has already fired,
+// so that the receives with it do not block.
+var noWait = func() <-chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
 
+// The errors returned by the buffers are the following sentinels,
+// *TimeoutError, and the errors of io (io.EOF, io.ErrUnexpectedEOF,
+// io.ErrClosedPipe and io.ErrShortWrite). They are returned as they are,
+// so they can be compared with == as well as errors.Is.
+// Each failure mode has its own error, and a write which fails
+// always returns n == 0, since it never buffers a part of the data.
 var (
-	// ErrBrokenBuffer shows the buffer is broken.
+	// ErrBrokenBuffer shows the buffer is broken. Reads and writes return it,
+	// instead of panicking, when the inner channel has been closed
+	// without Close.
 	ErrBrokenBuffer = errors.New("buffer is broken")
+
+	// ErrClosed shows the operation is not allowed any more because
+	// the buffer has been closed: writes return it after Close or CloseWrite,
+	// and reads return it after CloseRead.
+	ErrClosed = errors.New("buffer is closed")
+
+	// ErrAlreadyClosed is returned by the second and later calls of
+	// Close, CloseWrite and CloseRead.
+	ErrAlreadyClosed = errors.New("buffer is already closed")
+
+	// ErrAlreadyUnread is returned by DatagramBuf.Unread when
+	// the previously pushed back datagram has not been read yet.
+	ErrAlreadyUnread = errors.New("datagram is already unread")
+
+	// ErrCanceled is returned by the operations which are given up
+	// by the cancel channel of the caller.
+	ErrCanceled = errors.New("operation is canceled")
+
+	// ErrWouldBlock is returned by non-blocking operations
+	// which cannot complete without blocking.
+	ErrWouldBlock = errors.New("operation would block")
+
+	// ErrNegativeCapacity shows the capacity given to a constructor is negative.
+	ErrNegativeCapacity = errors.New("capacity is negative")
+
+	// ErrWriterClosed shows the writer has closed the buffer cleanly,
+	// and all the data has been read. It wraps io.EOF, so errors.Is reports
+	// it as io.EOF as well. It is returned instead of io.EOF by
+	// DatagramBuf.DiscardDatagram, DatagramBuf.ReadInto,
+	// StreamBuf.ReadChunk, StreamBuf.ReadString, StreamBuf.ReadUntilBytes,
+	// StreamBuf.ReadMessage, StreamBuf.DrainTo and
+	// MetaDatagramBuf.ReadEnvelope. The other reads, such as Read, still
+	// return io.EOF itself, since io.Reader requires it and the callers
+	// like io.ReadAll and io.Copy compare the error with io.EOF by ==.
+	ErrWriterClosed = fmt.Errorf("writer closed: %w", io.EOF)
+
+	// ErrDiscarded shows the data at the offset given to ReadAt
+	// has been discarded from the history.
+	ErrDiscarded = errors.New("data at the offset is discarded")
+
+	// ErrTokenTooLong shows the delimiter is not found within the limit
+	// of WithMaxTokenSize.
+	ErrTokenTooLong = errors.New("token too long")
+
+	// ErrNoReader is returned by the writes which would block
+	// while no one has ever read the buffer, with WithRequireReader.
+	ErrNoReader = errors.New("no reader has attached")
+
+	// ErrChecksumMismatch shows the datagram has been modified after it
+	// was written, which is detected by WithChecksum.
+	ErrChecksumMismatch = errors.New("datagram checksum mismatch")
+
+	// ErrTooLarge shows the data is too large to be written,
+	// such as beyond the limit of WithMaxWriteSize.
+	ErrTooLarge = errors.New("data is too large")
+)
+
+// TimeoutError is returned when a read or write operation
+// does not complete within the given time limit.
+// TimeoutError implements net.Error, and errors.Is reports
+// it as os.ErrDeadlineExceeded and context.DeadlineExceeded.
+type TimeoutError struct{}
+
+// Error implements error.
+func (e *TimeoutError) Error() string { return "i/o timeout" }
+
+// Timeout implements net.Error. It always returns true.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary implements net.Error. It always returns true,
+// because the operation may succeed if it is retried.
+func (e *TimeoutError) Temporary() bool { return true }
+
+// Is reports whether target is os.ErrDeadlineExceeded or context.DeadlineExceeded.
+func (e *TimeoutError) Is(target error) bool {
+	return target == os.ErrDeadlineExceeded || target == context.DeadlineExceeded
+}
+
+var (
+	_ io.ReadWriteCloser = (*DatagramBuf)(nil)
+	_ io.ReadWriteCloser = (*StreamBuf)(nil)
+	_ io.StringWriter    = (*StreamBuf)(nil)
+	_ io.ReadWriteCloser = (*RingDatagramBuf)(nil)
+	_ io.ReaderAt        = (*IndexedStreamBuf)(nil)
+	_ io.ReadCloser      = (*PipeReader)(nil)
+	_ io.WriteCloser     = (*PipeWriter)(nil)
 )
 
+// core is the inner channel and the configuration
+// shared by DatagramBuf and StreamBuf.
+type core struct {
+	chbuf   // replaced by DatagramBuf.Grow
+	cfg     config
+	dropped atomic.Uint64
+	hwm     atomic.Int64 // the maximum number of elements in chbuf
+	queued  atomic.Int64 // the bytes in chbuf, only for DatagramBuf.BufferedBytes
+
+	// closeMu is read-locked while sending to chbuf, so that Close never
+	// closes chbuf in the middle of a send. Close closes done first,
+	// which wakes up the blocked senders to release closeMu.
+	closeMu   sync.RWMutex
+	closeOnce sync.Once
+	done      chan struct{} // closed by CloseWrite
+
+	rcloseOnce sync.Once
+	rdone      chan struct{} // closed by CloseRead
+
+	stats *chunkStats // only for StreamBuf
+
+	cause atomic.Pointer[error] // the error of the context given by WithCancel
+
+	closeErr error // given by StreamBuf.CloseWithError, written before done is closed
+
+	// chMu guards chbuf and moved against DatagramBuf.Grow. The operations
+	// on chbuf are counted in inflight, so that Grow can wait for them
+	// to leave chbuf before replacing it.
+	chMu     sync.RWMutex
+	moved    chan struct{} // closed when Grow replaces chbuf
+	inflight sync.WaitGroup
+
+	// fullCap is the capacity to which chbuf is regrown after it is shrunk
+	// by WithIdleShrink, guarded by chMu. recent is the maximum number of
+	// elements in chbuf since the last check of WithIdleShrink.
+	fullCap int
+	shrunk  atomic.Bool
+	recent  atomic.Int64
+
+	limiter *rateLimiter // only with WithWriteRateLimit
+
+	wtransform func([]byte) []byte // set by StreamBuf.WithWriteTransform
+
+	// arrival is closed by the next send, for DatagramBuf.WaitForDepth
+	arrival atomic.Pointer[chan struct{}]
+
+	attached atomic.Bool // set by the first read, for WithRequireReader
+}
+
+// chunkStats tracks the sizes of the chunks in the inner channel,
+// and the length of the rest slice of StreamBuf. A reader may take a chunk
+// before its writer adds it, so a size may be counted negatively for a moment.
+type chunkStats struct {
+	mu    sync.Mutex
+	count int
+	sum   int
+	peak  int         // the maximum of sum
+	sizes map[int]int // the number of chunks of each size
+	rest  int
+
+	// buffered is sum + rest, which is kept atomically for Len without s.mu
+	buffered atomic.Int64
+
+	budget   *MemoryBudget // only for NewStreamBufBudgeted
+	detached bool          // set by detach after CloseRead
+
+	notEmpty chan struct{} // signaled when StreamBuf becomes non-empty
+	emptied  chan struct{} // closed when StreamBuf becomes empty, made by waiters
+	filled   chan struct{} // closed when StreamBuf becomes non-empty, made by waiters
+}
+
+// newChunkStats returns an empty chunkStats.
+func newChunkStats() *chunkStats {
+	return &chunkStats{
+		sizes:    make(map[int]int),
+		notEmpty: make(chan struct{}, 1),
+	}
+}
+
+// add counts a chunk of n bytes sent to the inner channel.
+func (s *chunkStats) add(n int) {
+	s.update(n, 1, 0)
+}
+
+// move counts a chunk of n bytes moved from the inner channel to the rest slice.
+func (s *chunkStats) move(n int) {
+	s.update(n, -1, n)
+}
+
+// remove counts a chunk of n bytes received from the inner channel
+// without moving it to the rest slice.
+func (s *chunkStats) remove(n int) {
+	s.update(n, -1, 0)
+}
+
+// consume counts n bytes consumed from the rest slice.
+func (s *chunkStats) consume(n int) {
+	s.update(0, 0, -n)
+}
+
+// update adds delta chunks of n bytes, and restDelta bytes to the rest slice.
+// update signals notEmpty if StreamBuf becomes non-empty.
+func (s *chunkStats) update(n, delta, restDelta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	empty := s.empty()
+	s.count += delta
+	s.sum += n * delta
+	if s.sum > s.peak {
+		s.peak = s.sum
+	}
+	if delta != 0 {
+		if s.sizes[n] += delta; s.sizes[n] == 0 {
+			delete(s.sizes, n)
+		}
+	}
+	s.rest += restDelta
+	d := int64(n*delta + restDelta)
+	s.buffered.Add(d)
+	switch {
+	case s.budget == nil:
+	case s.detached:
+		if delta == 1 {
+			// taken by send after detach, but never read
+			s.budget.give(d)
+		}
+	case delta != 1:
+		// the bytes of a sent chunk are taken from the budget by send,
+		// and the others, such as read or transformed, are adjusted here
+		s.budget.give(-d)
+	}
+
+	switch nowEmpty := s.empty(); {
+	case empty && !nowEmpty:
+		select {
+		case s.notEmpty <- struct{}{}:
+		default:
+		}
+		if s.filled != nil {
+			close(s.filled)
+			s.filled = nil
+		}
+	case !empty && nowEmpty && s.emptied != nil:
+		close(s.emptied)
+		s.emptied = nil
+	}
+}
+
+// empty reports whether StreamBuf holds no data. The caller must hold s.mu.
+func (s *chunkStats) empty() bool {
+	return s.count <= 0 && s.rest <= 0
+}
+
+// init makes the inner channel which can buffer n elements, and applies opts.
+// init panics if n is negative.
+func (c *core) init(n int, opts []Option) {
+	if n < 0 {
+		panic("ebuf: " + ErrNegativeCapacity.Error())
+	}
+	c.chbuf = make(chan chunk, n)
+	c.fullCap = n
+	c.cfg = newConfig(opts)
+	if c.cfg.rate > 0 {
+		c.limiter = newRateLimiter(c.cfg.rate)
+	}
+	c.done = make(chan struct{})
+	c.rdone = make(chan struct{})
+	c.moved = make(chan struct{})
+}
+
+// enter returns the current inner channel and its moved channel,
+// and counts the caller in inflight until it calls leave.
+func (c *core) enter() (chbuf, <-chan struct{}) {
+	c.chMu.RLock()
+	defer c.chMu.RUnlock()
+
+	c.inflight.Add(1)
+	return c.chbuf, c.moved
+}
+
+// leave ends the operation started by enter.
+func (c *core) leave() {
+	c.inflight.Done()
+}
+
+// lenCap returns the length and the capacity of the current inner channel.
+func (c *core) lenCap() (int, int) {
+	c.chMu.RLock()
+	defer c.chMu.RUnlock()
+
+	return len(c.chbuf), cap(c.chbuf)
+}
+
 // DatagramBuf is channel-based datagram buffer.
+//
+// DatagramBuf implements io.ReadWriteCloser, but its Read deviates from
+// the contract of io.Reader in the way of a datagram socket: each Read
+// returns one whole datagram, and the part of it beyond len(p) is
+// discarded instead of being returned by the next Read. So the io helpers
+// which read into a fixed buffer, such as io.Copy, io.ReadAll and
+// io.ReadFull, lose the datagram boundaries, and they lose data if
+// a datagram is larger than their buffer. Use Read with a buffer large
+// enough for any datagram, or All, to keep the datagrams intact.
 type DatagramBuf struct {
-	chbuf
+	core
+	latency latencyStats
+
+	cOnce sync.Once // starts the goroutine feeding c
+	c     chan []byte
+
+	unreadMu sync.Mutex // guards unread
+	unread   []byte     // the datagram pushed back by Unread, or nil
+
+	expired atomic.Uint64 // the number of datagrams discarded by their TTL
+
+	// opened is closed when the reader returned by OpenDatagram is exhausted
+	opened atomic.Pointer[chan struct{}]
+}
+
+// latencyStats accumulates the time that datagrams spend in the buffer.
+type latencyStats struct {
+	mu       sync.Mutex
+	count    int64
+	min, max time.Duration
+	sum      time.Duration
+}
+
+// record adds the latency d of one datagram.
+func (s *latencyStats) record(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.count == 0 || d < s.min {
+		s.min = d
+	}
+	if d > s.max {
+		s.max = d
+	}
+	s.sum += d
+	s.count++
 }
 
 // StreamBuf is channel-based byte-stream buffer.
 type StreamBuf struct {
-	chbuf
-	rest []byte
+	core
+	rmu  sync.Mutex // serializes the reads consuming StreamBuf, even while blocked
+	mu   sync.Mutex // guards rest and parked, released while a read is blocked
+	rest restBuf
+
+	// rfree is closed by the next release of rmu, for SelectRead
+	rfree atomic.Pointer[chan struct{}]
+
+	// parked is true while a read is blocked on the inner channel or on
+	// the destination of Copy without mu, so that the others must not
+	// receive from the channel
+	parked bool
+
+	// framed makes Read return at most one chunk per call
+	framed bool
+
+	// rtransform is applied to each chunk fetched by reads,
+	// set by WithReadTransform
+	rtransform func([]byte) []byte
+
+	// hist records the fetched bytes, only for IndexedStreamBuf
+	hist *history
+
+	ctxOnce sync.Once // makes ctx for Context
+	ctx     context.Context
 }
 
 // NewDatagramBuf generates a new DatagramBuf which can buffer `nrDgrams` datagrams.
-func NewDatagramBuf(nrDgrams int) *DatagramBuf {
+// If nrDgrams is zero, DatagramBuf buffers nothing, and each Write is blocked
+// until a Read receives the datagram, like an unbuffered channel.
+// NewDatagramBuf panics if nrDgrams is negative.
+func NewDatagramBuf(nrDgrams int, opts ...Option) *DatagramBuf {
 	var dbuf DatagramBuf
-	dbuf.chbuf = make(chan []byte, nrDgrams)
+	dbuf.init(nrDgrams, opts)
+	dbuf.watch()
+	if dbuf.cfg.idleAfter > 0 {
+		go dbuf.shrinkIdle()
+	}
+	if dbuf.cfg.maxAge > 0 {
+		go dbuf.sweep()
+	}
 	return &dbuf
 }
 
+// NewDatagramBufFrom generates a new DatagramBuf like NewDatagramBuf, which
+// already holds copies of datagrams in order, so the reads return them first.
+// Like the initial bytes of NewStreamBufFrom, the datagrams are not written
+// by Write, so the options on the writes, such as WithWriteInterceptor,
+// WithMaxWriteSize and WithWriteRateLimit, do not apply to them.
+// NewDatagramBufFrom panics if nrDgrams is negative, or datagrams are more
+// than nrDgrams.
+func NewDatagramBufFrom(nrDgrams int, datagrams [][]byte, opts ...Option) *DatagramBuf {
+	if nrDgrams < 0 {
+		panic("ebuf: " + ErrNegativeCapacity.Error())
+	}
+	if len(datagrams) > nrDgrams {
+		panic("ebuf: too many initial datagrams")
+	}
+	dbuf := NewDatagramBuf(nrDgrams, opts...)
+	for _, d := range datagrams {
+		c := dbuf.alloc(len(d))
+		copy(c.data, d)
+		dbuf.stamp(&c)
+		// the inner channel has room for all of datagrams
+		dbuf.push(c, false, nil)
+		dbuf.sent(c)
+	}
+	return dbuf
+}
+
+// NewDatagramBufChecked is like NewDatagramBuf, but returns
+// ErrNegativeCapacity instead of panicking if nrDgrams is negative.
+func NewDatagramBufChecked(nrDgrams int, opts ...Option) (*DatagramBuf, error) {
+	if nrDgrams < 0 {
+		return nil, ErrNegativeCapacity
+	}
+	return NewDatagramBuf(nrDgrams, opts...), nil
+}
+
 // Write implements io.Writer. Write will be blocked when
-// the inner channel is full.
+// the inner channel is full. Write returns ErrClosed after Close or
+// CloseWrite, io.ErrClosedPipe after CloseRead, and ErrBrokenBuffer
+// if the buffer is broken. It also returns ErrTooLarge with
+// WithMaxWriteSize, ErrNoReader with WithRequireReader, a *TimeoutError
+// with WithWriteTimeout, the error of the interceptor given by
+// WithWriteInterceptor, and ctx.Err() after ctx given by WithCancel is done.
+// Write never returns ErrWouldBlock, which only TryWrite does.
 func (b *DatagramBuf) Write(p []byte) (n int, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			n, err = 0, ErrBrokenBuffer
-			return
-		}
-	}()
+	return b.write(p, nil)
+}
 
-	cp := make([]byte, len(p))
-	copy(cp, p)
-	n, err = len(cp), nil
-	b.chbuf <- cp
+// TryWrite is like Write, but never blocks: it returns ErrWouldBlock
+// instead if the inner channel is full, or the write would wait for
+// the rate limit of WithWriteRateLimit. With DropNewest or DropOldest
+// given by WithOverflowPolicy, TryWrite drops a datagram as Write does.
+// TryWrite returns the other errors of Write, except the *TimeoutError.
+func (b *DatagramBuf) TryWrite(p []byte) (n int, err error) {
+	return b.write(p, noWait)
+}
 
-	return n, err
+// WriteTimeout is like Write, but gives up and returns a *TimeoutError
+// if the inner channel stays full for the duration d, which is used instead
+// of WithWriteTimeout. WriteTimeout returns the other errors of Write.
+func (b *DatagramBuf) WriteTimeout(p []byte, d time.Duration) (n int, err error) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	return b.write(p, t.C)
 }
 
 // Read implements io.Reader. Read reads one
@@ -56,94 +525,2589 @@ func (b *DatagramBuf) Write(p []byte) (n int, err error) {
 // the unused field of p is left. Therefore, the caller
 // must treat `n` as the size of received datagram.
 // Read will be blocked when the inner channel is empty.
+// After Close, Read returns the remaining datagrams, and then io.EOF.
+// Read returns ErrClosed after CloseRead, and ErrBrokenBuffer
+// if the buffer is broken. With WithChecksum, Read returns
+// ErrChecksumMismatch for a datagram modified since its write, and discards
+// it. With WithReadTimeout, Read returns a *TimeoutError if it is blocked
+// longer than the timeout.
+// Read(nil) is a no-op, which returns (0, nil) without consuming
+// a datagram, while Read of an empty but non-nil p consumes a datagram
+// and discards it as a whole. DiscardDatagram does the latter explicitly.
 func (b *DatagramBuf) Read(p []byte) (n int, err error) {
-	r, ok := <-b.chbuf
-	if !ok {
-		return 0, ErrBrokenBuffer
+	return b.read(p, nil)
+}
+
+// ReadTimeout is like Read, but gives up and returns a *TimeoutError
+// if no datagram arrives within the duration d.
+func (b *DatagramBuf) ReadTimeout(p []byte, d time.Duration) (n int, err error) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	return b.read(p, t.C)
+}
+
+// read calls recv and reports the result to the observer if any.
+// read does nothing if p is nil.
+func (b *DatagramBuf) read(p []byte, timeout <-chan time.Time) (int, error) {
+	if p == nil {
+		return 0, nil
+	}
+	if b.cfg.observer == nil {
+		n, _, err := b.recv(p, timeout)
+		b.delay(err)
+		return n, err
 	}
-	return copy(p, r), nil
+
+	start := time.Now()
+	n, blocked, err := b.recv(p, timeout)
+	b.cfg.observer.ObserveRead(n, blocked, time.Since(start))
+	b.delay(err)
+	return n, err
 }
 
-// NewStreamBuf generates a new StreamBuf which can buffer `nrChunks` chunks.
-// StreamBuf provides the byte-stream with the caller by concatenating a seriese of chunks.
-func NewStreamBuf(nrChunks int) *StreamBuf {
-	var sb StreamBuf
-	sb.chbuf = make(chan []byte, nrChunks)
-	sb.rest = []byte{}
-	return &sb
+// recv is the body of Read. If timeout fires while recv is blocked,
+// recv returns a *TimeoutError. A nil timeout blocks forever.
+// blocked reports whether recv had to wait for a datagram.
+func (b *DatagramBuf) recv(p []byte, timeout <-chan time.Time) (n int, blocked bool, err error) {
+	timeout, stop := b.readTimer(timeout)
+	defer stop()
+	c, blocked, err := b.nextChunk(timeout)
+	if err != nil {
+		return 0, blocked, err
+	}
+	n = copy(p, c.data)
+	b.release(c)
+	return n, blocked, nil
 }
 
-// Read implements io.Reader. Read reads len(p) bytes from StreamBuf.
-// If len(p) is larger than the length of buffered data, Read
-// reads the all buffered data and returns the length of data in byte.
-// Therefore, Read will not be blocked. When needed to read
-// a specified length, it is better to use io.ReadAtLeast() together.
-func (b *StreamBuf) Read(p []byte) (int, error) {
-	requiredLen := len(p)
-	provideLen := requiredLen
+// DiscardDatagram consumes one datagram without copying it, and returns
+// its size. DiscardDatagram is blocked until a datagram arrives, and
+// returns the same errors as Read, except ErrWriterClosed for io.EOF.
+func (b *DatagramBuf) DiscardDatagram() (int, error) {
+	c, _, err := b.nextChunk(nil)
+	if err != nil {
+		return 0, writerClosed(err)
+	}
+	b.release(c)
+	return len(c.data), nil
+}
 
-	if len(b.rest) >= requiredLen {
-		// this StreamBuf can return the required length of bytes without fetching from its inner channel
-		copy(p, b.rest[:provideLen])
-		b.rest = b.rest[provideLen:]
+// ReadInto reads datagrams into dst, which lets the caller reuse its
+// buffers across calls: the i-th datagram is copied into the backing array
+// of dst[i], up to cap(dst[i]), and dst[i] is resliced to the copied length.
+// ReadInto is blocked until the first datagram arrives, then reads the
+// datagrams available at the moment without blocking, up to len(dst),
+// and returns the number of dst filled. ReadInto returns the same errors
+// as Read, except ErrWriterClosed for io.EOF, only if no datagram is read;
+// the errors after the first datagram are left for the next call.
+func (b *DatagramBuf) ReadInto(dst [][]byte) (int, error) {
+	for i := range dst {
+		timeout := noWait
+		if i == 0 {
+			timeout = nil
+		}
+		c, _, err := b.nextChunk(timeout)
+		if err != nil {
+			if i == 0 {
+				return 0, writerClosed(err)
+			}
+			return i, nil
+		}
+		dst[i] = dst[i][:copy(dst[i][:cap(dst[i])], c.data)]
+		b.release(c)
+	}
+	return len(dst), nil
+}
 
-		return provideLen, nil
+// next receives one datagram from the inner channel. If timeout fires while
+// next is blocked, next returns a *TimeoutError. A nil timeout blocks forever.
+// blocked reports whether next had to wait for a datagram.
+// The returned datagram is owned by the caller, and never released:
+// a datagram allocated by WithAllocator is copied and released instead.
+func (b *DatagramBuf) next(timeout <-chan time.Time) (d []byte, blocked bool, err error) {
+	c, blocked, err := b.nextChunk(timeout)
+	if err != nil || !c.alloced {
+		return c.data, blocked, err
 	}
+	// the data must be given back to the allocator
+	d = make([]byte, len(c.data))
+	copy(d, c.data)
+	b.release(c)
+	return d, blocked, nil
+}
 
-	// StreamBuf tries fetching more bytes from its inner channel
-	// until the the length of the rest slice is larger than the required length.
-	// If no more bytes in the channel, StreamBuf returns the largest possible
-	// length of data.
+// nextChunk is like next, but returns the chunk of the datagram,
+// which the caller should release after copying the datagram.
+func (b *DatagramBuf) nextChunk(timeout <-chan time.Time) (c chunk, blocked bool, err error) {
+	if b.readClosed() {
+		return chunk{}, false, b.canceled(ErrClosed)
+	}
+	if p := b.opened.Load(); p != nil {
+		// wait for the reader of OpenDatagram to be exhausted
+		blocked = true
+		select {
+		case <-*p:
+		case <-timeout:
+			return chunk{}, true, &TimeoutError{}
+		case <-b.rdone:
+			return chunk{}, true, b.canceled(ErrClosed)
+		}
+	}
+
+	b.unreadMu.Lock()
+	d := b.unread
+	b.unread = nil
+	b.unreadMu.Unlock()
+	if d != nil {
+		return chunk{data: d}, false, nil
+	}
+
+	for {
+		c, waited, err := b.recvChunk(timeout)
+		blocked = blocked || waited
+		if err != nil {
+			return chunk{}, blocked, b.canceled(err)
+		}
+		if b.stale(c, time.Now()) {
+			// the datagram is stale, so it is discarded instead of delivered late
+			b.expired.Add(1)
+			b.release(c)
+			continue
+		}
+		if c.summed && crc32.ChecksumIEEE(c.data) != c.sum {
+			b.release(c)
+			return chunk{}, blocked, ErrChecksumMismatch
+		}
+		return b.dequeued(c), blocked, nil
+	}
+}
+
+// stale reports whether c has expired at now, by its TTL given by
+// WriteTTL or by the maximum age given by WithMaxAge.
+func (b *DatagramBuf) stale(c chunk, now time.Time) bool {
+	if !c.expiry.IsZero() && now.After(c.expiry) {
+		return true
+	}
+	return b.cfg.maxAge > 0 && !c.enq.IsZero() && now.Sub(c.enq) > b.cfg.maxAge
+}
+
+// dequeued records the latency of c if it is tracked, notifies
+// the writer of c if it waits, and returns c.
+func (b *DatagramBuf) dequeued(c chunk) chunk {
+	if b.cfg.latency {
+		b.latency.record(time.Since(c.enq))
+	}
+	if c.delivered != nil {
+		close(c.delivered)
+	}
+	c.guard.check(c.data)
+	return c
+}
+
+// WriteTimed is like Write, but also returns how long Write was blocked
+// because the inner channel was full, until the datagram was accepted.
+// waited is 0 if Write was not blocked.
+func (b *DatagramBuf) WriteTimed(p []byte) (n int, waited time.Duration, err error) {
+	start := time.Now()
+	n, blocked, err := b.send(b.own(p), nil)
+	elapsed := time.Since(start)
+	if blocked {
+		waited = elapsed
+	}
+	if b.cfg.observer != nil {
+		b.cfg.observer.ObserveWrite(n, blocked, elapsed)
+	}
+	return n, waited, b.canceled(err)
+}
+
+// WriteTTL is like Write, but the datagram expires when ttl elapses:
+// reads discard the datagram instead of returning it if it has expired
+// by then, and count it in Expired. WriteTTL returns the same errors as Write.
+func (b *DatagramBuf) WriteTTL(p []byte, ttl time.Duration) error {
+	c := b.own(p)
+	c.expiry = time.Now().Add(ttl)
+	_, err := b.writeOwned(c, nil)
+	return err
+}
+
+// WriteNotify is like Write, but also returns a channel which is closed
+// when the datagram is taken by a read, such as Read and All, so that
+// the writer can track the delivery of each datagram. The channel is never
+// closed if the datagram is discarded instead, such as by DropNewest or
+// DropOldest given by WithOverflowPolicy, or by its TTL. WriteNotify returns
+// a nil channel with the same errors as Write.
+func (b *DatagramBuf) WriteNotify(p []byte) (<-chan struct{}, error) {
+	c := b.own(p)
+	c.delivered = make(chan struct{})
+	if _, err := b.writeOwned(c, nil); err != nil {
+		return nil, err
+	}
+	return c.delivered, nil
+}
+
+// WriteAllOrNone writes copies of ps as datagrams in order, only if
+// DatagramBuf has room for all of them at the moment, and otherwise writes
+// none of them and returns false, so that a group of messages is delivered
+// atomically. WriteAllOrNone never waits for the room, and ignores the overflow
+// policy given by WithOverflowPolicy. While it checks the room, the other
+// reads and writes are stopped in the way described in Grow. Datagrams of
+// another writer are never interleaved with ps, but a concurrent reader
+// may take some of ps before the others are written. WriteAllOrNone returns
+// the errors of Write, such as ErrClosed, ErrTooLarge, and the error
+// of the interceptor given by WithWriteInterceptor, writing none of ps.
+// With WithRequireReader, it returns ErrNoReader instead of false if no one
+// has ever read the buffer. Empty datagrams in ps are skipped as Write does
+// with WithAllowEmptyWrites(false), and the observer given by WithObserver
+// observes WriteAllOrNone as one write of all the bytes of ps.
+func (b *DatagramBuf) WriteAllOrNone(ps ...[]byte) (bool, error) {
+	if b.cfg.observer == nil {
+		sent, _, _, err := b.sendAll(ps)
+		return sent, b.canceled(err)
+	}
+
+	start := time.Now()
+	sent, n, blocked, err := b.sendAll(ps)
+	b.cfg.observer.ObserveWrite(n, blocked, time.Since(start))
+	return sent, b.canceled(err)
+}
+
+// sendAll is the body of WriteAllOrNone. n is the number of bytes written,
+// and blocked reports whether sendAll had to wait for the rate limit
+// of WithWriteRateLimit.
+func (b *DatagramBuf) sendAll(ps [][]byte) (sent bool, n int, blocked bool, err error) {
+	cs := make([]chunk, 0, len(ps))
+	defer func() {
+		for _, c := range cs {
+			b.release(c)
+		}
+	}()
+
+	total := 0
+	for _, p := range ps {
+		if len(p) == 0 && !b.cfg.allowEmpty {
+			continue
+		}
+		cs = append(cs, b.own(p))
+		if err := b.admit(&cs[len(cs)-1]); err != nil {
+			return false, 0, false, err
+		}
+		total += len(p)
+	}
+	if blocked, err = b.throttle(total, nil, b.writeDeadline(nil)); err != nil {
+		return false, 0, blocked, err
+	}
+
+	for i := range cs {
+		b.stamp(&cs[i])
+	}
+	sent, err = b.pushAll(cs)
+	if err == nil && !sent && b.regrow() {
+		// the inner channel shrunk by WithIdleShrink has room again
+		sent, err = b.pushAll(cs)
+	}
+	if err == nil && !sent && b.cfg.requireReader && !b.attached.Load() {
+		err = ErrNoReader
+	}
+	if !sent {
+		b.unthrottle(total)
+		return false, 0, blocked, err
+	}
+
+	for _, c := range cs {
+		b.sent(c)
+	}
+	cs = nil // sent, so not released
+	return true, total, blocked, nil
+}
+
+// BufferedBytes returns the total size in byte of the datagrams buffered
+// in the inner channel of DatagramBuf, which complements Available for
+// memory reporting, since the sizes of datagrams vary. The datagram
+// pushed back by Unread is not counted. Like Available, BufferedBytes is
+// only a snapshot, which may be outdated by concurrent reads and writes.
+func (b *DatagramBuf) BufferedBytes() int {
+	// a read may uncount a datagram before its write counts it
+	return max(0, int(b.queued.Load()))
+}
+
+// Expired returns the number of datagrams discarded because their TTL
+// given by WriteTTL, or the maximum age given by WithMaxAge, had elapsed.
+func (b *DatagramBuf) Expired() uint64 {
+	return b.expired.Load()
+}
+
+// Unread pushes a copy of p back to DatagramBuf, so that the next Read
+// returns it before the datagrams in the inner channel. Unread lets
+// the reader reject a datagram after inspecting it, and is meant to be
+// called by the reader itself: a Read blocked at the moment will not
+// return p. Only one datagram can be pushed back at a time, and Unread
+// returns ErrAlreadyUnread if the previous one has not been read yet.
+func (b *DatagramBuf) Unread(p []byte) error {
+	b.unreadMu.Lock()
+	defer b.unreadMu.Unlock()
+
+	if b.unread != nil {
+		return ErrAlreadyUnread
+	}
+	// a non-nil slice marks the pushed back datagram even if p is empty
+	b.unread = append(make([]byte, 0, len(p)), p...)
+	return nil
+}
+
+// Close implements io.Closer. Close is the same as CloseWrite,
+// so the remaining datagrams are still readable after Close.
+func (b *DatagramBuf) Close() error {
+	return b.close()
+}
+
+// CloseWrite shuts down the writing side of DatagramBuf. Subsequent writes,
+// including the ones blocked at the moment, return ErrClosed.
+// Reads return the remaining datagrams, and then io.EOF.
+// Calling CloseWrite more than once returns ErrAlreadyClosed.
+func (b *DatagramBuf) CloseWrite() error {
+	return b.close()
+}
+
+// CloseRead shuts down the reading side of DatagramBuf, telling the writers
+// that no one reads any more. Subsequent writes, including the ones blocked
+// at the moment, return io.ErrClosedPipe, and subsequent reads return ErrClosed.
+// Calling CloseRead more than once returns ErrAlreadyClosed.
+func (b *DatagramBuf) CloseRead() error {
+	return b.closeRead()
+}
+
+// Available returns the number of datagrams that can be written
+// before Write blocks. The result is only a snapshot, which may be
+// already stale when it is returned if other goroutines use DatagramBuf.
+func (b *DatagramBuf) Available() int {
+	n, capacity := b.lenCap()
+	return capacity - n
+}
+
+// String returns a summary of the state of DatagramBuf for debugging,
+// like `DatagramBuf{dgrams=2 cap=5 closed=false}`. String never consumes
+// datagrams, and the state is only a snapshot.
+func (b *DatagramBuf) String() string {
+	n, capacity := b.lenCap()
+	return fmt.Sprintf("DatagramBuf{dgrams=%d cap=%d closed=%t}", n, capacity, b.writeClosed())
+}
+
+// Grow enlarges the capacity of DatagramBuf by additional datagrams.
+// Grow replaces the inner channel with a larger one, and moves
+// the buffered datagrams to it in order. The blocked reads and writes are
+// woken up to retry on the new channel, and the other reads and writes
+// wait for Grow to finish. Grow returns ErrClosed after Close, and
+// ErrNegativeCapacity if additional is negative.
+func (b *DatagramBuf) Grow(additional int) error {
+	if additional < 0 {
+		return ErrNegativeCapacity
+	}
+
+	b.chMu.Lock()
+	defer b.chMu.Unlock()
+
+	if err := b.resize(cap(b.chbuf) + additional); err != nil {
+		return err
+	}
+	b.fullCap += additional
+	return nil
+}
+
+// resize replaces the inner channel with one of capacity n, or of
+// the number of the buffered elements if more, and moves the elements
+// to it in order, in the way described in DatagramBuf.Grow.
+// The caller must hold chMu for writing. resize returns ErrClosed after Close.
+func (c *core) resize(n int) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	if n == cap(c.chbuf) {
+		return nil
+	}
+	c.rebuild(max(n, len(c.chbuf)), nil)
+	return nil
+}
+
+// rebuild replaces the inner channel with one of capacity n, and moves
+// the elements for which keep returns true to it in order. The others
+// are returned. A nil keep keeps all the elements. n must not be less
+// than the number of the buffered elements. The caller must hold chMu
+// for writing, and check that the buffer is not closed.
+func (c *core) rebuild(n int, keep func(chunk) bool) (removed []chunk) {
+	// wake up the blocked operations, and wait for all of them to leave
+	close(c.moved)
+	c.inflight.Wait()
+
+	q := make(chbuf, n)
 L:
-	for len(b.rest) < requiredLen {
+	for {
 		select {
-		case r, ok := <-b.chbuf:
-			if !ok {
-				return 0, ErrBrokenBuffer
+		case ch := <-c.chbuf:
+			if keep != nil && !keep(ch) {
+				c.taken(ch)
+				removed = append(removed, ch)
+				continue
 			}
-			b.rest = append(b.rest, r...)
+			q <- ch
 		default:
-			provideLen = len(b.rest)
 			break L
 		}
 	}
+	c.chbuf = q
+	c.moved = make(chan struct{})
+	return removed
+}
 
-	// If inner buffer is empty and the provideLen is zero,
-	// Read will be blocked until StreamBuf fetches one chunk.
-	if provideLen == 0 {
-		r, ok := <-b.chbuf
-		if !ok {
-			return 0, ErrBrokenBuffer
+// shrinkIdle shrinks the inner channel to the capacity given by
+// WithIdleShrink each time it stays below the capacity for the period
+// given by WithIdleShrink. shrinkIdle returns when the buffer is closed.
+func (c *core) shrinkIdle() {
+	t := time.NewTicker(c.cfg.idleAfter)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-c.done:
+			return
+		case <-c.rdone:
+			return
 		}
-		b.rest = append(b.rest, r...)
 
-		if len(b.rest) < requiredLen {
-			provideLen = len(b.rest)
-		} else {
-			provideLen = requiredLen
+		n, capacity := c.lenCap()
+		if int(c.recent.Swap(0)) >= c.cfg.idleTo || n >= c.cfg.idleTo || capacity <= c.cfg.idleTo {
+			continue
 		}
+		c.chMu.Lock()
+		if c.resize(c.cfg.idleTo) == nil {
+			c.shrunk.Store(true)
+		}
+		c.chMu.Unlock()
 	}
+}
 
-	copy(p, b.rest[:provideLen])
-	b.rest = b.rest[provideLen:]
+// sweep discards the datagrams older than the maximum age given by
+// WithMaxAge from the inner channel, every period of the age.
+// sweep returns when DatagramBuf is closed.
+func (b *DatagramBuf) sweep() {
+	t := time.NewTicker(b.cfg.maxAge)
+	defer t.Stop()
 
-	return provideLen, nil
-}
+	for {
+		select {
+		case <-t.C:
+		case <-b.done:
+			return
+		case <-b.rdone:
+			return
+		}
 
-// Write implements io.Writer. Write writes len(p) bytes to StreamBuf.
-// When the StreamBuf is full, Write will be blocked.
-func (b *StreamBuf) Write(p []byte) (n int, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			n, err = 0, ErrBrokenBuffer
+		if n, _ := b.lenCap(); n == 0 {
+			continue
+		}
+		now := time.Now()
+		b.chMu.Lock()
+		select {
+		case <-b.done:
+			b.chMu.Unlock()
 			return
+		default:
 		}
-	}()
+		removed := b.rebuild(cap(b.chbuf), func(c chunk) bool {
+			return !b.stale(c, now)
+		})
+		b.chMu.Unlock()
 
-	cp := make([]byte, len(p))
+		for _, c := range removed {
+			b.expired.Add(1)
+			b.release(c)
+		}
+	}
+}
+
+// regrow restores the capacity of the inner channel shrunk by shrinkIdle,
+// and reports whether it is restored.
+func (c *core) regrow() bool {
+	if !c.shrunk.CompareAndSwap(true, false) {
+		return false
+	}
+
+	c.chMu.Lock()
+	defer c.chMu.Unlock()
+
+	return c.resize(c.fullCap) == nil
+}
+
+// HighWaterMark returns the maximum number of datagrams ever buffered
+// in DatagramBuf, which tells whether the capacity is ever approached.
+// The number is sampled just after each Write, so a datagram read
+// at the same moment may not be counted.
+func (b *DatagramBuf) HighWaterMark() int {
+	return int(b.hwm.Load())
+}
+
+// WaitForDepth blocks until at least n datagrams are buffered in
+// DatagramBuf, or timeout elapses, and returns the number of the buffered
+// datagrams at that moment, which may be less than n on timeout.
+// It lets a consumer read datagrams in batches under load, while
+// bounding the latency by timeout. WaitForDepth also returns when
+// DatagramBuf is closed. WaitForDepth never consumes datagrams,
+// so another reader may take them before the caller reads.
+func (b *DatagramBuf) WaitForDepth(n int, timeout time.Duration) int {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		// take the channel before the depth, so that no arrival is missed
+		arrived := b.arrived()
+		depth, _ := b.lenCap()
+		if depth >= n {
+			return depth
+		}
+		select {
+		case <-arrived:
+		case <-t.C:
+			depth, _ = b.lenCap()
+			return depth
+		case <-b.done:
+			depth, _ = b.lenCap()
+			return depth
+		case <-b.rdone:
+			return 0
+		}
+	}
+}
+
+// WriteAvailable is the same as Available, and is named after the writing
+// side for the producers which adapt to the room, like
+// `for n := b.WriteAvailable(); n > 0; n-- { ... }`.
+// The result is only a snapshot like Available.
+func (b *DatagramBuf) WriteAvailable() int {
+	return b.Available()
+}
+
+// LatencyStats returns the minimum, the maximum and the average time that
+// datagrams spent in DatagramBuf, from Write to Read. It accounts only for
+// the datagrams read so far, and returns zeros without WithLatencyTracking.
+func (b *DatagramBuf) LatencyStats() (min, max, avg time.Duration) {
+	b.latency.mu.Lock()
+	defer b.latency.mu.Unlock()
+
+	if b.latency.count == 0 {
+		return 0, 0, 0
+	}
+	return b.latency.min, b.latency.max, b.latency.sum / time.Duration(b.latency.count)
+}
+
+// Dropped returns the number of datagrams discarded by
+// the overflow policy set by WithOverflowPolicy.
+func (b *DatagramBuf) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+// WriteFromReader reads frameSize-byte frames from r, and writes each frame
+// to DatagramBuf as one datagram until r returns io.EOF.
+// The last frame shorter than frameSize is also written as one datagram.
+// WriteFromReader returns the number of datagrams written and the first
+// error encountered other than io.EOF. It panics if frameSize is not positive.
+func (b *DatagramBuf) WriteFromReader(r io.Reader, frameSize int) (datagrams int, err error) {
+	if frameSize <= 0 {
+		panic("ebuf: non-positive frame size")
+	}
+
+	frame := make([]byte, frameSize)
+	for {
+		n, rerr := io.ReadFull(r, frame)
+		if n > 0 {
+			// Write copies the frame, so it can be reused for the next read,
+			// unless WithCopyThreshold elides the copy
+			if _, err := b.Write(frame[:n]); err != nil {
+				return datagrams, err
+			}
+			if b.cfg.elides(n) {
+				frame = make([]byte, frameSize)
+			}
+			datagrams++
+		}
+		switch rerr {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return datagrams, nil
+		default:
+			return datagrams, rerr
+		}
+	}
+}
+
+// Datagrams returns a receive-only channel, which emits each buffered
+// datagram in order. Since Write copies every datagram, the received slices
+// are owned by the caller. Datagrams starts a goroutine which moves
+// datagrams from DatagramBuf to the returned channel, so a datagram taken by
+// the goroutine is not returned by Read. The returned channel is closed when
+// DatagramBuf is closed and drained; the caller should keep receiving
+// until then, otherwise the goroutine is blocked forever.
+func (b *DatagramBuf) Datagrams() <-chan []byte {
+	ch := make(chan []byte)
+	go func() {
+		defer close(ch)
+		for d := range b.All() {
+			ch <- d
+		}
+	}()
+	return ch
+}
+
+// C returns a receive-only channel for composing DatagramBuf into
+// the caller's select statements, like `case d := <-b.C():`.
+// C is an escape hatch: the inner channel holds the datagrams together
+// with their timestamps, so C returns a channel fed from it by a goroutine,
+// which is started by the first call, and every call returns the same channel.
+// Like Datagrams, the received slices are owned by the caller, a datagram
+// taken by the goroutine is not returned by Read, and the channel is closed
+// when DatagramBuf is closed and drained. The datagrams received through C
+// are still recorded by LatencyStats, but are not reported to the observer
+// given by WithObserver.
+func (b *DatagramBuf) C() <-chan []byte {
+	b.cOnce.Do(func() {
+		b.c = make(chan []byte)
+		go func() {
+			defer close(b.c)
+			for d := range b.All() {
+				b.c <- d
+			}
+		}()
+	})
+	return b.c
+}
+
+// MergeDatagramBufs merges the datagrams of ins into out. MergeDatagramBufs
+// starts a goroutine for each of ins, which reads the datagrams and writes
+// them to out, so the datagrams of each of ins keep their order, but
+// the order across ins is unspecified. The goroutines are blocked while out
+// is full. out is closed after all of ins are closed and drained.
+// If a write to out fails, for example because out is closed for reading,
+// the goroutine stops reading its input.
+func MergeDatagramBufs(out *DatagramBuf, ins ...*DatagramBuf) {
+	var wg sync.WaitGroup
+	for _, in := range ins {
+		wg.Add(1)
+		go func(in *DatagramBuf) {
+			defer wg.Done()
+			for d := range in.All() {
+				// d is owned by this goroutine, so it need not be copied again
+				if _, err := out.writeOwned(chunk{data: d}, nil); err != nil {
+					return
+				}
+			}
+		}(in)
+	}
+	go func() {
+		wg.Wait()
+		out.Close()
+	}()
+}
+
+// RouteDatagrams reads the datagrams of src, and writes each of them to
+// the buffer returned by route for it, or drops it if route returns nil.
+// RouteDatagrams returns when src is closed and drained, so it is usually
+// run on its own goroutine. Like Write, RouteDatagrams is blocked while
+// the destination is full. If the write to a destination fails, for example
+// because it is closed, the datagram is skipped. RouteDatagrams returns
+// the number of the skipped datagrams, not including the dropped ones.
+// The destinations are not closed by RouteDatagrams.
+func RouteDatagrams(src *DatagramBuf, route func([]byte) *DatagramBuf) (skipped int) {
+	for d := range src.All() {
+		dst := route(d)
+		if dst == nil {
+			continue
+		}
+		// d is owned by RouteDatagrams, so it need not be copied again
+		if _, err := dst.writeOwned(chunk{data: d}, nil); err != nil {
+			skipped++
+		}
+	}
+	return skipped
+}
+
+// WriteMulti writes p to each of bufs as one datagram for mirroring,
+// and returns the number of bufs which accepted it. WriteMulti copies p
+// only once, and the copy is shared by bufs, so the datagrams returned as
+// they are, such as by All, must not be modified. WriteMulti never blocks:
+// a buffer which is full is skipped like TryWrite, so that a slow consumer
+// does not stall the others. WriteMulti is not transactional: the buffers
+// accepting p keep it even if the others do not. err is the first error
+// of bufs other than ErrWouldBlock, such as ErrClosed.
+func WriteMulti(p []byte, bufs ...*DatagramBuf) (written int, err error) {
+	cp := make([]byte, len(p))
 	copy(cp, p)
-	n, err = len(cp), nil
-	b.chbuf <- cp
+	for _, b := range bufs {
+		_, werr := b.writeOwned(chunk{data: cp}, noWait)
+		switch {
+		case werr == nil:
+			written++
+		case werr != ErrWouldBlock && err == nil:
+			err = werr
+		}
+	}
+	return written, err
+}
+
+// All returns an iterator over the datagrams in DatagramBuf.
+// Each iteration blocks until a datagram arrives, and
+// the iteration stops when DatagramBuf is closed and drained.
+func (b *DatagramBuf) All() iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		for {
+			d, _, err := b.next(nil)
+			if err != nil || !yield(d) {
+				return
+			}
+		}
+	}
+}
+
+// NewStreamBuf generates a new StreamBuf which can buffer `nrChunks` chunks.
+// StreamBuf provides the byte-stream with the caller by concatenating a seriese of chunks.
+// If nrChunks is zero, StreamBuf buffers nothing, and each Write is blocked
+// until a Read receives the chunk, like an unbuffered channel.
+// NewStreamBuf panics if nrChunks is negative.
+func NewStreamBuf(nrChunks int, opts ...Option) *StreamBuf {
+	var sb StreamBuf
+	sb.setup(nrChunks, opts)
+	return &sb
+}
+
+// setup initializes StreamBuf for NewStreamBuf.
+func (b *StreamBuf) setup(nrChunks int, opts []Option) {
+	b.init(nrChunks, opts)
+	// dropping chunks would corrupt the byte-stream
+	b.cfg.overflow = BlockOnFull
+	// an empty chunk carries no data, but wastes the room of the inner channel
+	if !b.cfg.emptySet {
+		b.cfg.allowEmpty = false
+	}
+	// only DatagramBuf reports the latency, verifies the checksum,
+	// and expires the datagrams by WithMaxAge
+	b.cfg.latency = false
+	b.cfg.checksum = false
+	b.cfg.maxAge = 0
+	b.stats = newChunkStats()
+	b.watch()
+}
+
+// NewStreamBufFrom generates a new StreamBuf like NewStreamBuf, which
+// already holds a copy of initial as one chunk, so the first Read returns it
+// without blocking, and the writes are read after it. The initial bytes are
+// ready for Read without occupying the inner channel, so initial of any
+// length is held regardless of nrChunks. NewStreamBufFrom panics
+// if nrChunks is negative.
+func NewStreamBufFrom(nrChunks int, initial []byte, opts ...Option) *StreamBuf {
+	sb := NewStreamBuf(nrChunks, opts...)
+	if len(initial) > 0 {
+		sb.rest.append(initial)
+		sb.stats.update(0, 0, len(initial))
+	}
+	return sb
+}
+
+// NewStreamBufChecked is like NewStreamBuf, but returns
+// ErrNegativeCapacity instead of panicking if nrChunks is negative.
+func NewStreamBufChecked(nrChunks int, opts ...Option) (*StreamBuf, error) {
+	if nrChunks < 0 {
+		return nil, ErrNegativeCapacity
+	}
+	return NewStreamBuf(nrChunks, opts...), nil
+}
+
+// NewStreamBufFramed is like NewStreamBuf, but the generated StreamBuf
+// preserves the chunk boundaries: each Read returns the bytes of only one
+// chunk, even if p has room for more. If p is shorter than the chunk,
+// the next Read continues the same chunk.
+func NewStreamBufFramed(nrChunks int, opts ...Option) *StreamBuf {
+	sb := NewStreamBuf(nrChunks, opts...)
+	sb.framed = true
+	return sb
+}
+
+// Copy copies from src to dst until src is closed and drained,
+// and returns the number of bytes copied. Unlike io.Copy, Copy moves
+// each chunk of src to dst as it is, without copying it through an
+// intermediate buffer. A successful Copy returns err == nil, not io.EOF.
+// Otherwise Copy returns the first error of reading src or writing dst.
+// Copy holds src like a Read for the whole copy, so the other reads of src
+// wait for Copy to return, while the operations which never block, such as
+// Bytes, do not wait even if Copy is blocked by dst.
+func Copy(dst, src *StreamBuf) (written int64, err error) {
+	src.rmu.Lock()
+	defer src.unlockRead()
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	// the bytes already fetched from src alias its backing array
+	if n := src.rest.len(); n > 0 {
+		cp := make([]byte, n)
+		copy(cp, src.rest.bytes())
+		unpark := src.park()
+		m, err := dst.writeOwned(chunk{data: cp}, nil)
+		unpark()
+		src.consume(m)
+		written += int64(m)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	for {
+		if src.readClosed() {
+			return written, src.canceled(ErrClosed)
+		}
+		c, ok, err := src.wait(nil, nil)
+		if err != nil {
+			return written, err
+		}
+		if !ok {
+			if err := src.closedErr(); err != io.EOF {
+				return written, src.canceled(err)
+			}
+			return written, nil
+		}
+		src.stats.remove(len(c.data))
+		ch := chunk{data: c.data, guard: c.guard}
+		if src.rtransform != nil {
+			// the guard is only for the data as it is written
+			c.guard.check(c.data)
+			ch = chunk{data: src.rtransform(c.data)}
+		}
+		if src.hist != nil {
+			src.hist.append(ch.data)
+		}
+		if len(ch.data) == 0 {
+			src.release(c)
+			continue
+		}
+
+		if c.alloced {
+			// the data must be given back to the allocator of src, so it is
+			// copied even if dst elides copies by WithNoCopy or WithCopyThreshold
+			cp := dst.alloc(len(ch.data))
+			copy(cp.data, ch.data)
+			ch = cp
+			src.release(c)
+		}
+		unpark := src.park()
+		n, err := dst.writeOwned(ch, nil)
+		unpark()
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// MultiStreamBuf returns a Reader that is the logical concatenation of bufs,
+// like io.MultiReader. The Reader reads each StreamBuf until it is closed
+// and drained, and then moves to the next one. The Reader returns io.EOF
+// only after all of bufs return io.EOF.
+func MultiStreamBuf(bufs ...*StreamBuf) io.Reader {
+	readers := make([]io.Reader, len(bufs))
+	for i, b := range bufs {
+		readers[i] = b
+	}
+	return io.MultiReader(readers...)
+}
+
+// SelectRead reads one chunk from whichever of bufs has data first, like
+// a select statement over the buffers, and returns the index of the buffer
+// in bufs and the chunk in the same way as ReadChunk. If more than one of
+// bufs have data, the first one in bufs is read. SelectRead is blocked
+// until any of bufs has data, and skips the empty chunks. It returns
+// (-1, nil, io.EOF) when all of bufs are closed and drained. If a read fails
+// otherwise, SelectRead returns the index of the buffer and the error.
+// A buffer held by another read, such as a Read blocked for data, is
+// skipped until the read returns, instead of blocking SelectRead.
+func SelectRead(bufs ...*StreamBuf) (index int, p []byte, err error) {
+	// each of bufs wakes up SelectRead by an arrival, Close, or CloseRead,
+	// and by the end of another read holding it
+	cases := make([]reflect.SelectCase, 0, 4*len(bufs))
+	recv := func(ch <-chan struct{}) reflect.SelectCase {
+		return reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)}
+	}
+	for {
+		// take the arrivals before reading, so that no arrival is missed
+		cases = cases[:0]
+		for _, b := range bufs {
+			cases = append(cases, recv(b.arrived()), recv(b.done), recv(b.rdone), recv(nil))
+		}
+
+		drained := 0
+		for i, b := range bufs {
+			if !b.rmu.TryLock() {
+				// another read holds b, such as a Read blocked for data,
+				// so b is tried again when the read returns. The release
+				// is taken before trying again, so that it is not missed.
+				cases[4*i+3] = recv(waiter(&b.rfree))
+				if !b.rmu.TryLock() {
+					continue
+				}
+				cases[4*i+3] = recv(nil)
+			}
+			for {
+				p, err = b.tryChunk()
+				if err != nil || len(p) > 0 {
+					break
+				}
+			}
+			b.unlockRead()
+			switch err {
+			case nil:
+				return i, p, nil
+			case ErrWouldBlock:
+			case io.EOF:
+				drained++
+				// a drained buffer never wakes up SelectRead again
+				cases[4*i], cases[4*i+1] = recv(nil), recv(nil)
+			default:
+				return i, nil, err
+			}
+		}
+		if drained == len(bufs) {
+			return -1, nil, io.EOF
+		}
+		reflect.Select(cases)
+	}
+}
+
+// Read implements io.Reader. Read reads len(p) bytes from StreamBuf.
+// If len(p) is larger than the length of buffered data, Read
+// reads the all buffered data and returns the length of data in byte.
+// Therefore, Read is blocked only while no data is buffered, or, with
+// WithMinRead, while less than the minimum is. When needed to read
+// a specified length, it is better to use io.ReadAtLeast() together.
+// Read of an empty p, including nil, is a no-op which returns (0, nil).
+// After Close, Read returns the remaining data, and then io.EOF, or
+// the error given to CloseWithError. Read returns ErrClosed after CloseRead,
+// ErrBrokenBuffer if the buffer is broken, a *TimeoutError with
+// WithReadTimeout, and ctx.Err() after ctx given by WithCancel is done.
+func (b *StreamBuf) Read(p []byte) (int, error) {
+	return b.read(p, nil, nil)
+}
+
+// ReadEx is like Read, but also reports whether it was blocked because
+// no data was buffered, or, with WithMinRead, less than the minimum was.
+// An adaptive reader can use it to tell whether it keeps up with
+// the writers, such as to increase its prefetch, without timing each Read.
+func (b *StreamBuf) ReadEx(p []byte) (n int, blocked bool, err error) {
+	return b.readBlocked(p, nil, nil)
+}
+
+// ReadTimeout is like Read, but gives up and returns a *TimeoutError
+// if no data arrives within the duration d while Read is blocked.
+// ReadTimeout never discards buffered data on timeout: like Read, it returns
+// as soon as any data is buffered, without waiting to fill p, and the timeout
+// fires only while nothing is buffered. With WithMinRead, ReadTimeout waits
+// for the minimum instead, and on timeout it returns the bytes fetched so far
+// together with the *TimeoutError, like a socket read.
+func (b *StreamBuf) ReadTimeout(p []byte, d time.Duration) (int, error) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	return b.read(p, t.C, nil)
+}
+
+// ReadOrCancel is like Read, but gives up and returns ErrCanceled
+// if cancel is closed or receives a value while Read is blocked.
+// It lets the caller managing its own timers or signals avoid
+// allocating a context or a timer for each read.
+// Like ReadTimeout, ReadOrCancel returns as soon as any data is buffered,
+// so cancel is watched only while nothing is buffered. With WithMinRead,
+// ReadOrCancel waits for the minimum instead, and on cancel it returns
+// the bytes fetched so far together with ErrCanceled.
+func (b *StreamBuf) ReadOrCancel(p []byte, cancel <-chan struct{}) (int, error) {
+	return b.read(p, nil, cancel)
+}
+
+// ChunkStats returns the number of chunks buffered in the inner channel,
+// their average size and their maximum size in byte. The bytes which
+// StreamBuf has already fetched for Read are not counted. Lots of tiny
+// chunks show that the writers should write larger data at once.
+// The result is only a snapshot, which may be already stale when it is
+// returned if other goroutines use StreamBuf.
+func (b *StreamBuf) ChunkStats() (count int, avgSize float64, maxSize int) {
+	s := b.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.count <= 0 {
+		return 0, 0, 0
+	}
+	for n, k := range s.sizes {
+		if k > 0 && n > maxSize {
+			maxSize = n
+		}
+	}
+	return s.count, float64(s.sum) / float64(s.count), maxSize
+}
+
+// HighWaterMark returns the maximum number of bytes ever buffered in
+// the inner channel of StreamBuf, which tells whether the capacity is
+// ever approached. Like ChunkStats, the bytes which StreamBuf has already
+// fetched for Read are not counted.
+func (b *StreamBuf) HighWaterMark() int {
+	s := b.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.peak
+}
+
+// take moves the data of c, which is received from the inner channel,
+// to the rest slice. The caller must hold b.mu.
+func (b *StreamBuf) take(c chunk) {
+	data := b.received(c)
+	// the read transform may change the length of the data
+	b.stats.update(len(c.data), -1, len(data))
+	b.rest.append(data)
+	b.release(c)
+}
+
+// received checks the data of c, which is received from the inner channel,
+// applies the read transform if any, and records the result in the history
+// if any. The returned data is valid until c is released.
+// The caller must hold b.mu.
+func (b *StreamBuf) received(c chunk) []byte {
+	c.guard.check(c.data)
+	data := c.data
+	if b.rtransform != nil {
+		data = b.rtransform(data)
+	}
+	if b.hist != nil {
+		b.hist.append(data)
+	}
+	return data
+}
+
+// consume discards the first n bytes of the rest slice.
+// The caller must hold b.mu.
+func (b *StreamBuf) consume(n int) {
+	b.rest.consume(n)
+	b.stats.consume(n)
+	if b.cfg.autoCompact && b.rest.sparse() {
+		b.rest.compact()
+	}
+}
+
+// Compact moves the bytes fetched but not read yet to a new backing array
+// of their size, and releases the old one, which stays as large as the largest
+// burst StreamBuf has ever buffered. Compact waits for an in-progress Read
+// to return. See also WithAutoCompact.
+func (b *StreamBuf) Compact() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rest.compact()
+}
+
+// BytesUntilBoundary returns the number of the bytes which Read can
+// provide before it crosses the boundary of the chunk currently being read,
+// that is, the remainder of the chunk partially read. BytesUntilBoundary
+// returns 0 if all the fetched bytes have been read; the chunks still
+// in the inner channel are not fetched. This is intended for debugging
+// framing issues, where a writer and a reader disagree on boundaries.
+func (b *StreamBuf) BytesUntilBoundary() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rest.boundary()
+}
+
+// NotEmpty returns a channel which is signaled each time StreamBuf
+// becomes non-empty, that is, a chunk arrives while neither the inner
+// channel nor the bytes fetched for Read hold any data. It lets an idle
+// consumer wait on the channel, drain StreamBuf fully, and then wait again.
+// The channel buffers one signal, so a transition during the drain is not
+// lost, but transitions are coalesced while the signal is not received.
+func (b *StreamBuf) NotEmpty() <-chan struct{} {
+	return b.stats.notEmpty
+}
+
+// String returns a summary of the state of StreamBuf for debugging,
+// like `StreamBuf{rest=12B chunks=3 cap=5 closed=false}`, where rest is
+// the bytes fetched for Read but not read yet. String never consumes data,
+// and is not blocked by a blocked Read. The state is only a snapshot.
+func (b *StreamBuf) String() string {
+	s := b.stats
+	s.mu.Lock()
+	rest, chunks := s.rest, max(s.count, 0)
+	s.mu.Unlock()
+
+	return fmt.Sprintf("StreamBuf{rest=%dB chunks=%d cap=%d closed=%t}", rest, chunks, cap(b.chbuf), b.writeClosed())
+}
+
+// Len returns the number of bytes buffered in StreamBuf, both the bytes
+// fetched for Read and the chunks in the inner channel. Len never touches
+// the inner channel, so it never changes the chunk boundaries seen by
+// ReadChunk, and is never blocked by a blocked Read. The result is only
+// a snapshot, which may be already stale when it is returned if other
+// goroutines use StreamBuf. The writes blocked at the moment are not counted.
+func (b *StreamBuf) Len() int {
+	return int(max(b.stats.buffered.Load(), 0))
+}
+
+// WaitDrained blocks until StreamBuf becomes empty, that is, all the
+// buffered data has been read, or ctx is done. It lets a producer know that
+// the consumers have finished after CloseWrite. WaitDrained returns nil
+// when StreamBuf is empty, and ctx.Err() when ctx is done.
+// The writes blocked at the moment are not counted as buffered.
+func (b *StreamBuf) WaitDrained(ctx context.Context) error {
+	s := b.stats
+	s.mu.Lock()
+	if s.empty() {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.emptied == nil {
+		s.emptied = make(chan struct{})
+	}
+	emptied := s.emptied
+	s.mu.Unlock()
+
+	select {
+	case <-emptied:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitNotEmpty blocks until StreamBuf has data to read, or ctx is done,
+// without consuming anything. It lets a consumer wait before a non-blocking
+// read, such as DrainTo, in its own loop. WaitNotEmpty returns nil when
+// the following Read does not block: StreamBuf has data, or it is closed.
+// Another consumer may still take the data first, and DrainTo returns
+// nothing while another read is in progress.
+// It returns ctx.Err() when ctx is done. Unlike NotEmpty, any number of
+// consumers can wait at the same time.
+func (b *StreamBuf) WaitNotEmpty(ctx context.Context) error {
+	s := b.stats
+	s.mu.Lock()
+	if !s.empty() {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.filled == nil {
+		s.filled = make(chan struct{})
+	}
+	filled := s.filled
+	s.mu.Unlock()
+
+	select {
+	case <-filled:
+		return nil
+	case <-b.done:
+		return nil
+	case <-b.rdone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WriteAvailable returns the number of Writes that can be done
+// before Write blocks. Since StreamBuf bounds the number of chunks,
+// not the number of bytes, each of the Writes may be of any length.
+// The result is only a snapshot, which may be already stale when it is
+// returned if other goroutines use StreamBuf.
+func (b *StreamBuf) WriteAvailable() int {
+	return cap(b.chbuf) - len(b.chbuf)
+}
+
+// ReadVectored reads data into bufs in order, like readv, and returns
+// the total length of data in byte. The data spills over from each slice
+// of bufs to the next one. Like Read, ReadVectored is blocked only until
+// the first byte arrives, and it returns as soon as some data is buffered,
+// without waiting to fill bufs.
+func (b *StreamBuf) ReadVectored(bufs [][]byte) (int, error) {
+	if b.cfg.observer == nil {
+		n, _, err := b.recvVectored(bufs)
+		return n, err
+	}
 
+	start := time.Now()
+	n, blocked, err := b.recvVectored(bufs)
+	b.cfg.observer.ObserveRead(n, blocked, time.Since(start))
 	return n, err
 }
+
+// recvVectored is the body of ReadVectored.
+func (b *StreamBuf) recvVectored(bufs [][]byte) (n int, blocked bool, err error) {
+	want := 0
+	for _, p := range bufs {
+		want += len(p)
+	}
+	timeout, stop := b.readTimer(nil)
+	defer stop()
+
+	b.rmu.Lock()
+	defer b.unlockRead()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if blocked, err = b.fetch(want, timeout, nil); err != nil {
+		return 0, blocked, err
+	}
+
+	for _, p := range bufs {
+		if b.rest.len() == 0 {
+			break
+		}
+		m := copy(p, b.rest.bytes())
+		b.consume(m)
+		n += m
+	}
+
+	return n, blocked, nil
+}
+
+// ReadWithBoundaries is like Read, but also returns the offsets within p
+// where the chunks written to StreamBuf end, which helps verifying
+// the framing of a stream. For example, after writing "ab" and "cde",
+// ReadWithBoundaries of 4 bytes returns "abcd" and [2], and the next one
+// returns "e" and [1].
+func (b *StreamBuf) ReadWithBoundaries(p []byte) (n int, boundaries []int, err error) {
+	if b.cfg.observer == nil {
+		n, boundaries, _, err = b.recvBoundaries(p)
+		return n, boundaries, err
+	}
+
+	start := time.Now()
+	n, boundaries, blocked, err := b.recvBoundaries(p)
+	b.cfg.observer.ObserveRead(n, blocked, time.Since(start))
+	return n, boundaries, err
+}
+
+// recvBoundaries is the body of ReadWithBoundaries.
+func (b *StreamBuf) recvBoundaries(p []byte) (n int, boundaries []int, blocked bool, err error) {
+	timeout, stop := b.readTimer(nil)
+	defer stop()
+
+	b.rmu.Lock()
+	defer b.unlockRead()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if blocked, err = b.fetch(len(p), timeout, nil); err != nil {
+		return 0, nil, blocked, err
+	}
+
+	n = copy(p, b.rest.bytes())
+	boundaries = b.rest.boundaries(n)
+	b.consume(n)
+
+	return n, boundaries, blocked, nil
+}
+
+// ReadChunk reads exactly one chunk as it was written, instead of
+// the byte-stream of Read, and returns it as a slice owned by the caller.
+// If a previous Read has read a part of a chunk, ReadChunk returns
+// the rest of the chunk first. ReadChunk returns the empty chunks of
+// empty Writes as well, which are sent only with WithAllowEmptyWrites(true).
+// ReadChunk is blocked until a chunk arrives.
+// After Close, ReadChunk returns the remaining chunks, and then
+// ErrWriterClosed. Otherwise ReadChunk returns the same errors as Read.
+func (b *StreamBuf) ReadChunk() ([]byte, error) {
+	timeout, stop := b.readTimer(nil)
+	defer stop()
+
+	b.rmu.Lock()
+	defer b.unlockRead()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.readClosed() {
+		return nil, b.canceled(ErrClosed)
+	}
+	if n := b.rest.boundary(); n > 0 {
+		return b.cut(n), nil
+	}
+
+	c, ok, err := b.wait(timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, writerClosed(b.closedErr())
+	}
+	return b.detach(c), nil
+}
+
+// tryChunk is like ReadChunk, but returns ErrWouldBlock
+// instead of blocking if no chunk is available. The caller must hold b.rmu.
+func (b *StreamBuf) tryChunk() ([]byte, error) {
+	b.attach()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.readClosed() {
+		return nil, b.canceled(ErrClosed)
+	}
+	if n := b.rest.boundary(); n > 0 {
+		return b.cut(n), nil
+	}
+
+	select {
+	case c, ok := <-b.chbuf:
+		if !ok {
+			return nil, b.closedErr()
+		}
+		return b.detach(c), nil
+	default:
+		return nil, ErrWouldBlock
+	}
+}
+
+// detach returns the data of c, which is received from the inner channel,
+// as a slice owned by the caller, bypassing the rest slice.
+// The caller must hold b.mu.
+func (b *StreamBuf) detach(c chunk) []byte {
+	data := b.received(c)
+	b.stats.remove(len(c.data))
+	if !c.alloced {
+		return data
+	}
+	// the data must be given back to the allocator
+	p := make([]byte, len(data))
+	copy(p, data)
+	b.release(c)
+	return p
+}
+
+// ReadSlice is like Read, but returns a view of at most n bytes of
+// the memory of StreamBuf, instead of copying them, for zero-copy parsing.
+// Like Read, ReadSlice may return fewer bytes than n.
+// The returned slice is valid only until the next call of any method
+// reading StreamBuf, including Bytes, Snapshot, and Compact, which may
+// overwrite it, and the caller must not modify it.
+func (b *StreamBuf) ReadSlice(n int) ([]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	timeout, stop := b.readTimer(nil)
+	defer stop()
+
+	b.rmu.Lock()
+	defer b.unlockRead()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.fetch(n, timeout, nil); err != nil {
+		return nil, err
+	}
+	p := b.rest.bytes()[:min(n, b.rest.len())]
+	b.consume(len(p))
+	return p, nil
+}
+
+// Bytes returns a copy of all the data currently buffered in StreamBuf
+// without consuming it. The following Read returns the same data.
+// Bytes forces all buffered chunks to be fetched from the inner channel
+// and concatenated into one contiguous slice in memory.
+// Bytes waits for an in-progress Read to return, unless the Read is
+// blocked, when the inner channel holds no chunks for Bytes to fetch.
+func (b *StreamBuf) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+L:
+	for !b.parked {
+		select {
+		case c, ok := <-b.chbuf:
+			if !ok {
+				break L
+			}
+			b.take(c)
+		default:
+			break L
+		}
+	}
+
+	cp := make([]byte, b.rest.len())
+	copy(cp, b.rest.bytes())
+	return cp
+}
+
+// Snapshot returns a copy of all the data currently buffered in StreamBuf,
+// both the bytes fetched for Read and the chunks in the inner channel,
+// in the same way as Bytes. It lets a process persist the in-flight data
+// before shutdown, and resume it by RestoreStreamBuf. The snapshot is
+// a point-in-time copy: the writes done during or after Snapshot are not
+// captured, and StreamBuf is left as it is.
+func (b *StreamBuf) Snapshot() []byte {
+	return b.Bytes()
+}
+
+// RestoreStreamBuf generates a new StreamBuf which holds data taken
+// by Snapshot, in the same way as NewStreamBufFrom.
+func RestoreStreamBuf(nrChunks int, data []byte, opts ...Option) *StreamBuf {
+	return NewStreamBufFrom(nrChunks, data, opts...)
+}
+
+// LimitReader returns a Reader that reads at most n bytes from StreamBuf
+// and then reports io.EOF, like io.LimitReader.
+// Reaching the limit does not close StreamBuf, so the following data
+// stays available for subsequent reads.
+func (b *StreamBuf) LimitReader(n int64) io.Reader {
+	return io.LimitReader(b, n)
+}
+
+// DrainTo writes at most max bytes of the data currently buffered in
+// StreamBuf to w, and returns the number of bytes written.
+// Unlike Read, DrainTo never waits for data to arrive;
+// it stops when the buffered data runs out or max bytes are written.
+// DrainTo never waits for another read either: while a read is in progress,
+// such as a Read blocked for data, DrainTo returns (0, nil), since
+// that read takes the buffered data first.
+// DrainTo returns ErrWriterClosed when StreamBuf has been closed and drained,
+// ErrBrokenBuffer if the buffer is broken, the error of w, or
+// io.ErrShortWrite if w writes less than requested without an error.
+func (b *StreamBuf) DrainTo(w io.Writer, max int64) (int64, error) {
+	b.attach()
+	if !b.rmu.TryLock() {
+		return 0, nil
+	}
+	defer b.unlockRead()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var total int64
+	for total < max {
+		if b.rest.len() == 0 {
+			select {
+			case c, ok := <-b.chbuf:
+				if !ok {
+					return total, writerClosed(b.closedErr())
+				}
+				b.take(c)
+				continue
+			default:
+				return total, nil
+			}
+		}
+
+		provideLen := int64(b.rest.len())
+		if provideLen > max-total {
+			provideLen = max - total
+		}
+		n, err := w.Write(b.rest.bytes()[:provideLen])
+		b.consume(n)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		if int64(n) != provideLen {
+			return total, io.ErrShortWrite
+		}
+	}
+
+	return total, nil
+}
+
+// ReadToWriter reads at most n bytes from StreamBuf, and writes them
+// to w directly from the memory of StreamBuf without a buffer of the caller.
+// Like Read, ReadToWriter waits until some data is buffered, and may
+// transfer fewer bytes than n. Unlike DrainTo, which never waits,
+// ReadToWriter is bounded by n but blocks like Read. It returns
+// the number of bytes written to w, and the same errors as Read, the error
+// of w, or io.ErrShortWrite if w writes less than requested without an error.
+// The bytes not written to w are left in StreamBuf.
+func (b *StreamBuf) ReadToWriter(w io.Writer, n int) (int, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	timeout, stop := b.readTimer(nil)
+	defer stop()
+
+	b.rmu.Lock()
+	defer b.unlockRead()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.fetch(n, timeout, nil); err != nil {
+		return 0, err
+	}
+	m := min(n, b.rest.len())
+	written, err := w.Write(b.rest.bytes()[:m])
+	b.consume(written)
+	if err == nil && written != m {
+		err = io.ErrShortWrite
+	}
+	return written, err
+}
+
+// read calls recv and reports the result to the observer if any.
+// read does nothing if p is empty.
+func (b *StreamBuf) read(p []byte, timeout <-chan time.Time, cancel <-chan struct{}) (int, error) {
+	n, _, err := b.readBlocked(p, timeout, cancel)
+	return n, err
+}
+
+// readBlocked is like read, but also reports whether it was blocked.
+func (b *StreamBuf) readBlocked(p []byte, timeout <-chan time.Time, cancel <-chan struct{}) (int, bool, error) {
+	if len(p) == 0 {
+		return 0, false, nil
+	}
+	if b.cfg.observer == nil {
+		n, blocked, err := b.recv(p, timeout, cancel)
+		b.delay(err)
+		return n, blocked, err
+	}
+
+	start := time.Now()
+	n, blocked, err := b.recv(p, timeout, cancel)
+	b.cfg.observer.ObserveRead(n, blocked, time.Since(start))
+	b.delay(err)
+	return n, blocked, err
+}
+
+// recv is the body of Read. If timeout fires while recv is blocked,
+// recv returns a *TimeoutError, and if cancel fires, recv returns
+// ErrCanceled. Nil timeout and cancel block forever.
+// blocked reports whether recv had to wait for a chunk.
+func (b *StreamBuf) recv(p []byte, timeout <-chan time.Time, cancel <-chan struct{}) (n int, blocked bool, err error) {
+	timeout, stop := b.readTimer(timeout)
+	defer stop()
+	b.rmu.Lock()
+	defer b.unlockRead()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// with WithMinRead, the bytes fetched before the timeout or cancel
+	// are returned together with the error, like a socket read
+	if blocked, err = b.fetch(len(p), timeout, cancel); err != nil {
+		if _, ok := err.(*TimeoutError); b.rest.len() == 0 || !ok && err != ErrCanceled {
+			return 0, blocked, err
+		}
+	}
+
+	n = copy(p, b.rest.bytes())
+	b.consume(n)
+
+	return n, blocked, err
+}
+
+// fetch fetches chunks from the inner channel into the rest slice
+// for a read of want bytes, in the way described in recv.
+// The caller must hold b.mu.
+func (b *StreamBuf) fetch(want int, timeout <-chan time.Time, cancel <-chan struct{}) (blocked bool, err error) {
+	b.attach()
+	if b.readClosed() {
+		return false, b.canceled(ErrClosed)
+	}
+
+	// StreamBuf tries fetching more bytes from its inner channel
+	// until the the length of the rest slice is larger than the required length.
+	// If no more bytes in the channel, StreamBuf returns the largest possible
+	// length of data. A framed StreamBuf fetches a chunk only when
+	// the rest slice is empty, and then stops.
+	drained := false
+L:
+	for b.rest.len() < want && !(b.framed && b.rest.len() > 0) {
+		select {
+		case c, ok := <-b.chbuf:
+			if !ok {
+				drained = true
+				break L
+			}
+			b.take(c)
+		default:
+			break L
+		}
+	}
+
+	// If the rest slice is empty,
+	// Read will be blocked until StreamBuf fetches one chunk.
+	if b.rest.len() == 0 && want > 0 {
+		if drained {
+			return false, b.closedErr()
+		}
+
+		blocked = true
+		c, ok, err := b.wait(timeout, cancel)
+		if err != nil {
+			return true, err
+		}
+		if !ok {
+			return true, b.closedErr()
+		}
+		b.take(c)
+	}
+
+	// With WithMinRead, Read will be blocked until the rest slice holds
+	// the minimum, or StreamBuf is closed and the remaining bytes are returned.
+	for need := min(b.cfg.minRead, want); !b.framed && b.rest.len() < need; {
+		blocked = true
+		c, ok, err := b.wait(timeout, cancel)
+		if err != nil {
+			return true, err
+		}
+		if !ok {
+			break
+		}
+		b.take(c)
+	}
+
+	return blocked, nil
+}
+
+// unlockRead releases b.rmu, and wakes up SelectRead waiting for it.
+func (b *StreamBuf) unlockRead() {
+	b.rmu.Unlock()
+	wake(&b.rfree)
+}
+
+// park releases b.mu while the caller is blocked, so that the operations
+// which never block, such as Bytes and IndexedStreamBuf.ReadAt, are not
+// blocked behind it, and returns the function which takes b.mu back.
+// The caller must hold b.rmu and b.mu, and must not touch rest until then.
+func (b *StreamBuf) park() (unpark func()) {
+	b.parked = true
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		b.parked = false
+	}
+}
+
+// wait waits for a chunk from the inner channel, in the way described in recv.
+// ok is false if the inner channel is closed. The caller must hold b.rmu
+// and b.mu, and wait releases b.mu while it is blocked.
+func (b *StreamBuf) wait(timeout <-chan time.Time, cancel <-chan struct{}) (c chunk, ok bool, err error) {
+	b.attach()
+	// WithSpin polls the inner channel before parking the goroutine
+	for i := 0; i < b.cfg.spin; i++ {
+		select {
+		case c, ok = <-b.chbuf:
+			return c, ok, nil
+		default:
+		}
+	}
+
+	defer b.region("Read")()
+	defer b.park()()
+	select {
+	case c, ok = <-b.chbuf:
+		return c, ok, nil
+	case <-timeout:
+		return chunk{}, false, &TimeoutError{}
+	case <-cancel:
+		return chunk{}, false, ErrCanceled
+	case <-b.rdone:
+		return chunk{}, false, b.canceled(ErrClosed)
+	}
+}
+
+// Write implements io.Writer. Write writes len(p) bytes to StreamBuf.
+// When the StreamBuf is full, Write will be blocked. Write returns
+// ErrClosed after Close, CloseWrite or CloseWithError, io.ErrClosedPipe
+// after CloseRead, and ErrBrokenBuffer if the buffer is broken. It also
+// returns ErrTooLarge with WithMaxWriteSize, ErrNoReader with
+// WithRequireReader, a *TimeoutError with WithWriteTimeout, the error of
+// the interceptor given by WithWriteInterceptor, and ctx.Err() after ctx
+// given by WithCancel is done. The waits for the rate limit of
+// WithWriteRateLimit and for the budget of NewStreamBufBudgeted end with
+// the same errors. Write never returns ErrWouldBlock, which only TryWrite does.
+func (b *StreamBuf) Write(p []byte) (n int, err error) {
+	return b.write(p, nil)
+}
+
+// TryWrite is like Write, but never blocks: it returns ErrWouldBlock
+// instead if the inner channel is full, or the write would wait for
+// the rate limit of WithWriteRateLimit or for the budget of
+// NewStreamBufBudgeted. TryWrite returns the other errors of Write,
+// except the *TimeoutError.
+func (b *StreamBuf) TryWrite(p []byte) (n int, err error) {
+	return b.write(p, noWait)
+}
+
+// WriteTimeout is like Write, but gives up and returns a *TimeoutError
+// if the inner channel stays full for the duration d, which is used instead
+// of WithWriteTimeout. WriteTimeout returns the other errors of Write.
+func (b *StreamBuf) WriteTimeout(p []byte, d time.Duration) (n int, err error) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	return b.write(p, t.C)
+}
+
+// WriteVectored writes the concatenation of bufs to StreamBuf, like writev
+// or net.Buffers, and returns the total length of data in byte.
+// WriteVectored sends the concatenation as one chunk, instead of sending
+// each of bufs separately, so it is never interleaved with other Writes.
+// WriteVectored returns the same errors as Write.
+func (b *StreamBuf) WriteVectored(bufs ...[]byte) (int, error) {
+	size := 0
+	for _, p := range bufs {
+		size += len(p)
+	}
+	ch := b.alloc(size)
+	cp := ch.data[:0]
+	for _, p := range bufs {
+		cp = append(cp, p...)
+	}
+	return b.writeOwned(ch, nil)
+}
+
+// WriteMessage writes p to StreamBuf as one message, which is prefixed by
+// its length in 4-byte big-endian. The prefix and p are written as one chunk,
+// so a message is never interleaved with concurrent writes.
+// WriteMessage returns len(p) on success. It returns ErrTooLarge if
+// the length of p does not fit in the prefix, or the errors of Write.
+func (b *StreamBuf) WriteMessage(p []byte) (int, error) {
+	msg, err := message(p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := b.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// message returns p prefixed by its length for WriteMessage.
+func message(p []byte) ([]byte, error) {
+	if uint64(len(p)) > math.MaxUint32 {
+		return nil, ErrTooLarge
+	}
+
+	msg := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(msg, uint32(len(p)))
+	copy(msg[4:], p)
+	return msg, nil
+}
+
+// ReadMessage reads one message written by WriteMessage, and returns
+// its payload. ReadMessage blocks until the whole message arrives.
+// ReadMessage returns ErrWriterClosed if StreamBuf is closed at a message
+// boundary, and io.ErrUnexpectedEOF if it is closed in the middle of
+// a message. Otherwise it returns the errors of Read.
+func (b *StreamBuf) ReadMessage() ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(b, prefix[:]); err != nil {
+		return nil, writerClosed(err)
+	}
+
+	p := make([]byte, binary.BigEndian.Uint32(prefix[:]))
+	if _, err := io.ReadFull(b, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// WriteString implements io.StringWriter. WriteString writes s to
+// StreamBuf as one chunk in the same way as Write, without converting s
+// to a byte slice first.
+func (b *StreamBuf) WriteString(s string) (int, error) {
+	ch := b.alloc(len(s))
+	copy(ch.data, s)
+	return b.writeOwned(ch, nil)
+}
+
+// ReadString reads until the first occurrence of delim, like
+// bufio.Reader.ReadString, and returns a string of the data up to and
+// including delim. ReadString is blocked until delim arrives. If StreamBuf
+// is closed before delim, ReadString returns the remaining data and
+// ErrWriterClosed.
+// ReadString returns err != nil if and only if the returned data does not
+// end in delim. The other errors of Read leave the data for the next read.
+func (b *StreamBuf) ReadString(delim byte) (string, error) {
+	p, err := b.readUntil([]byte{delim})
+	return string(p), err
+}
+
+// ReadUntilBytes is like ReadString, but reads until the first occurrence
+// of the byte sequence delim, such as "\r\n", and returns the data up to
+// and including delim as a byte slice owned by the caller. delim may be
+// split across chunks. ReadUntilBytes panics if delim is empty.
+func (b *StreamBuf) ReadUntilBytes(delim []byte) ([]byte, error) {
+	if len(delim) == 0 {
+		panic("ebuf: empty delimiter")
+	}
+	return b.readUntil(delim)
+}
+
+// readUntil is the body of ReadString and ReadUntilBytes. It reads until
+// the first occurrence of delim, fetching chunks from the inner channel into
+// the rest slice until it holds delim. readUntil returns the data read
+// with ErrWriterClosed if StreamBuf is closed before delim. If the read fails
+// otherwise, readUntil returns no data, which is kept in the rest slice,
+// except ErrTokenTooLong, for which the data is discarded.
+func (b *StreamBuf) readUntil(delim []byte) ([]byte, error) {
+	timeout, stop := b.readTimer(nil)
+	defer stop()
+
+	b.rmu.Lock()
+	defer b.unlockRead()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.readClosed() {
+		return nil, b.canceled(ErrClosed)
+	}
+
+	scanned := 0 // the bytes of the rest slice known not to start delim
+	for {
+		if i := bytes.Index(b.rest.bytes()[scanned:], delim); i >= 0 {
+			return b.cut(scanned + i + len(delim)), nil
+		}
+		if limit := b.cfg.maxToken; limit > 0 && b.rest.len() > limit {
+			b.consume(b.rest.len())
+			return nil, ErrTokenTooLong
+		}
+		scanned = max(b.rest.len()-len(delim)+1, 0)
+
+		c, ok, err := b.wait(timeout, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return b.cut(b.rest.len()), writerClosed(b.closedErr())
+		}
+		b.take(c)
+	}
+}
+
+// cut returns a copy of the first n bytes of the rest slice, and consumes them.
+// The caller must hold b.mu.
+func (b *StreamBuf) cut(n int) []byte {
+	p := make([]byte, n)
+	copy(p, b.rest.bytes())
+	b.consume(n)
+	return p
+}
+
+// Close implements io.Closer. Close is the same as CloseWrite,
+// so the remaining data is still readable after Close.
+func (b *StreamBuf) Close() error {
+	return b.close()
+}
+
+// CloseHandoff closes StreamBuf like Close, and then moves all the remaining
+// data to dst, instead of leaving it to the readers of StreamBuf, so that
+// a connection can fail over to another StreamBuf without losing the bytes
+// in flight. The chunk boundaries are kept, and the chunks are written to dst
+// in order by Write, which may block until dst has room. If a write to dst
+// fails, CloseHandoff returns its error, and the data not moved yet stays
+// readable from StreamBuf. CloseHandoff also moves the data of StreamBuf
+// already closed, but returns ErrClosed after CloseRead. dst must not be
+// StreamBuf itself.
+func (b *StreamBuf) CloseHandoff(dst *StreamBuf) error {
+	b.close()
+
+	b.rmu.Lock()
+	defer b.unlockRead()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.readClosed() {
+		return b.canceled(ErrClosed)
+	}
+	// no writes can follow Close, so the inner channel runs out
+	for c := range b.chbuf {
+		b.take(c)
+	}
+	for b.rest.len() > 0 {
+		// the chunk is copied before b.mu is released, since Compact
+		// may move the bytes of rest while Write is blocked
+		n := b.rest.boundary()
+		cp := make([]byte, n)
+		copy(cp, b.rest.bytes())
+		unpark := b.park()
+		_, err := dst.writeOwned(chunk{data: cp}, nil)
+		unpark()
+		if err != nil {
+			return err
+		}
+		b.consume(n)
+	}
+	return nil
+}
+
+// CloseWithError is like Close, but the reads return err instead of io.EOF
+// after the remaining data, like io.PipeWriter.CloseWithError, and Err
+// returns err. CloseWithError(nil) is the same as Close.
+// Calling it more than once returns ErrAlreadyClosed
+// without overwriting the previous error.
+func (b *StreamBuf) CloseWithError(err error) error {
+	return b.closeWithError(err)
+}
+
+// Done returns a channel which is closed when StreamBuf is closed by Close,
+// CloseWrite, CloseWithError, or the context given by WithCancel, like
+// context.Context.Done. Done lets StreamBuf be watched in the select
+// statements of supervisors, with Err telling why it was closed.
+func (b *StreamBuf) Done() <-chan struct{} {
+	return b.done
+}
+
+// Err returns the reason why StreamBuf was closed: the error given to
+// CloseWithError, or the error of the context given by WithCancel.
+// Err returns nil if StreamBuf was closed cleanly by Close or CloseWrite,
+// or has not been closed yet.
+func (b *StreamBuf) Err() error {
+	if !b.writeClosed() {
+		return nil
+	}
+	if b.closeErr != nil {
+		return b.closeErr
+	}
+	if cause := b.cause.Load(); cause != nil {
+		return *cause
+	}
+	return nil
+}
+
+// Context returns a context which is canceled when StreamBuf is closed,
+// in the same way as Done, so that the goroutines downstream can tie
+// their lifecycle to StreamBuf. context.Cause of the context returns
+// the reason returned by Err, or ErrClosed if StreamBuf was closed cleanly.
+// The first call starts a goroutine, which exits when StreamBuf is closed,
+// and every call returns the same context.
+func (b *StreamBuf) Context() context.Context {
+	b.ctxOnce.Do(func() {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		b.ctx = ctx
+		go func() {
+			<-b.done
+			cause := b.Err()
+			if cause == nil {
+				cause = ErrClosed
+			}
+			cancel(cause)
+		}()
+	})
+	return b.ctx
+}
+
+// CloseWrite shuts down the writing side of StreamBuf, like
+// net.TCPConn.CloseWrite. Subsequent writes, including the ones blocked
+// at the moment, return ErrClosed. Reads return the remaining data,
+// and then io.EOF. Calling CloseWrite more than once returns ErrAlreadyClosed.
+func (b *StreamBuf) CloseWrite() error {
+	return b.close()
+}
+
+// CloseRead shuts down the reading side of StreamBuf, telling the writers
+// that no one reads any more. Subsequent writes, including the ones blocked
+// at the moment, return io.ErrClosedPipe, and subsequent reads return ErrClosed.
+// With NewStreamBufBudgeted, the bytes still buffered are given back to
+// the budget. Calling CloseRead more than once returns ErrAlreadyClosed.
+func (b *StreamBuf) CloseRead() error {
+	return b.closeRead()
+}
+
+// write copies p, calls send, and reports the result to the observer if any.
+// The copy is elided if WithCopyThreshold or WithNoCopy allows it.
+func (c *core) write(p []byte, timeout <-chan time.Time) (int, error) {
+	return c.writeOwned(c.own(p), timeout)
+}
+
+// own returns a chunk of a copy of p, or of p itself if WithCopyThreshold
+// or WithNoCopy elides the copy. In the latter case, debug builds seal p
+// so that the reader can detect modifications by the writer.
+func (c *core) own(p []byte) chunk {
+	if c.cfg.elides(len(p)) {
+		return chunk{data: p, guard: seal(p)}
+	}
+	ch := c.alloc(len(p))
+	copy(ch.data, p)
+	return ch
+}
+
+// alloc returns a chunk of n bytes allocated by WithAllocator if any.
+func (c *core) alloc(n int) chunk {
+	if c.cfg.alloc == nil {
+		return chunk{data: make([]byte, n)}
+	}
+	return chunk{data: c.cfg.alloc(n)[:n], alloced: true}
+}
+
+// release gives the data of ch back to the allocator of WithAllocator
+// if it is allocated by alloc. The caller must not use the data afterwards.
+func (c *core) release(ch chunk) {
+	if ch.alloced && c.cfg.free != nil {
+		c.cfg.free(ch.data)
+	}
+}
+
+// writeOwned is like write, but sends ch without copying its data,
+// so the caller must not modify the data afterwards.
+func (c *core) writeOwned(ch chunk, timeout <-chan time.Time) (int, error) {
+	if c.wtransform != nil {
+		return c.writeTransformed(ch, timeout)
+	}
+	if c.cfg.observer == nil {
+		n, _, err := c.send(ch, timeout)
+		return n, c.canceled(err)
+	}
+
+	start := time.Now()
+	n, blocked, err := c.send(ch, timeout)
+	c.cfg.observer.ObserveWrite(n, blocked, time.Since(start))
+	return n, c.canceled(err)
+}
+
+// send sends ch to the inner channel.
+// If timeout fires while send is blocked, send returns a *TimeoutError.
+// A nil timeout blocks forever, or until the deadline of WithWriteTimeout
+// if given, which bounds all the waits of send together, and noWait never
+// blocks but returns ErrWouldBlock. blocked reports whether send had to wait
+// for the inner channel, for the rate limit of WithWriteRateLimit,
+// or for the budget of NewStreamBufBudgeted.
+// n is 0 whenever err is not nil.
+func (c *core) send(ch chunk, timeout <-chan time.Time) (n int, blocked bool, err error) {
+	if len(ch.data) == 0 && !c.cfg.allowEmpty {
+		// a skipped empty write still fails after Close or CloseRead
+		c.release(ch)
+		switch {
+		case c.writeClosed():
+			return 0, false, ErrClosed
+		case c.readClosed():
+			return 0, false, io.ErrClosedPipe
+		}
+		return 0, false, nil
+	}
+	if err := c.admit(&ch); err != nil {
+		c.release(ch)
+		return 0, false, err
+	}
+	deadline := c.writeDeadline(timeout)
+	throttled, err := c.throttle(len(ch.data), timeout, deadline)
+	if err != nil {
+		c.release(ch)
+		return 0, throttled, err
+	}
+	waited, err := c.reserve(len(ch.data), timeout, deadline)
+	throttled = throttled || waited
+	if err != nil {
+		c.unthrottle(len(ch.data))
+		c.release(ch)
+		return 0, throttled, err
+	}
+	// for a blocked Write, the latency includes the blocked time
+	c.stamp(&ch)
+
+	sent, err := c.push(ch, false, nil)
+	if err == nil && !sent && c.regrow() {
+		// the inner channel shrunk by WithIdleShrink has room again
+		sent, err = c.push(ch, false, nil)
+	}
+	if err != nil {
+		c.unreserve(len(ch.data))
+		c.unthrottle(len(ch.data))
+		c.release(ch)
+		return 0, throttled, err
+	}
+	if sent {
+		c.sent(ch)
+		return len(ch.data), throttled, nil
+	}
+
+	switch c.cfg.overflow {
+	case DropNewest:
+		c.dropped.Add(1)
+		c.release(ch)
+		return len(ch.data), throttled, nil
+	case DropOldest:
+		if err := c.pushEvicting(ch); err != nil {
+			c.unreserve(len(ch.data))
+			c.unthrottle(len(ch.data))
+			c.release(ch)
+			return 0, throttled, err
+		}
+		return len(ch.data), throttled, nil
+	}
+
+	if timeout == noWait {
+		c.unreserve(len(ch.data))
+		c.unthrottle(len(ch.data))
+		c.release(ch)
+		return 0, throttled, ErrWouldBlock
+	}
+	if c.cfg.requireReader && !c.attached.Load() {
+		c.unreserve(len(ch.data))
+		c.unthrottle(len(ch.data))
+		c.release(ch)
+		return 0, throttled, ErrNoReader
+	}
+
+	// the inner channel is full, so the following send will be blocked.
+	// onBlock is called outside push, so that a panic in it is not
+	// mistaken for a closed channel.
+	if c.cfg.onBlock != nil {
+		c.cfg.onBlock(c.lenCap())
+	}
+
+	timeout, stop := until(timeout, deadline)
+	defer stop()
+	end := c.region("Write")
+	_, err = c.push(ch, true, timeout)
+	end()
+	if err != nil {
+		c.unreserve(len(ch.data))
+		c.unthrottle(len(ch.data))
+		c.release(ch)
+		return 0, true, err
+	}
+	c.sent(ch)
+	return len(ch.data), true, nil
+}
+
+// writeDeadline returns the time by which a write starting now gives up
+// by WithWriteTimeout, or the zero time if timeout is given instead,
+// or WithWriteTimeout is not given.
+func (c *core) writeDeadline(timeout <-chan time.Time) time.Time {
+	if timeout != nil || c.cfg.writeTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.cfg.writeTimeout)
+}
+
+// until returns timeout, or the channel of a timer which fires at deadline
+// if timeout is nil and deadline is not zero, with the function
+// which stops the timer. The timer is created only when a write blocks.
+func until(timeout <-chan time.Time, deadline time.Time) (<-chan time.Time, func()) {
+	if timeout != nil || deadline.IsZero() {
+		return timeout, nop
+	}
+	t := time.NewTimer(time.Until(deadline))
+	return t.C, func() { t.Stop() }
+}
+
+// admit checks ch against WithMaxWriteSize and the interceptor given by
+// WithWriteInterceptor, and computes its checksum if WithChecksum is given.
+func (c *core) admit(ch *chunk) error {
+	if c.cfg.maxWrite > 0 && len(ch.data) > c.cfg.maxWrite {
+		return ErrTooLarge
+	}
+	if c.cfg.intercept != nil {
+		if err := c.cfg.intercept(ch.data); err != nil {
+			return err
+		}
+	}
+	if c.cfg.checksum {
+		ch.sum, ch.summed = crc32.ChecksumIEEE(ch.data), true
+	}
+	return nil
+}
+
+// stamp records when ch is written,
+// if WithLatencyTracking or WithMaxAge is given.
+func (c *core) stamp(ch *chunk) {
+	if c.cfg.latency || c.cfg.maxAge > 0 {
+		ch.enq = time.Now()
+	}
+}
+
+// pushAll sends all of cs to the inner channel if it has room for all of
+// them, and otherwise sends none of them. While pushAll checks the room,
+// it stops the other reads and writes in the way described in
+// DatagramBuf.Grow, so that no other write takes the room.
+func (c *core) pushAll(cs []chunk) (sent bool, err error) {
+	c.chMu.Lock()
+	defer c.chMu.Unlock()
+
+	select {
+	case <-c.done:
+		return false, ErrClosed
+	case <-c.rdone:
+		return false, io.ErrClosedPipe
+	default:
+	}
+	if cap(c.chbuf)-len(c.chbuf) < len(cs) {
+		return false, nil
+	}
+
+	// wake up the blocked operations, and wait for all of them to leave
+	close(c.moved)
+	c.inflight.Wait()
+	defer func() { c.moved = make(chan struct{}) }()
+
+	if cap(c.chbuf)-len(c.chbuf) < len(cs) {
+		return false, nil
+	}
+	for _, ch := range cs {
+		c.chbuf <- ch
+	}
+	c.mark(len(c.chbuf))
+	return true, nil
+}
+
+// sent counts ch, which has been sent to the inner channel, in the stats
+// if any, and wakes up the waiters of arrived.
+func (c *core) sent(ch chunk) {
+	if c.stats != nil {
+		c.stats.add(len(ch.data))
+	} else {
+		c.queued.Add(int64(len(ch.data)))
+	}
+	wake(&c.arrival)
+}
+
+// taken uncounts ch, which has been taken from the inner channel,
+// in the bytes counted by sent.
+func (c *core) taken(ch chunk) {
+	if c.stats == nil {
+		c.queued.Add(-int64(len(ch.data)))
+	}
+}
+
+// arrived returns a channel which is closed when the next element
+// is sent to the inner channel.
+func (c *core) arrived() <-chan struct{} {
+	return waiter(&c.arrival)
+}
+
+// waiter returns the channel held by p, which is closed by the next wake,
+// making one if p holds none.
+func waiter(p *atomic.Pointer[chan struct{}]) <-chan struct{} {
+	for {
+		if a := p.Load(); a != nil {
+			return *a
+		}
+		a := make(chan struct{})
+		if p.CompareAndSwap(nil, &a) {
+			return a
+		}
+	}
+}
+
+// wake closes the channel held by p if any, waking up its waiters.
+func wake(p *atomic.Pointer[chan struct{}]) {
+	if p.Load() == nil {
+		return
+	}
+	if a := p.Swap(nil); a != nil {
+		close(*a)
+	}
+}
+
+// readTimer returns timeout, or the channel of a timer of WithReadTimeout
+// if timeout is nil and WithReadTimeout is given, with the function
+// which stops the timer.
+func (c *core) readTimer(timeout <-chan time.Time) (<-chan time.Time, func()) {
+	if timeout != nil || c.cfg.readTimeout <= 0 {
+		return timeout, nop
+	}
+	t := time.NewTimer(c.cfg.readTimeout)
+	return t.C, func() { t.Stop() }
+}
+
+// delay sleeps for the period given by WithReadDelay
+// after a successful read, whose error err is nil.
+func (c *core) delay(err error) {
+	if err == nil && c.cfg.readDelay > 0 {
+		time.Sleep(c.cfg.readDelay)
+	}
+}
+
+// mark updates the high-water mark with n elements in the inner channel.
+func (c *core) mark(n int) {
+	raise(&c.hwm, int64(n))
+	if c.cfg.idleAfter > 0 {
+		raise(&c.recent, int64(n))
+	}
+}
+
+// raise updates v to n if n is larger.
+func raise(v *atomic.Int64, n int64) {
+	for {
+		old := v.Load()
+		if n <= old || v.CompareAndSwap(old, n) {
+			break
+		}
+	}
+}
+
+// pushEvicting sends ch to the inner channel without blocking, evicting
+// the oldest elements of the channel until ch fits. Since other writers
+// and readers may race for the freed room, pushEvicting retries
+// until ch is sent. An unbuffered channel never holds an element to evict,
+// so pushEvicting drops ch instead.
+func (c *core) pushEvicting(ch chunk) error {
+	for {
+		if err := c.evict(); err != nil {
+			return err
+		}
+		if _, capacity := c.lenCap(); capacity == 0 {
+			c.dropped.Add(1)
+			c.release(ch)
+			return nil
+		}
+
+		sent, err := c.push(ch, false, nil)
+		if sent {
+			c.sent(ch)
+		}
+		if err != nil || sent {
+			return err
+		}
+	}
+}
+
+// evict discards the oldest element of the inner channel if any.
+func (c *core) evict() error {
+	q, _ := c.enter()
+	defer c.leave()
+
+	select {
+	case ev, ok := <-q:
+		if !ok {
+			return ErrBrokenBuffer
+		}
+		c.dropped.Add(1)
+		c.taken(ev)
+		c.release(ev)
+	default:
+	}
+	return nil
+}
+
+// push sends ch to the inner channel. If block is false, push gives up
+// and returns immediately when the inner channel is full.
+// push recovers the panic caused by sending on a closed channel,
+// and returns ErrBrokenBuffer instead.
+func (c *core) push(ch chunk, block bool, timeout <-chan time.Time) (sent bool, err error) {
+	for {
+		sent, moved, err := c.pushOnce(ch, block, timeout)
+		if !moved {
+			return sent, err
+		}
+	}
+}
+
+// pushOnce is the body of push. moved reports that the inner channel
+// has been replaced while pushOnce is blocked, and then push retries.
+func (c *core) pushOnce(ch chunk, block bool, timeout <-chan time.Time) (sent, moved bool, err error) {
+	q, movedc := c.enter()
+	defer c.leave()
+
+	defer func() {
+		if r := recover(); r != nil {
+			sent, moved, err = false, false, ErrBrokenBuffer
+		}
+	}()
+
+	c.closeMu.RLock()
+	defer c.closeMu.RUnlock()
+
+	select {
+	case <-c.done:
+		return false, false, ErrClosed
+	case <-c.rdone:
+		return false, false, io.ErrClosedPipe
+	default:
+	}
+
+	if !block {
+		select {
+		case q <- ch:
+			c.mark(len(q))
+			return true, false, nil
+		default:
+			return false, false, nil
+		}
+	}
+
+	select {
+	case q <- ch:
+		c.mark(len(q))
+		return true, false, nil
+	case <-movedc:
+		return false, true, nil
+	case <-timeout:
+		return false, false, &TimeoutError{}
+	case <-c.done:
+		return false, false, ErrClosed
+	case <-c.rdone:
+		return false, false, io.ErrClosedPipe
+	}
+}
+
+// recvChunk receives one chunk from the inner channel. If timeout fires while
+// recvChunk is blocked, recvChunk returns a *TimeoutError. A nil timeout
+// blocks forever. blocked reports whether recvChunk had to wait for a chunk.
+func (c *core) recvChunk(timeout <-chan time.Time) (ch chunk, blocked bool, err error) {
+	c.attach()
+	for {
+		ch, b, moved, err := c.recvOnce(timeout)
+		blocked = blocked || b
+		if !moved {
+			if err == nil {
+				c.taken(ch)
+			}
+			return ch, blocked, err
+		}
+	}
+}
+
+// recvOnce is the body of recvChunk. moved reports that the inner channel
+// has been replaced while recvOnce is blocked, and then recvChunk retries.
+func (c *core) recvOnce(timeout <-chan time.Time) (ch chunk, blocked, moved bool, err error) {
+	if c.readClosed() {
+		return chunk{}, false, false, ErrClosed
+	}
+
+	q, movedc := c.enter()
+	defer c.leave()
+
+	select {
+	case ch, ok := <-q:
+		if !ok {
+			return chunk{}, false, false, c.closedErr()
+		}
+		return ch, false, false, nil
+	default:
+	}
+
+	defer c.region("Read")()
+	select {
+	case ch, ok := <-q:
+		if !ok {
+			return chunk{}, true, false, c.closedErr()
+		}
+		return ch, true, false, nil
+	case <-movedc:
+		return chunk{}, true, true, nil
+	case <-timeout:
+		return chunk{}, true, false, &TimeoutError{}
+	case <-c.rdone:
+		return chunk{}, true, false, ErrClosed
+	}
+}
+
+// attach records that a reader has attached to the buffer.
+func (c *core) attach() {
+	if !c.attached.Load() {
+		c.attached.Store(true)
+	}
+}
+
+// watch starts a goroutine which closes the buffer when the context given
+// by WithCancel is done. The goroutine exits when the buffer is closed.
+func (c *core) watch() {
+	ctx := c.cfg.ctx
+	if ctx == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			err := ctx.Err()
+			c.cause.Store(&err)
+			c.closeRead()
+			c.close()
+		case <-c.done:
+		case <-c.rdone:
+		}
+	}()
+}
+
+// canceled replaces err with the error of the context given by WithCancel
+// if err is caused by the cancellation.
+func (c *core) canceled(err error) error {
+	if err != ErrClosed && err != io.ErrClosedPipe {
+		return err
+	}
+	if cause := c.cause.Load(); cause != nil {
+		return *cause
+	}
+	return err
+}
+
+// close closes the inner channel after waking up the blocked senders.
+// Only the first call closes the channel, and the later calls
+// return ErrAlreadyClosed.
+func (c *core) close() error {
+	return c.closeWithError(nil)
+}
+
+// closeWithError is like close, but the readers receive cause instead of
+// io.EOF after the remaining data, if cause is not nil.
+func (c *core) closeWithError(cause error) error {
+	err := ErrAlreadyClosed
+	c.closeOnce.Do(func() {
+		c.closeErr = cause
+		close(c.done)
+
+		// chMu waits for Grow, which never replaces chbuf after done is closed
+		c.chMu.Lock()
+		c.closeMu.Lock()
+		close(c.chbuf)
+		c.closeMu.Unlock()
+		c.chMu.Unlock()
+		err = nil
+	})
+	return err
+}
+
+// closeRead wakes up the blocked readers and writers, and makes
+// the subsequent reads and writes fail, giving back the bytes buffered
+// to the budget of NewStreamBufBudgeted. The inner channel is left open,
+// since writers are told by rdone. Only the first call has effect,
+// and the later calls return ErrAlreadyClosed.
+func (c *core) closeRead() error {
+	err := ErrAlreadyClosed
+	c.rcloseOnce.Do(func() {
+		close(c.rdone)
+		if c.stats != nil {
+			c.stats.detach()
+		}
+		err = nil
+	})
+	return err
+}
+
+// readClosed reports whether closeRead has been called.
+func (c *core) readClosed() bool {
+	select {
+	case <-c.rdone:
+		return true
+	default:
+		return false
+	}
+}
+
+// writerClosed replaces io.EOF with ErrWriterClosed.
+func writerClosed(err error) error {
+	if err == io.EOF {
+		return ErrWriterClosed
+	}
+	return err
+}
+
+// writeClosed reports whether the buffer has been closed by Close or CloseWrite.
+func (c *core) writeClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// closedErr returns the error for a closed inner channel: io.EOF, or
+// the error given to CloseWithError, if the buffer has been closed
+// by Close, otherwise ErrBrokenBuffer.
+func (c *core) closedErr() error {
+	select {
+	case <-c.done:
+		if c.closeErr != nil {
+			return c.closeErr
+		}
+		return io.EOF
+	default:
+		return ErrBrokenBuffer
+	}
+}
@@ -0,0 +1,164 @@
+package ebuf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClosedChannelRead(t *testing.T) {
+	dbuf := NewDatagramBuf(1)
+	sbuf := NewStreamBuf(1)
+	pbuf := NewPriorityDatagramBuf(1)
+
+	tests := []struct {
+		name string
+		ch   chbuf
+		read func([]byte) (int, error)
+	}{
+		{"DatagramBuf.Read", dbuf.chbuf, dbuf.Read},
+		{"StreamBuf.Read", sbuf.chbuf, sbuf.Read},
+		{"PriorityDatagramBuf.Read", pbuf.hi.chbuf, pbuf.Read},
+	}
+
+	for _, test := range tests {
+		// Read がブロックしている間に内部のチャネルを閉じる
+		type result struct {
+			n   int
+			err error
+		}
+		done := make(chan result)
+		go func() {
+			n, err := test.read(make([]byte, 1))
+			done <- result{n, err}
+		}()
+		time.Sleep(10 * time.Millisecond)
+		close(test.ch)
+
+		r := <-done
+		if r.n != 0 || r.err != ErrBrokenBuffer {
+			t.Errorf("[%s] expected (0, %v) (got (%d, %v))", test.name, ErrBrokenBuffer, r.n, r.err)
+		}
+	}
+}
+
+func TestClosedChannelWrite(t *testing.T) {
+	dbuf := NewDatagramBuf(1)
+	sbuf := NewStreamBuf(1)
+	pbuf := NewPriorityDatagramBuf(1)
+	fullDbuf := NewDatagramBuf(1)
+	fullDbuf.Write([]byte("a"))
+
+	// 送信と close の並行実行はそれ自体がデータ競合になるため,
+	// 閉じてから書き込み, panic せずに ErrBrokenBuffer が返ることを確認する
+	tests := []struct {
+		name  string
+		ch    chbuf
+		write func() (int, error)
+	}{
+		{"DatagramBuf.Write", dbuf.chbuf, func() (int, error) { return dbuf.Write([]byte("a")) }},
+		{"DatagramBuf.WriteTimeout", fullDbuf.chbuf, func() (int, error) { return fullDbuf.WriteTimeout([]byte("b"), time.Second) }},
+		{"StreamBuf.Write", sbuf.chbuf, func() (int, error) { return sbuf.Write([]byte("a")) }},
+		{"PriorityDatagramBuf.WriteLo", pbuf.lo.chbuf, func() (int, error) { return pbuf.WriteLo([]byte("a")) }},
+	}
+
+	for _, test := range tests {
+		close(test.ch)
+		n, err := test.write()
+		if n != 0 || err != ErrBrokenBuffer {
+			t.Errorf("[%s] expected (0, %v) (got (%d, %v))", test.name, ErrBrokenBuffer, n, err)
+		}
+	}
+}
+
+// restPattern is a fragmented pattern of interleaved writes and reads:
+// two 7-byte chunks are appended, and then read by 5, 5 and 4 bytes.
+var (
+	restChunk = []byte("abcdefg")
+	restReads = []int{5, 5, 4}
+)
+
+// BenchmarkRestAppend measures the former handling of StreamBuf.rest,
+// which appends chunks to a slice and re-slices it on every read.
+func BenchmarkRestAppend(b *testing.B) {
+	b.ReportAllocs()
+	p := make([]byte, 5)
+	rest := []byte{}
+	for i := 0; i < b.N; i++ {
+		rest = append(rest, restChunk...)
+		rest = append(rest, restChunk...)
+		for _, size := range restReads {
+			n := copy(p[:size], rest)
+			rest = rest[n:]
+		}
+	}
+}
+
+// BenchmarkRestOffset measures restBuf, which reuses its backing array.
+func BenchmarkRestOffset(b *testing.B) {
+	b.ReportAllocs()
+	p := make([]byte, 5)
+	var rest restBuf
+	for i := 0; i < b.N; i++ {
+		rest.append(restChunk)
+		rest.append(restChunk)
+		for _, size := range restReads {
+			n := copy(p[:size], rest.bytes())
+			rest.consume(n)
+		}
+	}
+}
+
+func TestStreamBufCompact(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		read func(*StreamBuf)
+	}{
+		{"Compact", nil, (*StreamBuf).Compact},
+		{"WithAutoCompact", []Option{WithAutoCompact()}, func(*StreamBuf) {}},
+	}
+	for _, test := range tests {
+		sbuf := NewStreamBuf(1, test.opts...)
+		large := make([]byte, 1<<20)
+		large[len(large)-1] = 'z'
+		if _, err := sbuf.Write(large); err != nil {
+			t.Errorf("[error] [%s] [Write]: %v", test.name, err)
+		}
+
+		// ほとんど読んだ後に Compact すると, 残りの大きさまで縮む
+		if _, err := sbuf.Read(make([]byte, len(large)-10)); err != nil {
+			t.Errorf("[error] [%s] [Read]: %v", test.name, err)
+		}
+		test.read(sbuf)
+		if c := cap(sbuf.rest.buf); c != 10 {
+			t.Errorf("[%s] expected 10 (got %d)", test.name, c)
+		}
+
+		// 残りのデータは失われない
+		p := make([]byte, 10)
+		if n, err := sbuf.Read(p); n != 10 || err != nil || p[9] != 'z' {
+			t.Errorf("[%s] expected the rest (got %d, %v, %v)", test.name, n, err, p)
+		}
+	}
+}
+
+func TestStreamBufReadSlice(t *testing.T) {
+	sbuf := NewStreamBuf(2)
+	sbuf.Write([]byte("abcd"))
+
+	p, err := sbuf.ReadSlice(4)
+	if err != nil || string(p) != "abcd" {
+		t.Fatalf("expected abcd, <nil> (got %s, %v)", p, err)
+	}
+	// 返されたスライスは内部のメモリを指している
+	if &p[0] != &sbuf.rest.buf[:1][0] {
+		t.Errorf("expected the slice to alias the rest slice")
+	}
+
+	// 次の読み出しで上書きされる
+	sbuf.Write([]byte("wxyz"))
+	sbuf.Read(make([]byte, 1))
+	if string(p) != "wxyz" {
+		t.Errorf("expected wxyz (got %s)", p)
+	}
+}
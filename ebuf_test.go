@@ -2,6 +2,16 @@ package ebuf_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
@@ -249,3 +259,3490 @@ func TestStreamBufBlockingRead(t *testing.T) {
 		}
 	}
 }
+
+func TestTimeoutError(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(1)
+	sbuf := ebuf.NewStreamBuf(1)
+
+	// 容量 1 のバッファを埋めておき, 次の書き込みをタイムアウトさせる
+	if _, err := dbuf.Write([]byte("a")); err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [Write]: %v", err)
+	}
+	if _, err := sbuf.Write([]byte("a")); err != nil {
+		t.Fatalf("[error] [Stream Buffer] [Write]: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		op   func() (int, error)
+	}{
+		{"DatagramBuf.WriteTimeout", func() (int, error) { return dbuf.WriteTimeout([]byte("b"), time.Millisecond) }},
+		{"StreamBuf.WriteTimeout", func() (int, error) { return sbuf.WriteTimeout([]byte("b"), time.Millisecond) }},
+		{"DatagramBuf.ReadTimeout", func() (int, error) {
+			if _, err := dbuf.Read(make([]byte, 1)); err != nil {
+				return 0, err
+			}
+			return dbuf.ReadTimeout(make([]byte, 1), time.Millisecond)
+		}},
+		{"StreamBuf.ReadTimeout", func() (int, error) {
+			if _, err := sbuf.Read(make([]byte, 1)); err != nil {
+				return 0, err
+			}
+			return sbuf.ReadTimeout(make([]byte, 1), time.Millisecond)
+		}},
+	}
+
+	for _, test := range tests {
+		n, err := test.op()
+		if n != 0 {
+			t.Errorf("[%s] expected 0 byte (got %d)", test.name, n)
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("[%s] expected os.ErrDeadlineExceeded (got %v)", test.name, err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("[%s] expected context.DeadlineExceeded (got %v)", test.name, err)
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("[%s] expected net.Error with Timeout() (got %v)", test.name, err)
+		}
+	}
+}
+
+func TestStreamBufBytes(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(5)
+	inputs := [][]byte{[]byte("ab"), []byte("cde"), []byte("f")}
+	for i, in := range inputs {
+		if _, err := sbuf.Write(in); err != nil {
+			t.Fatalf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+		}
+	}
+
+	// 一部を読んでから Bytes を呼ぶ
+	head := make([]byte, 1)
+	if _, err := sbuf.Read(head); err != nil {
+		t.Fatalf("[error] [Stream Buffer] [Read]: %v", err)
+	}
+
+	expected := []byte("bcdef")
+	actual := sbuf.Bytes()
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("expected %v (got %v)", expected, actual)
+	}
+	// 2 回目の Bytes も同じ内容を返す
+	if again := sbuf.Bytes(); !bytes.Equal(expected, again) {
+		t.Errorf("expected %v (got %v)", expected, again)
+	}
+
+	// Bytes は消費しないので Read で同じデータが読める
+	p := make([]byte, 10)
+	n, err := sbuf.Read(p)
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [Read]: %v", err)
+	}
+	if !bytes.Equal(expected, p[:n]) {
+		t.Errorf("expected %v (got %v)", expected, p[:n])
+	}
+}
+
+func TestStreamBufLimitReader(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(5)
+
+	// 2 バイトの長さプレフィックス付きのフレームを分割して書き込む
+	frames := [][]byte{[]byte("hello"), []byte("ebuf")}
+	go func() {
+		for i, f := range frames {
+			var prefix [2]byte
+			binary.BigEndian.PutUint16(prefix[:], uint16(len(f)))
+			if _, err := sbuf.Write(prefix[:]); err != nil {
+				t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+			}
+			for j := range f {
+				if _, err := sbuf.Write(f[j : j+1]); err != nil {
+					t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+				}
+			}
+		}
+	}()
+
+	for i, expected := range frames {
+		var prefix [2]byte
+		if _, err := io.ReadFull(sbuf, prefix[:]); err != nil {
+			t.Fatalf("[error] [Stream Buffer] [Read %d]: %v", i, err)
+		}
+		n := int64(binary.BigEndian.Uint16(prefix[:]))
+		actual, err := io.ReadAll(sbuf.LimitReader(n))
+		if err != nil {
+			t.Errorf("[error] [Stream Buffer] [Read %d]: %v", i, err)
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Errorf("expected %v (got %v)", expected, actual)
+		}
+	}
+}
+
+func TestDatagramBufIterators(t *testing.T) {
+	inputs := [][]byte{[]byte("a"), []byte("bc"), []byte("def")}
+	dbuf := ebuf.NewDatagramBuf(len(inputs) * 2)
+	for i := 0; i < 2; i++ {
+		for j, in := range inputs {
+			if _, err := dbuf.Write(in); err != nil {
+				t.Fatalf("[error] [Datagram Buffer] [Write %d-%d]: %v", i, j, err)
+			}
+		}
+	}
+
+	// All で先頭から順に読む
+	var i int
+	for d := range dbuf.All() {
+		if !bytes.Equal(inputs[i], d) {
+			t.Errorf("expected %v (got %v)", inputs[i], d)
+		}
+		i++
+		if i == len(inputs) {
+			break
+		}
+	}
+
+	// 残りを Datagrams で読む
+	ch := dbuf.Datagrams()
+	for _, expected := range inputs {
+		if d := <-ch; !bytes.Equal(expected, d) {
+			t.Errorf("expected %v (got %v)", expected, d)
+		}
+	}
+}
+
+func TestWithOnBlock(t *testing.T) {
+	type call struct {
+		queued, cap int
+	}
+	calls := make(chan call, 1)
+	onBlock := func(queued, cap int) {
+		calls <- call{queued, cap}
+	}
+
+	dbuf := ebuf.NewDatagramBuf(1, ebuf.WithOnBlock(onBlock))
+	sbuf := ebuf.NewStreamBuf(1, ebuf.WithOnBlock(onBlock))
+
+	tests := []struct {
+		name  string
+		write func([]byte) (int, error)
+		read  func([]byte) (int, error)
+	}{
+		{"Datagram Buffer", dbuf.Write, dbuf.Read},
+		{"Stream Buffer", sbuf.Write, sbuf.Read},
+	}
+
+	for _, test := range tests {
+		// 1 つ目の書き込みはブロックしない
+		if _, err := test.write([]byte("a")); err != nil {
+			t.Fatalf("[error] [%s] [Write]: %v", test.name, err)
+		}
+		select {
+		case c := <-calls:
+			t.Errorf("[%s] unexpected callback %v", test.name, c)
+		default:
+		}
+
+		// 2 つ目の書き込みはバッファが一杯なのでブロックする
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, err := test.write([]byte("b")); err != nil {
+				t.Errorf("[error] [%s] [Write]: %v", test.name, err)
+			}
+		}()
+
+		c := <-calls
+		if c.queued != 1 || c.cap != 1 {
+			t.Errorf("[%s] expected {1 1} (got %v)", test.name, c)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := test.read(make([]byte, 1)); err != nil {
+				t.Errorf("[error] [%s] [Read]: %v", test.name, err)
+			}
+		}
+		<-done
+	}
+}
+
+type observation struct {
+	bytes   int
+	blocked bool
+}
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	writes []observation
+	reads  []observation
+}
+
+func (o *recordingObserver) ObserveWrite(bytes int, blocked bool, d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.writes = append(o.writes, observation{bytes, blocked})
+}
+
+func (o *recordingObserver) ObserveRead(bytes int, blocked bool, d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.reads = append(o.reads, observation{bytes, blocked})
+}
+
+func TestWithObserver(t *testing.T) {
+	newBufs := map[string]func(ebuf.Observer) (func([]byte) (int, error), func([]byte) (int, error)){
+		"Datagram Buffer": func(obs ebuf.Observer) (func([]byte) (int, error), func([]byte) (int, error)) {
+			dbuf := ebuf.NewDatagramBuf(1, ebuf.WithObserver(obs))
+			return dbuf.Write, dbuf.Read
+		},
+		"Stream Buffer": func(obs ebuf.Observer) (func([]byte) (int, error), func([]byte) (int, error)) {
+			sbuf := ebuf.NewStreamBuf(1, ebuf.WithObserver(obs))
+			return sbuf.Write, sbuf.Read
+		},
+	}
+
+	for name, newBuf := range newBufs {
+		obs := &recordingObserver{}
+		write, read := newBuf(obs)
+
+		// 1 つ目の書き込みはブロックしない
+		if _, err := write([]byte("ab")); err != nil {
+			t.Fatalf("[error] [%s] [Write]: %v", name, err)
+		}
+		// 2 つ目の書き込みはバッファが一杯なのでブロックする
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, err := write([]byte("cde")); err != nil {
+				t.Errorf("[error] [%s] [Write]: %v", name, err)
+			}
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		for i, size := range []int{2, 3} {
+			if _, err := read(make([]byte, size)); err != nil {
+				t.Errorf("[error] [%s] [Read %d]: %v", name, i, err)
+			}
+		}
+		<-done
+
+		// 2 つ目の読み込みがブロックしたかどうかはタイミング次第なので, 1 つ目だけ確認する
+		expectedWrites := []observation{{2, false}, {3, true}}
+		expectedReads := []observation{{2, false}}
+
+		obs.mu.Lock()
+		if len(obs.writes) != len(expectedWrites) {
+			t.Fatalf("[%s] expected %d writes (got %d)", name, len(expectedWrites), len(obs.writes))
+		}
+		for i, ex := range expectedWrites {
+			if obs.writes[i] != ex {
+				t.Errorf("[%s] [Write %d] expected %v (got %v)", name, i, ex, obs.writes[i])
+			}
+		}
+		if len(obs.reads) != 2 {
+			t.Fatalf("[%s] expected 2 reads (got %d)", name, len(obs.reads))
+		}
+		for i, ex := range expectedReads {
+			if obs.reads[i] != ex {
+				t.Errorf("[%s] [Read %d] expected %v (got %v)", name, i, ex, obs.reads[i])
+			}
+		}
+		obs.mu.Unlock()
+	}
+}
+
+func TestDatagramBufWriteFromReader(t *testing.T) {
+	tests := []struct {
+		input     []byte
+		frameSize int
+		expected  [][]byte
+	}{
+		{
+			// 入力がフレームサイズで割り切れる
+			[]byte("abcdef"),
+			3,
+			[][]byte{[]byte("abc"), []byte("def")},
+		},
+		{
+			// 最後のフレームはフレームサイズより短い
+			[]byte("abcdefg"),
+			3,
+			[][]byte{[]byte("abc"), []byte("def"), []byte("g")},
+		},
+		{
+			// 入力が空
+			[]byte{},
+			3,
+			nil,
+		},
+	}
+
+	for i, test := range tests {
+		dbuf := ebuf.NewDatagramBuf(len(test.expected))
+		n, err := dbuf.WriteFromReader(bytes.NewReader(test.input), test.frameSize)
+		if err != nil {
+			t.Errorf("[error] [Datagram Buffer] [WriteFromReader %d]: %v", i, err)
+		}
+		if n != len(test.expected) {
+			t.Errorf("[%d] expected %d datagrams (got %d)", i, len(test.expected), n)
+		}
+		for j, ex := range test.expected {
+			actual := make([]byte, test.frameSize)
+			n, err := dbuf.Read(actual)
+			if err != nil {
+				t.Errorf("[error] [Datagram Buffer] [Read %d-%d]: %v", i, j, err)
+			}
+			if !bytes.Equal(ex, actual[:n]) {
+				t.Errorf("[%d-%d] expected %s (got %s)", i, j, ex, actual[:n])
+			}
+		}
+	}
+}
+
+func TestStreamBufDrainTo(t *testing.T) {
+	inputs := [][]byte{[]byte("ab"), []byte("cde"), []byte("f")}
+	tests := []struct {
+		max      int64
+		expected []byte
+	}{
+		// バッファされている量より小さい
+		{4, []byte("abcd")},
+		// バッファされている量と同じ
+		{6, []byte("abcdef")},
+		// バッファされている量より大きい (ブロックしない)
+		{10, []byte("abcdef")},
+	}
+
+	for i, test := range tests {
+		sbuf := ebuf.NewStreamBuf(len(inputs))
+		for j, in := range inputs {
+			if _, err := sbuf.Write(in); err != nil {
+				t.Fatalf("[error] [Stream Buffer] [Write %d-%d]: %v", i, j, err)
+			}
+		}
+
+		var w bytes.Buffer
+		n, err := sbuf.DrainTo(&w, test.max)
+		if err != nil {
+			t.Errorf("[error] [Stream Buffer] [DrainTo %d]: %v", i, err)
+		}
+		if n != int64(len(test.expected)) || !bytes.Equal(test.expected, w.Bytes()) {
+			t.Errorf("[%d] expected %s (got %s, %d byte)", i, test.expected, w.Bytes(), n)
+		}
+
+		// 残りのデータは Read で読める
+		if rest := sbuf.Bytes(); !bytes.Equal([]byte("abcdef")[n:], rest) {
+			t.Errorf("[%d] expected rest %s (got %s)", i, []byte("abcdef")[n:], rest)
+		}
+	}
+}
+
+func TestStreamBufDrainToWhileReadBlocked(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(1)
+	read := make(chan string)
+	go func() {
+		p := make([]byte, 3)
+		n, _ := sbuf.Read(p)
+		read <- string(p[:n])
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Read がブロックしていても DrainTo は待たずに返る
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var w bytes.Buffer
+		if n, err := sbuf.DrainTo(&w, 10); n != 0 || err != nil {
+			t.Errorf("expected 0, <nil> (got %d, %v)", n, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("DrainTo is blocked behind Read")
+	}
+
+	sbuf.Write([]byte("abc"))
+	if s := <-read; s != "abc" {
+		t.Errorf("expected abc (got %s)", s)
+	}
+}
+
+func TestWithOverflowPolicy(t *testing.T) {
+	inputs := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	tests := []struct {
+		policy   ebuf.OverflowPolicy
+		expected [][]byte
+		dropped  uint64
+	}{
+		// 古いデータグラムから残る
+		{ebuf.DropNewest, [][]byte{[]byte("a"), []byte("b")}, 2},
+		// 新しいデータグラムが残る
+		{ebuf.DropOldest, [][]byte{[]byte("c"), []byte("d")}, 2},
+	}
+
+	for i, test := range tests {
+		dbuf := ebuf.NewDatagramBuf(2, ebuf.WithOverflowPolicy(test.policy))
+		for j, in := range inputs {
+			n, err := dbuf.Write(in)
+			if err != nil || n != len(in) {
+				t.Errorf("[error] [Datagram Buffer] [Write %d-%d]: %v (%d byte)", i, j, err, n)
+			}
+		}
+		if dropped := dbuf.Dropped(); dropped != test.dropped {
+			t.Errorf("[%d] expected %d dropped (got %d)", i, test.dropped, dropped)
+		}
+		for j, ex := range test.expected {
+			actual := make([]byte, 1)
+			if _, err := dbuf.Read(actual); err != nil {
+				t.Errorf("[error] [Datagram Buffer] [Read %d-%d]: %v", i, j, err)
+			}
+			if !bytes.Equal(ex, actual) {
+				t.Errorf("[%d-%d] expected %s (got %s)", i, j, ex, actual)
+			}
+		}
+	}
+
+	// BlockOnFull では 3 つ目の書き込みがブロックする
+	dbuf := ebuf.NewDatagramBuf(2, ebuf.WithOverflowPolicy(ebuf.BlockOnFull))
+	for j, in := range inputs[:2] {
+		if _, err := dbuf.Write(in); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Write %d]: %v", j, err)
+		}
+	}
+	if _, err := dbuf.WriteTimeout(inputs[2], 10*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected timeout (got %v)", err)
+	}
+	if dropped := dbuf.Dropped(); dropped != 0 {
+		t.Errorf("expected 0 dropped (got %d)", dropped)
+	}
+}
+
+func TestStreamBufReadTimeoutPartial(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(1)
+	if _, err := sbuf.Write([]byte("ab")); err != nil {
+		t.Fatalf("[error] [Stream Buffer] [Write]: %v", err)
+	}
+
+	// p より少ないデータしかなくても, タイムアウトを待たずに部分的なデータを返す
+	const timeout = 100 * time.Millisecond
+	actual := make([]byte, 5)
+	start := time.Now()
+	n, err := sbuf.ReadTimeout(actual, timeout)
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [ReadTimeout]: %v", err)
+	}
+	if !bytes.Equal([]byte("ab"), actual[:n]) {
+		t.Errorf("expected ab (got %s)", actual[:n])
+	}
+	if elapsed := time.Since(start); elapsed >= timeout {
+		t.Errorf("expected to return before the timeout (took %v)", elapsed)
+	}
+
+	// 何もバッファされていなければタイムアウトする
+	n, err = sbuf.ReadTimeout(actual, 10*time.Millisecond)
+	if n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected (0, timeout) (got (%d, %v))", n, err)
+	}
+}
+
+func TestStreamBufReadOrCancel(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(1)
+	if _, err := sbuf.Write([]byte("ab")); err != nil {
+		t.Fatalf("[error] [Stream Buffer] [Write]: %v", err)
+	}
+
+	// バッファされたデータはキャンセルを待たずに返す
+	cancel := make(chan struct{})
+	actual := make([]byte, 5)
+	n, err := sbuf.ReadOrCancel(actual, cancel)
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [ReadOrCancel]: %v", err)
+	}
+	if !bytes.Equal([]byte("ab"), actual[:n]) {
+		t.Errorf("expected ab (got %s)", actual[:n])
+	}
+
+	// ブロック中にキャンセルされると ErrCanceled を返す
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(cancel)
+	}()
+	n, err = sbuf.ReadOrCancel(actual, cancel)
+	if n != 0 || err != ebuf.ErrCanceled {
+		t.Errorf("expected (0, %v) (got (%d, %v))", ebuf.ErrCanceled, n, err)
+	}
+
+	// キャンセル後もデータは失われない
+	if _, err := sbuf.Write([]byte("cd")); err != nil {
+		t.Fatalf("[error] [Stream Buffer] [Write]: %v", err)
+	}
+	n, err = sbuf.Read(actual)
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [Read]: %v", err)
+	}
+	if !bytes.Equal([]byte("cd"), actual[:n]) {
+		t.Errorf("expected cd (got %s)", actual[:n])
+	}
+}
+
+func TestDatagramBufAvailable(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(3)
+	if a := dbuf.Available(); a != 3 {
+		t.Errorf("expected 3 (got %d)", a)
+	}
+
+	// 書き込むごとに減る
+	for i := 1; i <= 3; i++ {
+		if _, err := dbuf.Write([]byte("a")); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Write %d]: %v", i, err)
+		}
+		if a := dbuf.Available(); a != 3-i {
+			t.Errorf("[Write %d] expected %d (got %d)", i, 3-i, a)
+		}
+	}
+
+	// 読むごとに増える
+	for i := 1; i <= 3; i++ {
+		if _, err := dbuf.Read(make([]byte, 1)); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Read %d]: %v", i, err)
+		}
+		if a := dbuf.Available(); a != i {
+			t.Errorf("[Read %d] expected %d (got %d)", i, i, a)
+		}
+	}
+}
+
+func TestWriteAvailable(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(3)
+	sbuf := ebuf.NewStreamBuf(3)
+
+	tests := []struct {
+		name      string
+		buf       io.ReadWriter
+		available func() int
+	}{
+		{"Datagram Buffer", dbuf, dbuf.WriteAvailable},
+		{"Stream Buffer", sbuf, sbuf.WriteAvailable},
+	}
+
+	for _, test := range tests {
+		// 空きがなくなるまで書き込む
+		n := 0
+		for a := test.available(); a > 0; a = test.available() {
+			if _, err := test.buf.Write([]byte("ab")); err != nil {
+				t.Errorf("[error] [%s] [Write %d]: %v", test.name, n, err)
+			}
+			n++
+		}
+		if n != 3 {
+			t.Errorf("[%s] expected 3 writes (got %d)", test.name, n)
+		}
+
+		// 読むと空きが戻る
+		if _, err := test.buf.Read(make([]byte, 2)); err != nil {
+			t.Errorf("[error] [%s] [Read]: %v", test.name, err)
+		}
+		if a := test.available(); a != 1 {
+			t.Errorf("[%s] expected 1 (got %d)", test.name, a)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(1)
+	sbuf := ebuf.NewStreamBuf(1)
+
+	tests := []struct {
+		name  string
+		write func([]byte) (int, error)
+		read  func([]byte) (int, error)
+		close func() error
+	}{
+		{"Datagram Buffer", dbuf.Write, dbuf.Read, dbuf.Close},
+		{"Stream Buffer", sbuf.Write, sbuf.Read, sbuf.Close},
+	}
+
+	for _, test := range tests {
+		if _, err := test.write([]byte("ab")); err != nil {
+			t.Fatalf("[error] [%s] [Write]: %v", test.name, err)
+		}
+
+		// バッファが一杯でブロックしている書き込みは Close で ErrClosed を返す
+		done := make(chan error)
+		go func() {
+			_, err := test.write([]byte("cd"))
+			done <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if err := test.close(); err != nil {
+			t.Errorf("[error] [%s] [Close]: %v", test.name, err)
+		}
+		if err := <-done; err != ebuf.ErrClosed {
+			t.Errorf("[%s] expected %v (got %v)", test.name, ebuf.ErrClosed, err)
+		}
+
+		// Close 後の書き込みも ErrClosed を返す
+		if n, err := test.write([]byte("ef")); n != 0 || err != ebuf.ErrClosed {
+			t.Errorf("[%s] expected (0, %v) (got (%d, %v))", test.name, ebuf.ErrClosed, n, err)
+		}
+		// 2 回目の Close は ErrAlreadyClosed を返す
+		if err := test.close(); err != ebuf.ErrAlreadyClosed {
+			t.Errorf("[%s] expected %v (got %v)", test.name, ebuf.ErrAlreadyClosed, err)
+		}
+
+		// 残りのデータを読んだ後は io.EOF を返す
+		actual := make([]byte, 5)
+		n, err := test.read(actual)
+		if err != nil {
+			t.Errorf("[error] [%s] [Read]: %v", test.name, err)
+		}
+		if !bytes.Equal([]byte("ab"), actual[:n]) {
+			t.Errorf("[%s] expected ab (got %s)", test.name, actual[:n])
+		}
+		if n, err := test.read(actual); n != 0 || err != io.EOF {
+			t.Errorf("[%s] expected (0, %v) (got (%d, %v))", test.name, io.EOF, n, err)
+		}
+	}
+}
+
+func TestStreamBufMessage(t *testing.T) {
+	messages := [][]byte{[]byte("hello"), {}, []byte("ebuf")}
+
+	sbuf := ebuf.NewStreamBuf(len(messages) + 1)
+	for i, m := range messages {
+		n, err := sbuf.WriteMessage(m)
+		if err != nil || n != len(m) {
+			t.Fatalf("[error] [Stream Buffer] [WriteMessage %d]: %v (%d byte)", i, err, n)
+		}
+	}
+	if err := sbuf.Close(); err != nil {
+		t.Fatalf("[error] [Stream Buffer] [Close]: %v", err)
+	}
+
+	// 連続したメッセージを境界を保って読む
+	for i, ex := range messages {
+		actual, err := sbuf.ReadMessage()
+		if err != nil {
+			t.Errorf("[error] [Stream Buffer] [ReadMessage %d]: %v", i, err)
+		}
+		if !bytes.Equal(ex, actual) {
+			t.Errorf("[%d] expected %s (got %s)", i, ex, actual)
+		}
+	}
+	// メッセージの境界で閉じられていれば ErrWriterClosed
+	if _, err := sbuf.ReadMessage(); err != ebuf.ErrWriterClosed {
+		t.Errorf("expected %v (got %v)", ebuf.ErrWriterClosed, err)
+	}
+
+	tails := []struct {
+		name string
+		tail []byte
+	}{
+		// 長さプレフィックスの途中で閉じられた
+		{"truncated prefix", []byte{0, 0}},
+		// ペイロードの途中で閉じられた
+		{"truncated payload", []byte{0, 0, 0, 5, 'a', 'b'}},
+	}
+	for _, test := range tails {
+		sbuf := ebuf.NewStreamBuf(2)
+		if _, err := sbuf.WriteMessage([]byte("ok")); err != nil {
+			t.Fatalf("[error] [Stream Buffer] [WriteMessage]: %v", err)
+		}
+		if _, err := sbuf.Write(test.tail); err != nil {
+			t.Fatalf("[error] [Stream Buffer] [Write]: %v", err)
+		}
+		sbuf.Close()
+
+		if actual, err := sbuf.ReadMessage(); err != nil || !bytes.Equal([]byte("ok"), actual) {
+			t.Errorf("[%s] expected ok (got %s, %v)", test.name, actual, err)
+		}
+		if _, err := sbuf.ReadMessage(); err != io.ErrUnexpectedEOF {
+			t.Errorf("[%s] expected %v (got %v)", test.name, io.ErrUnexpectedEOF, err)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	// 負の容量では panic し, Checked 版はエラーを返す
+	for name, newBuf := range map[string]func(){
+		"NewDatagramBuf": func() { ebuf.NewDatagramBuf(-1) },
+		"NewStreamBuf":   func() { ebuf.NewStreamBuf(-1) },
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("[%s] expected panic", name)
+				}
+			}()
+			newBuf()
+		}()
+	}
+	if _, err := ebuf.NewDatagramBufChecked(-1); err != ebuf.ErrNegativeCapacity {
+		t.Errorf("expected %v (got %v)", ebuf.ErrNegativeCapacity, err)
+	}
+	if _, err := ebuf.NewStreamBufChecked(-1); err != ebuf.ErrNegativeCapacity {
+		t.Errorf("expected %v (got %v)", ebuf.ErrNegativeCapacity, err)
+	}
+
+	for _, n := range []int{0, 1} {
+		dbuf, err := ebuf.NewDatagramBufChecked(n)
+		if err != nil {
+			t.Fatalf("[error] [Datagram Buffer] [%d]: %v", n, err)
+		}
+		sbuf, err := ebuf.NewStreamBufChecked(n)
+		if err != nil {
+			t.Fatalf("[error] [Stream Buffer] [%d]: %v", n, err)
+		}
+
+		for name, buf := range map[string]io.ReadWriter{"Datagram Buffer": dbuf, "Stream Buffer": sbuf} {
+			// 容量 n までは読み手がいなくても書き込める
+			for i := 0; i < n; i++ {
+				if _, err := buf.Write([]byte("a")); err != nil {
+					t.Errorf("[error] [%s] [%d] [Write]: %v", name, n, err)
+				}
+			}
+			// 容量を超える書き込みは読み手に直接渡されるまでブロックする
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				if _, err := buf.Write([]byte("b")); err != nil {
+					t.Errorf("[error] [%s] [%d] [Write]: %v", name, n, err)
+				}
+			}()
+			select {
+			case <-done:
+				t.Errorf("[%s] [%d] expected Write to block", name, n)
+			case <-time.After(10 * time.Millisecond):
+			}
+			for i := 0; i <= n; i++ {
+				if _, err := buf.Read(make([]byte, 1)); err != nil {
+					t.Errorf("[error] [%s] [%d] [Read]: %v", name, n, err)
+				}
+			}
+			<-done
+		}
+	}
+}
+
+func TestMultiStreamBuf(t *testing.T) {
+	inputs := [][][]byte{
+		{[]byte("ab"), []byte("c")},
+		{[]byte("defgh")},
+		{[]byte("i"), []byte("j"), []byte("kl")},
+	}
+
+	var bufs []*ebuf.StreamBuf
+	for range inputs {
+		bufs = append(bufs, ebuf.NewStreamBuf(1))
+	}
+	// それぞれのバッファに並行して書き込み, 書き終えたら閉じる
+	for i := len(inputs) - 1; i >= 0; i-- {
+		go func(i int) {
+			for j, in := range inputs[i] {
+				if _, err := bufs[i].Write(in); err != nil {
+					t.Errorf("[error] [Stream Buffer] [Write %d-%d]: %v", i, j, err)
+				}
+			}
+			bufs[i].Close()
+		}(i)
+	}
+
+	actual, err := io.ReadAll(ebuf.MultiStreamBuf(bufs...))
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [ReadAll]: %v", err)
+	}
+	if expected := []byte("abcdefghijkl"); !bytes.Equal(expected, actual) {
+		t.Errorf("expected %s (got %s)", expected, actual)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	type buffer interface {
+		io.ReadWriter
+		CloseWrite() error
+		CloseRead() error
+	}
+	newBufs := map[string]func() buffer{
+		"Datagram Buffer": func() buffer { return ebuf.NewDatagramBuf(2) },
+		"Stream Buffer":   func() buffer { return ebuf.NewStreamBuf(2) },
+	}
+
+	for name, newBuf := range newBufs {
+		// CloseWrite 後も読み手は残りのデータを io.EOF まで読める
+		buf := newBuf()
+		for _, in := range [][]byte{[]byte("ab"), []byte("cd")} {
+			if _, err := buf.Write(in); err != nil {
+				t.Fatalf("[error] [%s] [Write]: %v", name, err)
+			}
+		}
+		if err := buf.CloseWrite(); err != nil {
+			t.Errorf("[error] [%s] [CloseWrite]: %v", name, err)
+		}
+		if _, err := buf.Write([]byte("ef")); err != ebuf.ErrClosed {
+			t.Errorf("[%s] expected %v (got %v)", name, ebuf.ErrClosed, err)
+		}
+		for _, ex := range [][]byte{[]byte("ab"), []byte("cd")} {
+			actual := make([]byte, 2)
+			n, err := buf.Read(actual)
+			if err != nil || !bytes.Equal(ex, actual[:n]) {
+				t.Errorf("[%s] expected %s (got %s, %v)", name, ex, actual[:n], err)
+			}
+		}
+		if _, err := buf.Read(make([]byte, 2)); err != io.EOF {
+			t.Errorf("[%s] expected %v (got %v)", name, io.EOF, err)
+		}
+
+		// CloseRead 後は, ブロックしている書き込みも含めて書き込みがエラーになる
+		buf = newBuf()
+		for _, in := range [][]byte{[]byte("ab"), []byte("cd")} {
+			if _, err := buf.Write(in); err != nil {
+				t.Fatalf("[error] [%s] [Write]: %v", name, err)
+			}
+		}
+		done := make(chan error)
+		go func() {
+			_, err := buf.Write([]byte("ef"))
+			done <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if err := buf.CloseRead(); err != nil {
+			t.Errorf("[error] [%s] [CloseRead]: %v", name, err)
+		}
+		if err := <-done; err != io.ErrClosedPipe {
+			t.Errorf("[%s] expected %v (got %v)", name, io.ErrClosedPipe, err)
+		}
+		if _, err := buf.Write([]byte("gh")); err != io.ErrClosedPipe {
+			t.Errorf("[%s] expected %v (got %v)", name, io.ErrClosedPipe, err)
+		}
+		if _, err := buf.Read(make([]byte, 2)); err != ebuf.ErrClosed {
+			t.Errorf("[%s] expected %v (got %v)", name, ebuf.ErrClosed, err)
+		}
+	}
+}
+
+func TestWithLatencyTracking(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(2, ebuf.WithLatencyTracking())
+	if min, max, avg := dbuf.LatencyStats(); min != 0 || max != 0 || avg != 0 {
+		t.Errorf("expected zeros (got %v %v %v)", min, max, avg)
+	}
+
+	// 1 つ目は約 40ms, 2 つ目は約 20ms バッファに留まる
+	const delay = 20 * time.Millisecond
+	if _, err := dbuf.Write([]byte("a")); err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [Write]: %v", err)
+	}
+	time.Sleep(delay)
+	if _, err := dbuf.Write([]byte("b")); err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [Write]: %v", err)
+	}
+	time.Sleep(delay)
+	for i := 0; i < 2; i++ {
+		if _, err := dbuf.Read(make([]byte, 1)); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Read %d]: %v", i, err)
+		}
+	}
+
+	const slack = 50 * time.Millisecond
+	min, max, avg := dbuf.LatencyStats()
+	if min < delay || min > delay+slack {
+		t.Errorf("min: expected about %v (got %v)", delay, min)
+	}
+	if max < 2*delay || max > 2*delay+slack {
+		t.Errorf("max: expected about %v (got %v)", 2*delay, max)
+	}
+	if avg != (min+max)/2 {
+		t.Errorf("avg: expected %v (got %v)", (min+max)/2, avg)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	sentinels := []error{
+		ebuf.ErrBrokenBuffer,
+		ebuf.ErrClosed,
+		ebuf.ErrAlreadyClosed,
+		ebuf.ErrAlreadyUnread,
+		ebuf.ErrCanceled,
+		ebuf.ErrDiscarded,
+		ebuf.ErrWriterClosed,
+		ebuf.ErrWouldBlock,
+		ebuf.ErrNegativeCapacity,
+		ebuf.ErrTooLarge,
+		&ebuf.TimeoutError{},
+	}
+	// どの 2 つも errors.Is で一致しない
+	for i, a := range sentinels {
+		for j, b := range sentinels {
+			if i != j && errors.Is(a, b) {
+				t.Errorf("%v and %v should be distinct", a, b)
+			}
+		}
+	}
+
+	// 実際に返されるエラーは errors.Is で判定できる
+	sbuf := ebuf.NewStreamBuf(1)
+	sbuf.Close()
+	if _, err := sbuf.Write([]byte("a")); !errors.Is(err, ebuf.ErrClosed) {
+		t.Errorf("expected %v (got %v)", ebuf.ErrClosed, err)
+	}
+	if err := sbuf.Close(); !errors.Is(err, ebuf.ErrAlreadyClosed) {
+		t.Errorf("expected %v (got %v)", ebuf.ErrAlreadyClosed, err)
+	}
+	if err := sbuf.CloseRead(); err != nil {
+		t.Errorf("[error] [Stream Buffer] [CloseRead]: %v", err)
+	}
+	if err := sbuf.CloseRead(); !errors.Is(err, ebuf.ErrAlreadyClosed) {
+		t.Errorf("expected %v (got %v)", ebuf.ErrAlreadyClosed, err)
+	}
+}
+
+func TestStreamBufFramed(t *testing.T) {
+	inputs := []string{"ab", "cdefg", "h"}
+	tests := []struct {
+		name     string
+		sbuf     *ebuf.StreamBuf
+		expected []string
+	}{
+		// 通常の StreamBuf は p に入るだけチャンクを連結する
+		{"Stream Buffer", ebuf.NewStreamBuf(len(inputs)), []string{"abcd", "efgh"}},
+		// フレーム付きの StreamBuf は 1 回の Read で 1 チャンクだけ返し、
+		// p に入りきらない残りは次の Read で返す
+		{"Framed Stream Buffer", ebuf.NewStreamBufFramed(len(inputs)), []string{"ab", "cdef", "g", "h"}},
+	}
+
+	for _, test := range tests {
+		for i, in := range inputs {
+			if _, err := test.sbuf.Write([]byte(in)); err != nil {
+				t.Errorf("[error] [%s] [Write %d]: %v", test.name, i, err)
+			}
+		}
+		test.sbuf.Close()
+
+		var actual []string
+		p := make([]byte, 4)
+		for {
+			n, err := test.sbuf.Read(p)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("[error] [%s] [Read]: %v", test.name, err)
+			}
+			actual = append(actual, string(p[:n]))
+		}
+		if !slices.Equal(test.expected, actual) {
+			t.Errorf("[%s] expected %q (got %q)", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	const nrWriters = 16
+	const nrWrites = 200
+
+	// 各チャンクは書き込んだ goroutine の番号とシーケンス番号を繰り返したもの
+	chunk := func(w, i int) []byte {
+		return bytes.Repeat([]byte{byte(w), byte(i)}, 1+i%8)
+	}
+
+	dbuf := ebuf.NewDatagramBuf(4)
+	sbuf := ebuf.NewStreamBuf(4)
+	tests := []struct {
+		name string
+		buf  io.WriteCloser
+		// readChunk はチャンクを 1 つ読み出す
+		readChunk func() ([]byte, error)
+	}{
+		{"Datagram Buffer", dbuf, func() ([]byte, error) {
+			p := make([]byte, 64)
+			n, err := dbuf.Read(p)
+			return p[:n], err
+		}},
+		{"Stream Buffer", sbuf, func() ([]byte, error) {
+			// 先頭の 2 バイトからチャンクの長さがわかる
+			hdr := make([]byte, 2)
+			if _, err := io.ReadFull(sbuf, hdr); err != nil {
+				return nil, err
+			}
+			p := make([]byte, len(chunk(int(hdr[0]), int(hdr[1]))))
+			copy(p, hdr)
+			_, err := io.ReadFull(sbuf, p[len(hdr):])
+			return p, err
+		}},
+	}
+
+	for _, test := range tests {
+		var wg sync.WaitGroup
+		total := 0
+		for w := 0; w < nrWriters; w++ {
+			for i := 0; i < nrWrites; i++ {
+				total += len(chunk(w, i))
+			}
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < nrWrites; i++ {
+					if _, err := test.buf.Write(chunk(w, i)); err != nil {
+						t.Errorf("[error] [%s] [Write %d]: %v", test.name, i, err)
+					}
+				}
+			}(w)
+		}
+		go func() {
+			wg.Wait()
+			test.buf.Close()
+		}()
+
+		// チャンク単位で読み出し、他のチャンクと混ざっていないことを確かめる
+		next := make([]int, nrWriters)
+		actual := 0
+		for {
+			c, err := test.readChunk()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("[error] [%s] [Read]: %v", test.name, err)
+			}
+			w := int(c[0])
+			if w >= nrWriters {
+				t.Fatalf("[%s] unexpected chunk %v", test.name, c)
+			}
+			if expected := chunk(w, next[w]); !bytes.Equal(expected, c) {
+				t.Fatalf("[%s] chunk %d of writer %d is corrupted: expected %v (got %v)", test.name, next[w], w, expected, c)
+			}
+			next[w]++
+			actual += len(c)
+		}
+		if actual != total {
+			t.Errorf("[%s] expected %d bytes (got %d)", test.name, total, actual)
+		}
+	}
+}
+
+func TestStreamBufReadVectored(t *testing.T) {
+	tests := []struct {
+		inputs   []string
+		sizes    []int
+		expected []string
+	}{
+		// 2 つのスライスに分けて読む
+		{[]string{"ab", "cde"}, []int{3, 2}, []string{"abc", "de"}},
+		// データが足りなければ後ろのスライスは埋まらない
+		{[]string{"ab"}, []int{1, 4}, []string{"a", "b"}},
+		// 3 つのスライスに分けて読み, 残りは次の Read で返す
+		{[]string{"abc", "defg", "hi"}, []int{2, 4, 1}, []string{"ab", "cdef", "g"}},
+		// 空のスライスは読み飛ばす
+		{[]string{"abc"}, []int{1, 0, 2}, []string{"a", "", "bc"}},
+	}
+
+	for i, test := range tests {
+		sbuf := ebuf.NewStreamBuf(len(test.inputs))
+		for j, in := range test.inputs {
+			if _, err := sbuf.Write([]byte(in)); err != nil {
+				t.Errorf("[error] [Stream Buffer] [Write %d-%d]: %v", i, j, err)
+			}
+		}
+
+		bufs := make([][]byte, len(test.sizes))
+		for j, size := range test.sizes {
+			bufs[j] = make([]byte, size)
+		}
+		n, err := sbuf.ReadVectored(bufs)
+		if err != nil {
+			t.Errorf("[error] [Stream Buffer] [ReadVectored %d]: %v", i, err)
+		}
+
+		total := 0
+		for j, ex := range test.expected {
+			if actual := bufs[j][:len(ex)]; !bytes.Equal([]byte(ex), actual) {
+				t.Errorf("[ReadVectored %d-%d] expected %s (got %s)", i, j, ex, actual)
+			}
+			total += len(ex)
+		}
+		if n != total {
+			t.Errorf("[ReadVectored %d] expected %d bytes (got %d)", i, total, n)
+		}
+	}
+
+	// Read と同様に, 最初のバイトが届くまでブロックする
+	sbuf := ebuf.NewStreamBuf(1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sbuf.Write([]byte("abc"))
+	}()
+	bufs := [][]byte{make([]byte, 2), make([]byte, 2)}
+	n, err := sbuf.ReadVectored(bufs)
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [ReadVectored]: %v", err)
+	}
+	if n != 3 || !bytes.Equal([]byte("ab"), bufs[0]) || !bytes.Equal([]byte("c"), bufs[1][:1]) {
+		t.Errorf("expected abc (got %d bytes: %s %s)", n, bufs[0], bufs[1])
+	}
+}
+
+func TestStreamBufWriteVectored(t *testing.T) {
+	// フレーム付きの StreamBuf は 1 回の Read で 1 チャンクだけ返すので,
+	// 1 つのチャンクとして書き込まれたことを確かめられる
+	sbuf := ebuf.NewStreamBufFramed(2)
+	n, err := sbuf.WriteVectored([]byte("ab"), nil, []byte("cde"), []byte("f"))
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [WriteVectored]: %v", err)
+	}
+	if n != 6 {
+		t.Errorf("expected 6 (got %d)", n)
+	}
+	if _, err := sbuf.Write([]byte("g")); err != nil {
+		t.Errorf("[error] [Stream Buffer] [Write]: %v", err)
+	}
+
+	expected := []string{"abcdef", "g"}
+	for i, ex := range expected {
+		actual := make([]byte, 10)
+		n, err := sbuf.Read(actual)
+		if err != nil {
+			t.Errorf("[error] [Stream Buffer] [Read %d]: %v", i, err)
+		}
+		if !bytes.Equal([]byte(ex), actual[:n]) {
+			t.Errorf("expected %s (got %s)", ex, actual[:n])
+		}
+	}
+}
+
+func TestDatagramBufC(t *testing.T) {
+	bufs := []*ebuf.DatagramBuf{ebuf.NewDatagramBuf(2), ebuf.NewDatagramBuf(2)}
+	for i, dbuf := range bufs {
+		for j := 0; j < 2; j++ {
+			if _, err := dbuf.Write([]byte{byte(i), byte(j)}); err != nil {
+				t.Errorf("[error] [Datagram Buffer %d] [Write %d]: %v", i, j, err)
+			}
+		}
+		dbuf.Close()
+	}
+
+	// 2 つのバッファの C を select で待ち, それぞれの順序で受け取る
+	next := make([]int, len(bufs))
+	c0, c1 := bufs[0].C(), bufs[1].C()
+	for c0 != nil || c1 != nil {
+		var d []byte
+		var ok bool
+		var i int
+		select {
+		case d, ok = <-c0:
+			if !ok {
+				c0 = nil
+				continue
+			}
+			i = 0
+		case d, ok = <-c1:
+			if !ok {
+				c1 = nil
+				continue
+			}
+			i = 1
+		}
+		if expected := []byte{byte(i), byte(next[i])}; !bytes.Equal(expected, d) {
+			t.Errorf("expected %v (got %v)", expected, d)
+		}
+		next[i]++
+	}
+	for i, n := range next {
+		if n != 2 {
+			t.Errorf("[Datagram Buffer %d] expected 2 datagrams (got %d)", i, n)
+		}
+	}
+
+	// C は毎回同じチャネルを返す
+	if bufs[0].C() != bufs[0].C() {
+		t.Errorf("expected the same channel")
+	}
+}
+
+func TestMergeDatagramBufs(t *testing.T) {
+	const nrInputs = 3
+	const nrDgrams = 50
+
+	ins := make([]*ebuf.DatagramBuf, nrInputs)
+	for i := range ins {
+		ins[i] = ebuf.NewDatagramBuf(2)
+	}
+	// 出力の容量は小さく, マージ中にブロックさせる
+	out := ebuf.NewDatagramBuf(1)
+	ebuf.MergeDatagramBufs(out, ins...)
+
+	for i, in := range ins {
+		go func(i int, in *ebuf.DatagramBuf) {
+			for j := 0; j < nrDgrams; j++ {
+				if _, err := in.Write([]byte{byte(i), byte(j)}); err != nil {
+					t.Errorf("[error] [Datagram Buffer %d] [Write %d]: %v", i, j, err)
+				}
+			}
+			in.Close()
+		}(i, in)
+	}
+
+	// 入力ごとの順序は保たれ, すべての入力が閉じると out も閉じる
+	next := make([]int, nrInputs)
+	for d := range out.All() {
+		i := int(d[0])
+		if int(d[1]) != next[i] {
+			t.Errorf("[Datagram Buffer %d] expected %d (got %d)", i, next[i], d[1])
+		}
+		next[i]++
+	}
+	for i, n := range next {
+		if n != nrDgrams {
+			t.Errorf("[Datagram Buffer %d] expected %d datagrams (got %d)", i, nrDgrams, n)
+		}
+	}
+}
+
+func TestStreamBufChunkStats(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(5)
+	if count, avg, max := sbuf.ChunkStats(); count != 0 || avg != 0 || max != 0 {
+		t.Errorf("expected (0, 0, 0) (got (%d, %v, %d))", count, avg, max)
+	}
+
+	for i, in := range []string{"a", "bcdefgh", "ij", "k"} {
+		if _, err := sbuf.Write([]byte(in)); err != nil {
+			t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+		}
+	}
+	if count, avg, max := sbuf.ChunkStats(); count != 4 || avg != 2.75 || max != 7 {
+		t.Errorf("expected (4, 2.75, 7) (got (%d, %v, %d))", count, avg, max)
+	}
+
+	// Read が取り出したチャンクは数えない
+	if _, err := io.ReadFull(sbuf, make([]byte, 3)); err != nil {
+		t.Errorf("[error] [Stream Buffer] [Read]: %v", err)
+	}
+	if count, avg, max := sbuf.ChunkStats(); count != 2 || avg != 1.5 || max != 2 {
+		t.Errorf("expected (2, 1.5, 2) (got (%d, %v, %d))", count, avg, max)
+	}
+}
+
+func TestWithWriteTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	tests := []struct {
+		name string
+		buf  io.Writer
+	}{
+		{"Datagram Buffer", ebuf.NewDatagramBuf(1, ebuf.WithWriteTimeout(timeout))},
+		{"Stream Buffer", ebuf.NewStreamBuf(1, ebuf.WithWriteTimeout(timeout))},
+	}
+
+	for _, test := range tests {
+		if _, err := test.buf.Write([]byte("a")); err != nil {
+			t.Errorf("[error] [%s] [Write]: %v", test.name, err)
+		}
+
+		// 読み手がいないので, 2 回目の Write はタイムアウトする
+		start := time.Now()
+		n, err := test.buf.Write([]byte("b"))
+		var terr *ebuf.TimeoutError
+		if n != 0 || !errors.As(err, &terr) {
+			t.Errorf("[%s] expected (0, timeout) (got (%d, %v))", test.name, n, err)
+		}
+		if elapsed := time.Since(start); elapsed < timeout {
+			t.Errorf("[%s] expected to wait for the timeout (took %v)", test.name, elapsed)
+		}
+	}
+
+	// レート制限とチャンネルの空き待ちを合わせても, タイムアウトは 1 回分
+	sbuf := ebuf.NewStreamBuf(1, ebuf.WithWriteRateLimit(1000), ebuf.WithWriteTimeout(2*timeout))
+	sbuf.Write([]byte("a"))
+	start := time.Now()
+	if _, err := sbuf.Write(make([]byte, 80)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected %v (got %v)", os.ErrDeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*timeout || elapsed > 3*timeout {
+		t.Errorf("expected about %v (got %v)", 2*timeout, elapsed)
+	}
+}
+
+func TestDatagramBufUnread(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(2)
+	for i, in := range []string{"a", "b"} {
+		if _, err := dbuf.Write([]byte(in)); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Write %d]: %v", i, err)
+		}
+	}
+	dbuf.Close()
+
+	p := make([]byte, 4)
+	n, err := dbuf.Read(p)
+	if err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [Read]: %v", err)
+	}
+
+	// 読んだデータグラムを戻すと, 次の Read で先に返される
+	if err := dbuf.Unread(p[:n]); err != nil {
+		t.Errorf("[error] [Datagram Buffer] [Unread]: %v", err)
+	}
+	// 2 回続けて戻すことはできない
+	if err := dbuf.Unread([]byte("x")); err != ebuf.ErrAlreadyUnread {
+		t.Errorf("expected %v (got %v)", ebuf.ErrAlreadyUnread, err)
+	}
+	// Unread は p をコピーする
+	p[0] = 'x'
+
+	expected := []string{"a", "b"}
+	for i, ex := range expected {
+		n, err := dbuf.Read(p)
+		if err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Read %d]: %v", i, err)
+		}
+		if !bytes.Equal([]byte(ex), p[:n]) {
+			t.Errorf("expected %s (got %s)", ex, p[:n])
+		}
+	}
+	if _, err := dbuf.Read(p); err != io.EOF {
+		t.Errorf("expected %v (got %v)", io.EOF, err)
+	}
+}
+
+// benchmarkStreamBufRead writes chunks and reads them by reads of size
+// in each iteration. Write allocates a copy of each chunk, so the allocations
+// beyond the number of chunks per iteration come from Read.
+func benchmarkStreamBufRead(b *testing.B, chunks [][]byte, size int) {
+	b.ReportAllocs()
+	total := 0
+	for _, c := range chunks {
+		total += len(c)
+	}
+	sbuf := ebuf.NewStreamBuf(len(chunks))
+	p := make([]byte, size)
+	b.SetBytes(int64(total))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range chunks {
+			if _, err := sbuf.Write(c); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for n := 0; n < total; {
+			m, err := sbuf.Read(p)
+			if err != nil {
+				b.Fatal(err)
+			}
+			n += m
+		}
+	}
+}
+
+func BenchmarkStreamBufReadSmall(b *testing.B) {
+	benchmarkStreamBufRead(b, [][]byte{make([]byte, 16)}, 16)
+}
+
+func BenchmarkStreamBufReadLarge(b *testing.B) {
+	benchmarkStreamBufRead(b, [][]byte{make([]byte, 64*1024)}, 4096)
+}
+
+func BenchmarkStreamBufReadFragmented(b *testing.B) {
+	chunks := make([][]byte, 32)
+	for i := range chunks {
+		chunks[i] = make([]byte, 1+i%7)
+	}
+	benchmarkStreamBufRead(b, chunks, 10)
+}
+
+func TestWithCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 容量 0 のバッファで, Read と Write をそれぞれブロックさせる
+	dbufR := ebuf.NewDatagramBuf(0, ebuf.WithCancel(ctx))
+	dbufW := ebuf.NewDatagramBuf(0, ebuf.WithCancel(ctx))
+	sbufR := ebuf.NewStreamBuf(0, ebuf.WithCancel(ctx))
+	sbufW := ebuf.NewStreamBuf(0, ebuf.WithCancel(ctx))
+	tests := []struct {
+		name string
+		op   func() (int, error)
+	}{
+		{"DatagramBuf.Read", func() (int, error) { return dbufR.Read(make([]byte, 1)) }},
+		{"DatagramBuf.Write", func() (int, error) { return dbufW.Write([]byte("a")) }},
+		{"StreamBuf.Read", func() (int, error) { return sbufR.Read(make([]byte, 1)) }},
+		{"StreamBuf.Write", func() (int, error) { return sbufW.Write([]byte("a")) }},
+	}
+
+	errs := make([]chan error, len(tests))
+	for i, test := range tests {
+		errs[i] = make(chan error, 1)
+		go func(op func() (int, error), errc chan error) {
+			_, err := op()
+			errc <- err
+		}(test.op, errs[i])
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	for i, test := range tests {
+		select {
+		case err := <-errs[i]:
+			if err != context.Canceled {
+				t.Errorf("[%s] expected %v (got %v)", test.name, context.Canceled, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("[%s] expected to return after cancel", test.name)
+		}
+		// キャンセル後の操作も ctx.Err() を返す
+		if _, err := test.op(); err != context.Canceled {
+			t.Errorf("[%s] expected %v (got %v)", test.name, context.Canceled, err)
+		}
+	}
+}
+
+func TestHighWaterMark(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(5)
+	sbuf := ebuf.NewStreamBuf(5)
+
+	tests := []struct {
+		name     string
+		buf      io.ReadWriter
+		hwm      func() int
+		expected int
+	}{
+		// DatagramBuf はデータグラム数, StreamBuf はバイト数
+		{"Datagram Buffer", dbuf, dbuf.HighWaterMark, 3},
+		{"Stream Buffer", sbuf, sbuf.HighWaterMark, 6},
+	}
+
+	for _, test := range tests {
+		if hwm := test.hwm(); hwm != 0 {
+			t.Errorf("[%s] expected 0 (got %d)", test.name, hwm)
+		}
+
+		// 3 つ書き込んでから読み切り, もう 1 度 1 つだけ書き込む
+		for i := 0; i < 3; i++ {
+			if _, err := test.buf.Write([]byte("ab")); err != nil {
+				t.Errorf("[error] [%s] [Write %d]: %v", test.name, i, err)
+			}
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := io.ReadFull(test.buf, make([]byte, 2)); err != nil {
+				t.Errorf("[error] [%s] [Read %d]: %v", test.name, i, err)
+			}
+		}
+		if _, err := test.buf.Write([]byte("ab")); err != nil {
+			t.Errorf("[error] [%s] [Write]: %v", test.name, err)
+		}
+
+		// 最大値は読み出した後も残る
+		if hwm := test.hwm(); hwm != test.expected {
+			t.Errorf("[%s] expected %d (got %d)", test.name, test.expected, hwm)
+		}
+	}
+}
+
+func TestWithCopyThreshold(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(2, ebuf.WithCopyThreshold(4))
+	small := []byte("abcd")
+	large := []byte("abcde")
+	for i, in := range [][]byte{small, large} {
+		if _, err := dbuf.Write(in); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Write %d]: %v", i, err)
+		}
+	}
+	dbuf.Close()
+
+	// 閾値以下の書き込みはコピーされ, 閾値を超える書き込みはそのまま渡される
+	var actual [][]byte
+	for d := range dbuf.All() {
+		actual = append(actual, d)
+	}
+	if len(actual) != 2 {
+		t.Fatalf("expected 2 datagrams (got %d)", len(actual))
+	}
+	if &actual[0][0] == &small[0] {
+		t.Errorf("expected the small datagram to be copied")
+	}
+	if &actual[1][0] != &large[0] {
+		t.Errorf("expected the large datagram not to be copied")
+	}
+}
+
+// benchmarkCopyThreshold writes datagrams of size bytes to DatagramBuf
+// with the copy threshold of 1 KiB, and reads them.
+func benchmarkCopyThreshold(b *testing.B, size int) {
+	b.ReportAllocs()
+	dbuf := ebuf.NewDatagramBuf(1, ebuf.WithCopyThreshold(1024))
+	in := make([]byte, size)
+	p := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dbuf.Write(in); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := dbuf.Read(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyThresholdAt(b *testing.B) {
+	benchmarkCopyThreshold(b, 1024)
+}
+
+func BenchmarkCopyThresholdAbove(b *testing.B) {
+	benchmarkCopyThreshold(b, 1025)
+}
+
+func TestStreamBufNotEmpty(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(5)
+	notEmpty := sbuf.NotEmpty()
+
+	// signals は通知の数を数える
+	signals := func() int {
+		n := 0
+		for {
+			select {
+			case <-notEmpty:
+				n++
+			default:
+				return n
+			}
+		}
+	}
+
+	tests := []struct {
+		inputs []string
+		reads  []int
+	}{
+		// 空のときの書き込みだけが通知される
+		{[]string{"a", "bc", "d"}, []int{3}},
+		// 読み残しがあれば通知されない
+		{[]string{"ef"}, []int{2}},
+		{[]string{"g"}, []int{2}},
+		// 読み切った後の書き込みは再び通知される
+		{[]string{"h"}, []int{1}},
+	}
+	expected := []int{1, 0, 0, 1}
+
+	for i, test := range tests {
+		for j, in := range test.inputs {
+			if _, err := sbuf.Write([]byte(in)); err != nil {
+				t.Errorf("[error] [Stream Buffer] [Write %d-%d]: %v", i, j, err)
+			}
+		}
+		if n := signals(); n != expected[i] {
+			t.Errorf("[%d] expected %d signals (got %d)", i, expected[i], n)
+		}
+		for j, size := range test.reads {
+			if _, err := io.ReadFull(sbuf, make([]byte, size)); err != nil {
+				t.Errorf("[error] [Stream Buffer] [Read %d-%d]: %v", i, j, err)
+			}
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	src := ebuf.NewStreamBuf(2)
+	dst := ebuf.NewStreamBufFramed(4)
+
+	inputs := []string{"abc", "de", "fgh", "i"}
+	go func() {
+		for i, in := range inputs {
+			if _, err := src.Write([]byte(in)); err != nil {
+				t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+			}
+		}
+		src.Close()
+	}()
+
+	// 読みかけのバイトも含めてコピーされる
+	p := make([]byte, 1)
+	if _, err := src.Read(p); err != nil {
+		t.Fatalf("[error] [Stream Buffer] [Read]: %v", err)
+	}
+	n, err := ebuf.Copy(dst, src)
+	if err != nil {
+		t.Errorf("[error] [Copy]: %v", err)
+	}
+	if n != 8 {
+		t.Errorf("expected 8 (got %d)", n)
+	}
+	dst.Close()
+
+	// チャンクの境界はそのまま保たれる
+	expected := []string{"bc", "de", "fgh", "i"}
+	for i, ex := range expected {
+		actual := make([]byte, 10)
+		n, err := dst.Read(actual)
+		if err != nil {
+			t.Errorf("[error] [Stream Buffer] [Read %d]: %v", i, err)
+		}
+		if !bytes.Equal([]byte(ex), actual[:n]) {
+			t.Errorf("expected %s (got %s)", ex, actual[:n])
+		}
+	}
+	if _, err := dst.Read(p); err != io.EOF {
+		t.Errorf("expected %v (got %v)", io.EOF, err)
+	}
+}
+
+func TestCopyAllocatorNoCopy(t *testing.T) {
+	// 解放されたスライスは上書きされる
+	free := func(p []byte) {
+		for i := range p {
+			p[i] = 'X'
+		}
+	}
+	src := ebuf.NewStreamBuf(2, ebuf.WithAllocator(func(n int) []byte { return make([]byte, n) }, free))
+	dst := ebuf.NewStreamBuf(2, ebuf.WithNoCopy())
+	src.Write([]byte("hello"))
+	src.Close()
+
+	// src に返されたメモリを dst が参照してはいけない
+	if _, err := ebuf.Copy(dst, src); err != nil {
+		t.Errorf("[error] [Copy]: %v", err)
+	}
+	dst.Close()
+	if actual, _ := io.ReadAll(dst); string(actual) != "hello" {
+		t.Errorf("expected hello (got %s)", actual)
+	}
+}
+
+// benchmarkCopy copies 64 chunks of 4 KiB between StreamBufs by copy.
+func benchmarkCopy(b *testing.B, copy func(dst, src *ebuf.StreamBuf) (int64, error)) {
+	b.ReportAllocs()
+	chunk := make([]byte, 4096)
+	const nrChunks = 64
+	b.SetBytes(nrChunks * int64(len(chunk)))
+	for i := 0; i < b.N; i++ {
+		src := ebuf.NewStreamBuf(nrChunks)
+		dst := ebuf.NewStreamBuf(nrChunks)
+		for j := 0; j < nrChunks; j++ {
+			src.Write(chunk)
+		}
+		src.Close()
+		if _, err := copy(dst, src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	benchmarkCopy(b, ebuf.Copy)
+}
+
+func BenchmarkIoCopy(b *testing.B) {
+	benchmarkCopy(b, func(dst, src *ebuf.StreamBuf) (int64, error) {
+		return io.Copy(dst, src)
+	})
+}
+
+func TestDatagramBufGrow(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(2)
+	for i := 0; i < 2; i++ {
+		if _, err := dbuf.Write([]byte{byte(i)}); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Write %d]: %v", i, err)
+		}
+	}
+
+	// 容量を 5 に広げると, さらに 3 つ書き込んでもブロックしない
+	if err := dbuf.Grow(3); err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [Grow]: %v", err)
+	}
+	for i := 2; i < 5; i++ {
+		if _, err := dbuf.WriteTimeout([]byte{byte(i)}, 10*time.Millisecond); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Write %d]: %v", i, err)
+		}
+	}
+	if a := dbuf.Available(); a != 0 {
+		t.Errorf("expected 0 (got %d)", a)
+	}
+
+	// 広げる前のデータグラムも順序通りに読める
+	for i := 0; i < 5; i++ {
+		p := make([]byte, 1)
+		if _, err := dbuf.Read(p); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Read %d]: %v", i, err)
+		}
+		if p[0] != byte(i) {
+			t.Errorf("expected %d (got %d)", i, p[0])
+		}
+	}
+
+	if err := dbuf.Grow(-1); err != ebuf.ErrNegativeCapacity {
+		t.Errorf("expected %v (got %v)", ebuf.ErrNegativeCapacity, err)
+	}
+	dbuf.Close()
+	if err := dbuf.Grow(1); err != ebuf.ErrClosed {
+		t.Errorf("expected %v (got %v)", ebuf.ErrClosed, err)
+	}
+}
+
+func TestDatagramBufGrowWhileBlocked(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(1)
+	if _, err := dbuf.Write([]byte("a")); err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [Write]: %v", err)
+	}
+
+	// ブロック中の Write は, 容量が広がると新しいチャネルに書き込む
+	done := make(chan error)
+	go func() {
+		_, err := dbuf.Write([]byte("b"))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := dbuf.Grow(1); err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [Grow]: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("[error] [Datagram Buffer] [Write]: %v", err)
+	}
+
+	// ブロック中の Read も, 新しいチャネルから読む
+	empty := ebuf.NewDatagramBuf(1)
+	go func() {
+		p := make([]byte, 1)
+		_, err := empty.Read(p)
+		if err == nil && p[0] != 'c' {
+			err = fmt.Errorf("expected c (got %c)", p[0])
+		}
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := empty.Grow(1); err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [Grow]: %v", err)
+	}
+	if _, err := empty.Write([]byte("c")); err != nil {
+		t.Errorf("[error] [Datagram Buffer] [Write]: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("[error] [Datagram Buffer] [Read]: %v", err)
+	}
+
+	for i, ex := range []string{"a", "b"} {
+		p := make([]byte, 1)
+		if _, err := dbuf.Read(p); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Read %d]: %v", i, err)
+		}
+		if string(p) != ex {
+			t.Errorf("expected %s (got %s)", ex, p)
+		}
+	}
+}
+
+func TestStreamBufWaitDrained(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(3)
+	if err := sbuf.WaitDrained(context.Background()); err != nil {
+		t.Errorf("[error] [Stream Buffer] [WaitDrained]: %v", err)
+	}
+
+	for i, in := range []string{"ab", "cd", "ef"} {
+		if _, err := sbuf.Write([]byte(in)); err != nil {
+			t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+		}
+	}
+	sbuf.CloseWrite()
+
+	// 空になる前にコンテキストが終われば ctx.Err() を返す
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sbuf.WaitDrained(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v (got %v)", context.DeadlineExceeded, err)
+	}
+
+	// ゆっくり 1 バイトずつ読み, 最後のバイトを読んだ後に WaitDrained が返る
+	var mu sync.Mutex
+	read := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p := make([]byte, 1)
+		for {
+			time.Sleep(time.Millisecond)
+			n, err := sbuf.Read(p)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			read += n
+			mu.Unlock()
+		}
+	}()
+	if err := sbuf.WaitDrained(context.Background()); err != nil {
+		t.Errorf("[error] [Stream Buffer] [WaitDrained]: %v", err)
+	}
+	// 最後の Read は返る途中かもしれない
+	mu.Lock()
+	if read < 5 {
+		t.Errorf("expected at least 5 bytes to be read (got %d)", read)
+	}
+	mu.Unlock()
+	<-done
+	if read != 6 {
+		t.Errorf("expected 6 bytes to be read (got %d)", read)
+	}
+}
+
+func TestString(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(5)
+	sbuf := ebuf.NewStreamBuf(5)
+	for i, in := range []string{"abcd", "efgh", "ijkl"} {
+		if _, err := dbuf.Write([]byte(in)); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Write %d]: %v", i, err)
+		}
+		if _, err := sbuf.Write([]byte(in)); err != nil {
+			t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+		}
+	}
+	// StreamBuf はチャンクを 1 つ取り出し, 2 バイトを読み残す
+	if _, err := sbuf.Read(make([]byte, 2)); err != nil {
+		t.Errorf("[error] [Stream Buffer] [Read]: %v", err)
+	}
+	dbuf.Close()
+
+	tests := []struct {
+		actual   string
+		expected string
+	}{
+		{dbuf.String(), "DatagramBuf{dgrams=3 cap=5 closed=true}"},
+		{fmt.Sprint(sbuf), "StreamBuf{rest=2B chunks=2 cap=5 closed=false}"},
+	}
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("expected %s (got %s)", test.expected, test.actual)
+		}
+	}
+
+	// String はデータを消費しない
+	if n, err := sbuf.Read(make([]byte, 10)); err != nil || n != 10 {
+		t.Errorf("expected 10 bytes (got %d, %v)", n, err)
+	}
+}
+
+func TestDatagramBufWriteTTL(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(3)
+	if err := dbuf.WriteTTL([]byte("stale"), time.Millisecond); err != nil {
+		t.Errorf("[error] [Datagram Buffer] [WriteTTL]: %v", err)
+	}
+	if err := dbuf.WriteTTL([]byte("live"), time.Minute); err != nil {
+		t.Errorf("[error] [Datagram Buffer] [WriteTTL]: %v", err)
+	}
+	if _, err := dbuf.Write([]byte("forever")); err != nil {
+		t.Errorf("[error] [Datagram Buffer] [Write]: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// 期限切れのデータグラムは読み飛ばされる
+	for i, ex := range []string{"live", "forever"} {
+		p := make([]byte, 10)
+		n, err := dbuf.Read(p)
+		if err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Read %d]: %v", i, err)
+		}
+		if !bytes.Equal([]byte(ex), p[:n]) {
+			t.Errorf("expected %s (got %s)", ex, p[:n])
+		}
+	}
+	if e := dbuf.Expired(); e != 1 {
+		t.Errorf("expected 1 (got %d)", e)
+	}
+}
+
+func TestErrWriterClosed(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(1)
+	if _, err := sbuf.Write([]byte("a")); err != nil {
+		t.Fatalf("[error] [Stream Buffer] [Write]: %v", err)
+	}
+	sbuf.CloseWrite()
+
+	var w bytes.Buffer
+	if _, err := sbuf.DrainTo(&w, 10); err != ebuf.ErrWriterClosed {
+		t.Errorf("expected %v (got %v)", ebuf.ErrWriterClosed, err)
+	}
+	// ErrWriterClosed は io.EOF としても判定できる
+	if !errors.Is(ebuf.ErrWriterClosed, io.EOF) {
+		t.Errorf("expected %v to be %v", ebuf.ErrWriterClosed, io.EOF)
+	}
+
+	// Read は io.Reader の規約どおり io.EOF そのものを返す
+	if _, err := sbuf.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected %v (got %v)", io.EOF, err)
+	}
+
+	// DatagramBuf の DiscardDatagram も ErrWriterClosed を返す
+	dbuf := ebuf.NewDatagramBuf(1)
+	dbuf.Close()
+	if _, err := dbuf.DiscardDatagram(); err != ebuf.ErrWriterClosed {
+		t.Errorf("expected %v (got %v)", ebuf.ErrWriterClosed, err)
+	}
+}
+
+func TestWithMinRead(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(1, ebuf.WithMinRead(4))
+
+	// 1 バイトずつ書き込まれても, 4 バイトそろうまで Read は待つ
+	go func() {
+		for i, c := range []byte("abcdef") {
+			time.Sleep(time.Millisecond)
+			if _, err := sbuf.Write([]byte{c}); err != nil {
+				t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+			}
+		}
+		sbuf.Close()
+	}()
+
+	tests := []struct {
+		size     int
+		expected []byte
+		err      error
+	}{
+		{10, []byte("abcd"), nil},
+		// 閉じた後は 4 バイトに満たなくても残りを返す
+		{10, []byte("ef"), nil},
+		{10, []byte{}, io.EOF},
+	}
+	for i, test := range tests {
+		actual := make([]byte, test.size)
+		n, err := sbuf.Read(actual)
+		if err != test.err {
+			t.Errorf("[Read %d] expected %v (got %v)", i, test.err, err)
+		}
+		if !bytes.Equal(test.expected, actual[:n]) {
+			t.Errorf("[Read %d] expected %s (got %s)", i, test.expected, actual[:n])
+		}
+	}
+
+	// p が n より短ければ len(p) バイトで返す
+	sbuf = ebuf.NewStreamBuf(2, ebuf.WithMinRead(4))
+	sbuf.Write([]byte("a"))
+	sbuf.Write([]byte("b"))
+	actual := make([]byte, 2)
+	if n, err := sbuf.Read(actual); err != nil || n != 2 {
+		t.Errorf("expected 2 bytes (got %d, %v)", n, err)
+	}
+
+	// タイムアウトしたら読みかけのバイトをエラーと一緒に返す
+	sbuf.Write([]byte("c"))
+	actual = make([]byte, 4)
+	n, err := sbuf.ReadTimeout(actual, 10*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected timeout (got %v)", err)
+	}
+	if !bytes.Equal([]byte("c"), actual[:n]) {
+		t.Errorf("expected c (got %s)", actual[:n])
+	}
+	sbuf.Write([]byte("def"))
+	n, err = sbuf.Read(actual[:3])
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [Read]: %v", err)
+	}
+	if !bytes.Equal([]byte("def"), actual[:n]) {
+		t.Errorf("expected def (got %s)", actual[:n])
+	}
+
+	// キャンセルされても同様に読みかけのバイトを返す
+	sbuf.Write([]byte("g"))
+	cancel := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(cancel)
+	}()
+	n, err = sbuf.ReadOrCancel(actual, cancel)
+	if err != ebuf.ErrCanceled {
+		t.Errorf("expected %v (got %v)", ebuf.ErrCanceled, err)
+	}
+	if !bytes.Equal([]byte("g"), actual[:n]) {
+		t.Errorf("expected g (got %s)", actual[:n])
+	}
+}
+
+func TestStreamBufBytesUntilBoundary(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(2)
+	if _, err := sbuf.Write([]byte("abc")); err != nil {
+		t.Errorf("[error] [Stream Buffer] [Write]: %v", err)
+	}
+	if _, err := sbuf.Write([]byte("de")); err != nil {
+		t.Errorf("[error] [Stream Buffer] [Write]: %v", err)
+	}
+
+	// まだ何も読んでいなければ 0
+	if n := sbuf.BytesUntilBoundary(); n != 0 {
+		t.Errorf("expected 0 (got %d)", n)
+	}
+
+	tests := []struct {
+		size     int
+		expected int
+	}{
+		// "abc" の 1 バイト目まで読んだ
+		{1, 2},
+		// "bc" を超えて "de" の 1 バイト目まで読んだ
+		{3, 1},
+		// すべて読んだ
+		{1, 0},
+	}
+	for i, test := range tests {
+		if _, err := sbuf.Read(make([]byte, test.size)); err != nil {
+			t.Errorf("[error] [Stream Buffer] [Read %d]: %v", i, err)
+		}
+		if n := sbuf.BytesUntilBoundary(); n != test.expected {
+			t.Errorf("[BytesUntilBoundary %d] expected %d (got %d)", i, test.expected, n)
+		}
+	}
+}
+
+func TestWithNoCopy(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(2, ebuf.WithNoCopy())
+	inputs := [][]byte{[]byte("a"), make([]byte, 2048)}
+	for i, in := range inputs {
+		if _, err := dbuf.Write(in); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Write %d]: %v", i, err)
+		}
+	}
+	dbuf.Close()
+
+	// 大きさによらず, すべての書き込みがそのまま渡される
+	i := 0
+	for d := range dbuf.All() {
+		if &d[0] != &inputs[i][0] {
+			t.Errorf("[Read %d] expected the datagram not to be copied", i)
+		}
+		i++
+	}
+}
+
+// BenchmarkWriteCopy and BenchmarkWriteNoCopy compare the allocations
+// of writing a freshly allocated slice of 1 KiB with and without the copy.
+func BenchmarkWriteCopy(b *testing.B) {
+	benchmarkWriteFresh(b, ebuf.NewDatagramBuf(1))
+}
+
+func BenchmarkWriteNoCopy(b *testing.B) {
+	benchmarkWriteFresh(b, ebuf.NewDatagramBuf(1, ebuf.WithNoCopy()))
+}
+
+func benchmarkWriteFresh(b *testing.B, dbuf *ebuf.DatagramBuf) {
+	b.ReportAllocs()
+	p := make([]byte, 1024)
+	b.SetBytes(int64(len(p)))
+	for i := 0; i < b.N; i++ {
+		if _, err := dbuf.Write(make([]byte, len(p))); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := dbuf.Read(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDatagramBufReadInto(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(4)
+	inputs := []string{"hello", "ebuf", "abcdefghij"}
+	for i, in := range inputs {
+		if _, err := dbuf.Write([]byte(in)); err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Write %d]: %v", i, err)
+		}
+	}
+
+	// 用意した 4 つのうち, 読めるデータグラムの数だけ埋まる
+	dst := make([][]byte, 4)
+	for i := range dst {
+		dst[i] = make([]byte, 0, 8)
+	}
+	backing := &dst[0][:1][0]
+	n, err := dbuf.ReadInto(dst)
+	if err != nil {
+		t.Errorf("[error] [Datagram Buffer] [ReadInto]: %v", err)
+	}
+	if n != len(inputs) {
+		t.Errorf("expected %d (got %d)", len(inputs), n)
+	}
+	// 容量を超える部分は切り捨てられる
+	expected := []string{"hello", "ebuf", "abcdefgh"}
+	for i, ex := range expected {
+		if string(dst[i]) != ex {
+			t.Errorf("[ReadInto %d] expected %s (got %s)", i, ex, dst[i])
+		}
+	}
+	// 呼び出し側のバッファが再利用される
+	if &dst[0][0] != backing {
+		t.Errorf("expected dst[0] to be reused")
+	}
+
+	// 閉じた後は読み切ると io.EOF を返す
+	dbuf.Write([]byte("x"))
+	dbuf.Close()
+	if n, err := dbuf.ReadInto(dst); n != 1 || err != nil {
+		t.Errorf("expected 1, <nil> (got %d, %v)", n, err)
+	}
+	if _, err := dbuf.ReadInto(dst); err != ebuf.ErrWriterClosed {
+		t.Errorf("expected %v (got %v)", ebuf.ErrWriterClosed, err)
+	}
+}
+
+func TestStreamBufDoneErr(t *testing.T) {
+	errStop := errors.New("stop")
+	tests := []struct {
+		close func(*ebuf.StreamBuf) error
+		err   error
+		eof   error
+	}{
+		{(*ebuf.StreamBuf).Close, nil, io.EOF},
+		{func(b *ebuf.StreamBuf) error { return b.CloseWithError(nil) }, nil, io.EOF},
+		{func(b *ebuf.StreamBuf) error { return b.CloseWithError(errStop) }, errStop, errStop},
+	}
+	for i, test := range tests {
+		sbuf := ebuf.NewStreamBuf(1)
+		sbuf.Write([]byte("abc"))
+
+		// 閉じる前は Done は閉じておらず, Err は nil
+		select {
+		case <-sbuf.Done():
+			t.Errorf("[Done %d] expected not to be done", i)
+		default:
+		}
+		if err := sbuf.Err(); err != nil {
+			t.Errorf("[Err %d] expected <nil> (got %v)", i, err)
+		}
+
+		if err := test.close(sbuf); err != nil {
+			t.Errorf("[error] [Stream Buffer] [Close %d]: %v", i, err)
+		}
+		select {
+		case <-sbuf.Done():
+		case <-time.After(time.Second):
+			t.Errorf("[Done %d] expected to be done", i)
+		}
+		if err := sbuf.Err(); err != test.err {
+			t.Errorf("[Err %d] expected %v (got %v)", i, test.err, err)
+		}
+		// 二度目は前のエラーを上書きしない
+		if err := sbuf.CloseWithError(errors.New("other")); err != ebuf.ErrAlreadyClosed {
+			t.Errorf("[Close %d] expected %v (got %v)", i, ebuf.ErrAlreadyClosed, err)
+		}
+		if err := sbuf.Err(); err != test.err {
+			t.Errorf("[Err %d] expected %v (got %v)", i, test.err, err)
+		}
+
+		// 残りのデータを読んだ後に, 閉じた理由が返る
+		actual, err := io.ReadAll(io.LimitReader(sbuf, 3))
+		if err != nil || string(actual) != "abc" {
+			t.Errorf("[Read %d] expected abc (got %s, %v)", i, actual, err)
+		}
+		if _, err := sbuf.Read(make([]byte, 1)); err != test.eof {
+			t.Errorf("[Read %d] expected %v (got %v)", i, test.eof, err)
+		}
+	}
+
+	// WithCancel で閉じた場合は, コンテキストのエラーが返る
+	ctx, cancel := context.WithCancel(context.Background())
+	sbuf := ebuf.NewStreamBuf(1, ebuf.WithCancel(ctx))
+	cancel()
+	<-sbuf.Done()
+	if err := sbuf.Err(); err != context.Canceled {
+		t.Errorf("expected %v (got %v)", context.Canceled, err)
+	}
+}
+
+func TestStreamBufReadWithBoundaries(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(3)
+	for i, in := range []string{"ab", "cde", "fghi"} {
+		if _, err := sbuf.Write([]byte(in)); err != nil {
+			t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		size       int
+		expected   string
+		boundaries []int
+	}{
+		// チャンクの終わりの位置が p の先頭からのオフセットで返る
+		{7, "abcdefg", []int{2, 5}},
+		{2, "hi", []int{2}},
+	}
+	for i, test := range tests {
+		p := make([]byte, test.size)
+		n, boundaries, err := sbuf.ReadWithBoundaries(p)
+		if err != nil {
+			t.Errorf("[error] [Stream Buffer] [ReadWithBoundaries %d]: %v", i, err)
+		}
+		if string(p[:n]) != test.expected {
+			t.Errorf("[ReadWithBoundaries %d] expected %s (got %s)", i, test.expected, p[:n])
+		}
+		if !slices.Equal(boundaries, test.boundaries) {
+			t.Errorf("[ReadWithBoundaries %d] expected %v (got %v)", i, test.boundaries, boundaries)
+		}
+	}
+}
+
+func TestWithAllocator(t *testing.T) {
+	// recorder は割り当てたスライスを記録し, 二重解放を検出する
+	var mu sync.Mutex
+	live := map[*byte]bool{}
+	allocs, frees := 0, 0
+	alloc := func(n int) []byte {
+		p := make([]byte, n+1) // 長さ 0 でも先頭のアドレスで識別する
+		mu.Lock()
+		defer mu.Unlock()
+		allocs++
+		live[&p[0]] = true
+		return p[:n]
+	}
+	free := func(p []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		frees++
+		if !live[&p[:1][0]] {
+			t.Errorf("freed a slice not allocated or already freed")
+		}
+		delete(live, &p[:1][0])
+	}
+
+	tests := []struct {
+		name string
+		buf  interface {
+			Write([]byte) (int, error)
+			Read([]byte) (int, error)
+			Close() error
+		}
+	}{
+		{"DatagramBuf", ebuf.NewDatagramBuf(2, ebuf.WithAllocator(alloc, free))},
+		// 溢れて捨てられたデータグラムも解放される
+		{"DatagramBuf DropOldest", ebuf.NewDatagramBuf(2, ebuf.WithAllocator(alloc, free), ebuf.WithOverflowPolicy(ebuf.DropOldest))},
+		{"StreamBuf", ebuf.NewStreamBuf(2, ebuf.WithAllocator(alloc, free))},
+	}
+	for _, test := range tests {
+		allocs, frees = 0, 0
+		go func() {
+			for i, in := range []string{"a", "bc", "", "def"} {
+				if _, err := test.buf.Write([]byte(in)); err != nil {
+					t.Errorf("[error] [%s] [Write %d]: %v", test.name, i, err)
+				}
+			}
+			test.buf.Close()
+			// 閉じた後の書き込みに失敗しても解放される
+			test.buf.Write([]byte("g"))
+		}()
+		for {
+			if _, err := test.buf.Read(make([]byte, 2)); err != nil {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		if allocs != 5 || frees != allocs || len(live) != 0 {
+			t.Errorf("[%s] expected 5 allocs and frees (got %d, %d)", test.name, allocs, frees)
+		}
+		mu.Unlock()
+	}
+
+	// All で受け取ったデータグラムはコピーで, 元のスライスは解放される
+	allocs, frees = 0, 0
+	dbuf := ebuf.NewDatagramBuf(2, ebuf.WithAllocator(alloc, free))
+	dbuf.Write([]byte("a"))
+	dbuf.Write([]byte("bc"))
+	dbuf.Close()
+	var actual []string
+	for d := range dbuf.All() {
+		actual = append(actual, string(d))
+	}
+	if len(actual) != 2 || actual[0] != "a" || actual[1] != "bc" {
+		t.Errorf("expected [a bc] (got %v)", actual)
+	}
+	if allocs != 2 || frees != allocs || len(live) != 0 {
+		t.Errorf("[All] expected 2 allocs and frees (got %d, %d)", allocs, frees)
+	}
+}
+
+func TestDatagramBufWriteTimed(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	dbuf := ebuf.NewDatagramBuf(1)
+
+	// 空きがあればブロックしない
+	if _, waited, err := dbuf.WriteTimed([]byte("a")); err != nil || waited != 0 {
+		t.Errorf("expected 0, <nil> (got %v, %v)", waited, err)
+	}
+
+	// 満杯の間は, 読み手が読むまで待った時間が返る
+	go func() {
+		time.Sleep(delay)
+		dbuf.Read(make([]byte, 1))
+	}()
+	_, waited, err := dbuf.WriteTimed([]byte("b"))
+	if err != nil {
+		t.Errorf("[error] [Datagram Buffer] [WriteTimed]: %v", err)
+	}
+	if waited < delay/2 || waited > 10*delay {
+		t.Errorf("expected about %v (got %v)", delay, waited)
+	}
+
+	dbuf.Close()
+	if _, _, err := dbuf.WriteTimed([]byte("c")); err != ebuf.ErrClosed {
+		t.Errorf("expected %v (got %v)", ebuf.ErrClosed, err)
+	}
+}
+
+func TestRouteDatagrams(t *testing.T) {
+	src := ebuf.NewDatagramBuf(0)
+	even := ebuf.NewDatagramBuf(0)
+	odd := ebuf.NewDatagramBuf(0)
+	closed := ebuf.NewDatagramBuf(1)
+	closed.Close()
+
+	// 長さが偶数なら even, 奇数なら odd, 空なら捨て, "x" は閉じたバッファに送る
+	route := func(d []byte) *ebuf.DatagramBuf {
+		switch {
+		case len(d) == 0:
+			return nil
+		case string(d) == "x":
+			return closed
+		case len(d)%2 == 0:
+			return even
+		default:
+			return odd
+		}
+	}
+	skipped := make(chan int, 1)
+	go func() {
+		skipped <- ebuf.RouteDatagrams(src, route)
+		even.Close()
+		odd.Close()
+	}()
+	go func() {
+		for i, in := range []string{"ab", "c", "", "x", "def", "ghij"} {
+			if _, err := src.Write([]byte(in)); err != nil {
+				t.Errorf("[error] [Datagram Buffer] [Write %d]: %v", i, err)
+			}
+		}
+		src.Close()
+	}()
+
+	// 宛先のブロックも尊重されるよう, 両方を並行して読む
+	results := make([][]string, 2)
+	var wg sync.WaitGroup
+	for i, dbuf := range []*ebuf.DatagramBuf{even, odd} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range dbuf.All() {
+				results[i] = append(results[i], string(d))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !slices.Equal(results[0], []string{"ab", "ghij"}) {
+		t.Errorf("expected [ab ghij] (got %v)", results[0])
+	}
+	if !slices.Equal(results[1], []string{"c", "def"}) {
+		t.Errorf("expected [c def] (got %v)", results[1])
+	}
+	if n := <-skipped; n != 1 {
+		t.Errorf("expected 1 (got %d)", n)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	closed := ebuf.NewDatagramBuf(1)
+	closed.Close()
+	full := ebuf.NewStreamBuf(1)
+	full.Write([]byte("a"))
+
+	tests := []struct {
+		name  string
+		write func([]byte) (int, error)
+		err   error
+	}{
+		{"closed", closed.Write, ebuf.ErrClosed},
+		{"closed TryWrite", closed.TryWrite, ebuf.ErrClosed},
+		{"too large", ebuf.NewDatagramBuf(1, ebuf.WithMaxWriteSize(4)).Write, ebuf.ErrTooLarge},
+		{"too large StreamBuf", ebuf.NewStreamBuf(1, ebuf.WithMaxWriteSize(4)).Write, ebuf.ErrTooLarge},
+		{"would block", ebuf.NewDatagramBuf(0).TryWrite, ebuf.ErrWouldBlock},
+		{"would block StreamBuf", full.TryWrite, ebuf.ErrWouldBlock},
+	}
+	for _, test := range tests {
+		// 失敗した書き込みは, 常に n == 0 とそれぞれのエラーを返す
+		n, err := test.write([]byte("hello"))
+		if n != 0 || err != test.err {
+			t.Errorf("[%s] expected (0, %v) (got (%d, %v))", test.name, test.err, n, err)
+		}
+	}
+
+	// 上限以下の書き込みと, 空きのある TryWrite は成功する
+	dbuf := ebuf.NewDatagramBuf(1, ebuf.WithMaxWriteSize(5))
+	if n, err := dbuf.TryWrite([]byte("hello")); n != 5 || err != nil {
+		t.Errorf("expected (5, <nil>) (got (%d, %v))", n, err)
+	}
+}
+
+func TestWithIdleShrink(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(8, ebuf.WithIdleShrink(20*time.Millisecond, 2))
+	defer dbuf.Close()
+
+	// バーストを書き込んで読み切る
+	for i := 0; i < 8; i++ {
+		if _, err := dbuf.TryWrite([]byte{byte(i)}); err != nil {
+			t.Fatalf("[error] [Datagram Buffer] [TryWrite %d]: %v", i, err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		dbuf.Read(make([]byte, 1))
+	}
+
+	// しばらくアイドルにすると容量が縮む
+	time.Sleep(100 * time.Millisecond)
+	if n := dbuf.Available(); n != 2 {
+		t.Errorf("expected 2 (got %d)", n)
+	}
+
+	// 次のバーストで元の容量まで戻り, 書き込みはブロックしない
+	for i := 0; i < 8; i++ {
+		if _, err := dbuf.TryWrite([]byte{byte(i)}); err != nil {
+			t.Fatalf("[error] [Datagram Buffer] [TryWrite %d]: %v", i, err)
+		}
+	}
+	if n := dbuf.Available(); n != 0 {
+		t.Errorf("expected 0 (got %d)", n)
+	}
+	for i := 0; i < 8; i++ {
+		p := make([]byte, 1)
+		if _, err := dbuf.Read(p); err != nil || p[0] != byte(i) {
+			t.Errorf("expected %d, <nil> (got %d, %v)", i, p[0], err)
+		}
+	}
+}
+
+func TestStreamBufSnapshotRestore(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(3)
+	for i, in := range []string{"hello", " ", "ebuf"} {
+		if _, err := sbuf.Write([]byte(in)); err != nil {
+			t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+		}
+	}
+	// 一部を読んでおき, 取り込み済みのバイトもスナップショットに含まれることを確かめる
+	p := make([]byte, 2)
+	sbuf.Read(p)
+
+	snap := sbuf.Snapshot()
+	if string(snap) != "llo ebuf" {
+		t.Errorf("expected llo ebuf (got %s)", snap)
+	}
+
+	// 容量が足りなくても復元でき, 同じバイト列が読める
+	restored := ebuf.RestoreStreamBuf(0, snap)
+	restored.Close()
+	actual, err := io.ReadAll(restored)
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [ReadAll]: %v", err)
+	}
+	if string(actual) != string(snap) {
+		t.Errorf("expected %s (got %s)", snap, actual)
+	}
+
+	// 元のバッファはそのまま読める
+	sbuf.Close()
+	if actual, _ := io.ReadAll(sbuf); string(actual) != "llo ebuf" {
+		t.Errorf("expected llo ebuf (got %s)", actual)
+	}
+}
+
+func TestWithWriteRateLimit(t *testing.T) {
+	const rate, volume = 10000, 2000
+	sbuf := ebuf.NewStreamBuf(10, ebuf.WithWriteRateLimit(rate))
+
+	// volume/rate 以上かかるように書き込みが待たされる
+	start := time.Now()
+	for i := 0; i < volume/200; i++ {
+		if _, err := sbuf.Write(make([]byte, 200)); err != nil {
+			t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+		}
+	}
+	want := time.Duration(volume * float64(time.Second) / rate)
+	if elapsed := time.Since(start); elapsed < want*9/10 {
+		t.Errorf("expected at least %v (got %v)", want, elapsed)
+	}
+
+	// トークンを待たずに済まない TryWrite は ErrWouldBlock を返す
+	if _, err := sbuf.TryWrite(make([]byte, 200)); err != ebuf.ErrWouldBlock {
+		t.Errorf("expected %v (got %v)", ebuf.ErrWouldBlock, err)
+	}
+
+	// トークン待ちの間もタイムアウトと Close は尊重される
+	if _, err := sbuf.WriteTimeout(make([]byte, rate), 10*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected %v (got %v)", os.ErrDeadlineExceeded, err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sbuf.Close()
+	}()
+	if _, err := sbuf.Write(make([]byte, rate)); err != ebuf.ErrClosed {
+		t.Errorf("expected %v (got %v)", ebuf.ErrClosed, err)
+	}
+}
+
+func TestWithWriteRateLimitFailedWrites(t *testing.T) {
+	const rate = 10000
+	sbuf := ebuf.NewStreamBuf(1, ebuf.WithWriteRateLimit(rate))
+	time.Sleep(200 * time.Millisecond)
+	sbuf.Write([]byte("a"))
+
+	// 失敗した書き込みはトークンを消費しない
+	for i := 0; i < 3; i++ {
+		if _, err := sbuf.TryWrite(make([]byte, 1500)); err != ebuf.ErrWouldBlock {
+			t.Errorf("expected %v (got %v)", ebuf.ErrWouldBlock, err)
+		}
+	}
+	sbuf.Read(make([]byte, 1))
+	start := time.Now()
+	if _, err := sbuf.Write(make([]byte, 1500)); err != nil {
+		t.Errorf("[error] [Stream Buffer] [Write]: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected no wait (got %v)", elapsed)
+	}
+}
+
+func TestStreamBufReadChunk(t *testing.T) {
+	// 空のチャンクも送る
+	sbuf := ebuf.NewStreamBuf(4, ebuf.WithAllowEmptyWrites(true))
+	for i, in := range []string{"hello", "", "ebuf", "!"} {
+		if _, err := sbuf.Write([]byte(in)); err != nil {
+			t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+		}
+	}
+	sbuf.Close()
+
+	// Read で途中まで読んだチャンクは, その残りが一つのチャンクとして返る
+	p := make([]byte, 2)
+	if n, err := sbuf.Read(p); n != 2 || err != nil {
+		t.Errorf("expected (2, <nil>) (got (%d, %v))", n, err)
+	}
+	for i, expected := range []string{"llo", "", "eb"} {
+		var actual []byte
+		var err error
+		if i < 2 {
+			actual, err = sbuf.ReadChunk()
+		} else {
+			// ReadChunk の後は, Read はまたバイト列として読む
+			actual = make([]byte, 2)
+			_, err = sbuf.Read(actual)
+		}
+		if err != nil || string(actual) != expected {
+			t.Errorf("[%d] expected %q, <nil> (got %q, %v)", i, expected, actual, err)
+		}
+	}
+	for i, expected := range []string{"uf", "!"} {
+		actual, err := sbuf.ReadChunk()
+		if err != nil || string(actual) != expected {
+			t.Errorf("[%d] expected %q, <nil> (got %q, %v)", i, expected, actual, err)
+		}
+	}
+	if _, err := sbuf.ReadChunk(); err != ebuf.ErrWriterClosed {
+		t.Errorf("expected %v (got %v)", ebuf.ErrWriterClosed, err)
+	}
+}
+
+func TestStreamBufReadString(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(4)
+	go func() {
+		// 区切りがチャンクをまたいでも, 一つのチャンクに複数あってもよい
+		for i, in := range []string{"GET ", "/\nHost: a\nAcc", "ept: */*\n", "tail"} {
+			if _, err := sbuf.WriteString(in); err != nil {
+				t.Errorf("[error] [Stream Buffer] [WriteString %d]: %v", i, err)
+			}
+		}
+		sbuf.Close()
+	}()
+
+	for i, expected := range []string{"GET /\n", "Host: a\n", "Accept: */*\n"} {
+		actual, err := sbuf.ReadString('\n')
+		if err != nil || actual != expected {
+			t.Errorf("[%d] expected %q, <nil> (got %q, %v)", i, expected, actual, err)
+		}
+	}
+
+	// 区切りのない末尾は ErrWriterClosed と共に返る
+	if actual, err := sbuf.ReadString('\n'); actual != "tail" || err != ebuf.ErrWriterClosed {
+		t.Errorf("expected %q, %v (got %q, %v)", "tail", ebuf.ErrWriterClosed, actual, err)
+	}
+	if actual, err := sbuf.ReadString('\n'); actual != "" || err != ebuf.ErrWriterClosed {
+		t.Errorf("expected %q, %v (got %q, %v)", "", ebuf.ErrWriterClosed, actual, err)
+	}
+}
+
+func TestWithReadTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	tests := []struct {
+		name string
+		read func([]byte) (int, error)
+	}{
+		{"DatagramBuf", ebuf.NewDatagramBuf(1, ebuf.WithReadTimeout(timeout)).Read},
+		{"StreamBuf", ebuf.NewStreamBuf(1, ebuf.WithReadTimeout(timeout)).Read},
+		// StreamBuf のブロックする読み出しはすべてタイムアウトする
+		{"StreamBuf.ReadChunk", func(p []byte) (int, error) {
+			c, err := ebuf.NewStreamBuf(1, ebuf.WithReadTimeout(timeout)).ReadChunk()
+			return len(c), err
+		}},
+		{"StreamBuf.ReadString", func(p []byte) (int, error) {
+			sbuf := ebuf.NewStreamBuf(1, ebuf.WithReadTimeout(timeout))
+			sbuf.Write([]byte("no newline"))
+			s, err := sbuf.ReadString('\n')
+			return len(s), err
+		}},
+		{"StreamBuf.ReadVectored", func(p []byte) (int, error) {
+			return ebuf.NewStreamBuf(1, ebuf.WithReadTimeout(timeout)).ReadVectored([][]byte{p})
+		}},
+		{"StreamBuf.ReadWithBoundaries", func(p []byte) (int, error) {
+			n, _, err := ebuf.NewStreamBuf(1, ebuf.WithReadTimeout(timeout)).ReadWithBoundaries(p)
+			return n, err
+		}},
+	}
+	for _, test := range tests {
+		// 空のバッファの Read は, ブロックし続けずにタイムアウトする
+		start := time.Now()
+		n, err := test.read(make([]byte, 1))
+		var terr *ebuf.TimeoutError
+		if n != 0 || !errors.As(err, &terr) {
+			t.Errorf("[%s] expected (0, %v) (got (%d, %v))", test.name, &ebuf.TimeoutError{}, n, err)
+		}
+		if elapsed := time.Since(start); elapsed < timeout || elapsed > 10*timeout {
+			t.Errorf("[%s] expected about %v (got %v)", test.name, timeout, elapsed)
+		}
+	}
+}
+
+func TestStreamBufLen(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(8)
+	buffered := 0
+	check := func(op string) {
+		t.Helper()
+		if n := sbuf.Len(); n != buffered {
+			t.Errorf("[%s] expected %d (got %d)", op, buffered, n)
+		}
+	}
+
+	// 様々な読み書きを交互に行い, Len が常に実際のバイト数と一致することを確かめる
+	for i := 0; i < 3; i++ {
+		sbuf.Write([]byte("hello"))
+		sbuf.WriteString("")
+		sbuf.WriteVectored([]byte("eb"), []byte("uf"))
+		buffered += 9
+		check("Write")
+
+		n, _ := sbuf.Read(make([]byte, 3))
+		buffered -= n
+		check("Read")
+
+		// Bytes も ReadChunk もチャンクの区切りを変えない
+		sbuf.Bytes()
+		check("Bytes")
+		p, _ := sbuf.ReadChunk()
+		buffered -= len(p)
+		check("ReadChunk")
+
+		var w bytes.Buffer
+		m, _ := sbuf.DrainTo(&w, 2)
+		buffered -= int(m)
+		check("DrainTo")
+
+		n, _ = sbuf.ReadVectored([][]byte{make([]byte, 1), make([]byte, 1)})
+		buffered -= n
+		check("ReadVectored")
+	}
+
+	dst := ebuf.NewStreamBuf(8)
+	sbuf.Close()
+	ebuf.Copy(dst, sbuf)
+	buffered = 0
+	check("Copy")
+}
+
+func TestDatagramBufWaitForDepth(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(8)
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(10 * time.Millisecond)
+			dbuf.Write([]byte{byte(i)})
+		}
+	}()
+
+	// 少しずつ書き込まれ, 閾値に届いたところで返る
+	start := time.Now()
+	if depth := dbuf.WaitForDepth(3, time.Second); depth != 3 {
+		t.Errorf("expected 3 (got %d)", depth)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected to return at the threshold (got %v)", elapsed)
+	}
+
+	// 閾値に届かなければ, タイムアウトでその時点の数を返す
+	start = time.Now()
+	if depth := dbuf.WaitForDepth(5, 30*time.Millisecond); depth != 3 {
+		t.Errorf("expected 3 (got %d)", depth)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("expected to wait for the timeout (got %v)", elapsed)
+	}
+}
+
+func TestReadNil(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(2)
+	dbuf.Write([]byte("hello"))
+	dbuf.Write([]byte("world"))
+
+	// Read(nil) はデータグラムを消費しない
+	if n, err := dbuf.Read(nil); n != 0 || err != nil {
+		t.Errorf("expected (0, <nil>) (got (%d, %v))", n, err)
+	}
+	// DiscardDatagram は一つ消費して捨てる
+	if n, err := dbuf.DiscardDatagram(); n != 5 || err != nil {
+		t.Errorf("expected (5, <nil>) (got (%d, %v))", n, err)
+	}
+	p := make([]byte, 5)
+	if n, err := dbuf.Read(p); n != 5 || err != nil || string(p) != "world" {
+		t.Errorf("expected world, <nil> (got %s, %v)", p[:n], err)
+	}
+
+	// StreamBuf の空の Read は, 閉じた後でも何もしない
+	sbuf := ebuf.NewStreamBuf(1)
+	sbuf.Write([]byte("a"))
+	sbuf.CloseRead()
+	for _, p := range [][]byte{nil, {}} {
+		if n, err := sbuf.Read(p); n != 0 || err != nil {
+			t.Errorf("expected (0, <nil>) (got (%d, %v))", n, err)
+		}
+	}
+}
+
+func TestStreamBufIoCopy(t *testing.T) {
+	src := ebuf.NewStreamBuf(2)
+	dst := ebuf.NewStreamBuf(2)
+
+	// io.ReadWriteCloser として, io.Copy で端から端まで流せる
+	var rwc io.ReadWriteCloser = src
+	go func() {
+		for i, in := range []string{"hello", " ", "ebuf"} {
+			if _, err := rwc.Write([]byte(in)); err != nil {
+				t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+			}
+		}
+		rwc.Close()
+	}()
+	go func() {
+		if _, err := io.Copy(dst, src); err != nil {
+			t.Errorf("[error] [Stream Buffer] [io.Copy]: %v", err)
+		}
+		dst.Close()
+	}()
+
+	actual, err := io.ReadAll(dst)
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [ReadAll]: %v", err)
+	}
+	if string(actual) != "hello ebuf" {
+		t.Errorf("expected hello ebuf (got %s)", actual)
+	}
+}
+
+func TestSelectRead(t *testing.T) {
+	bufs := []*ebuf.StreamBuf{ebuf.NewStreamBuf(2), ebuf.NewStreamBuf(2)}
+	writes := []struct {
+		index int
+		data  string
+	}{
+		{1, "one"},
+		{0, "zero"},
+		{1, "uno"},
+	}
+	go func() {
+		// 時間をずらして, それぞれのバッファに書き込む
+		for _, w := range writes {
+			time.Sleep(10 * time.Millisecond)
+			bufs[w.index].Write([]byte(w.data))
+		}
+		bufs[0].Close()
+		time.Sleep(10 * time.Millisecond)
+		bufs[1].Close()
+	}()
+
+	for i, w := range writes {
+		index, p, err := ebuf.SelectRead(bufs...)
+		if index != w.index || string(p) != w.data || err != nil {
+			t.Errorf("[%d] expected (%d, %s, <nil>) (got (%d, %s, %v))", i, w.index, w.data, index, p, err)
+		}
+	}
+
+	// 全てが閉じて読み切られると io.EOF を返す
+	if index, p, err := ebuf.SelectRead(bufs...); index != -1 || p != nil || err != io.EOF {
+		t.Errorf("expected (-1, [], %v) (got (%d, %v, %v))", io.EOF, index, p, err)
+	}
+}
+
+func TestSelectReadWhileReadBlocked(t *testing.T) {
+	bufs := []*ebuf.StreamBuf{ebuf.NewStreamBuf(1), ebuf.NewStreamBuf(1)}
+	go bufs[0].Read(make([]byte, 1))
+	time.Sleep(10 * time.Millisecond)
+
+	// bufs[0] で Read がブロックしていても bufs[1] のデータを読める
+	bufs[1].Write([]byte("one"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if index, p, err := ebuf.SelectRead(bufs...); index != 1 || string(p) != "one" || err != nil {
+			t.Errorf("expected (1, one, <nil>) (got (%d, %s, %v))", index, p, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SelectRead is blocked behind Read")
+	}
+	bufs[0].Write([]byte("a"))
+
+	// 他の読み出しが返ると, 残っているデータを読む
+	src, dst := ebuf.NewStreamBuf(2), ebuf.NewStreamBuf(0)
+	src.Write([]byte("a"))
+	src.Write([]byte("b"))
+	go ebuf.Copy(dst, src)
+	time.Sleep(10 * time.Millisecond)
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		if index, p, err := ebuf.SelectRead(src); index != 0 || string(p) != "b" || err != nil {
+			t.Errorf("expected (0, b, <nil>) (got (%d, %s, %v))", index, p, err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	dst.CloseRead()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SelectRead is not woken up by the end of Copy")
+	}
+}
+
+func TestWithChecksum(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(2, ebuf.WithNoCopy(), ebuf.WithChecksum())
+
+	in := []byte("hello")
+	dbuf.Write(in)
+	dbuf.Write([]byte("world"))
+	// 所有権を渡したスライスを書き込み後に変更すると, 読み出しで検出される
+	in[0] = 'j'
+
+	p := make([]byte, 5)
+	if n, err := dbuf.Read(p); n != 0 || err != ebuf.ErrChecksumMismatch {
+		t.Errorf("expected (0, %v) (got (%d, %v))", ebuf.ErrChecksumMismatch, n, err)
+	}
+	// 壊れたデータグラムは捨てられ, 次のものは読める
+	if n, err := dbuf.Read(p); n != 5 || err != nil || string(p) != "world" {
+		t.Errorf("expected world, <nil> (got %s, %v)", p[:n], err)
+	}
+}
+
+func TestWithSpin(t *testing.T) {
+	// スピンしても読み書きの結果は変わらない
+	for _, spin := range []int{0, 1000} {
+		sbuf := ebuf.NewStreamBuf(0, ebuf.WithSpin(spin))
+		go func() {
+			for i := 0; i < 100; i++ {
+				sbuf.Write([]byte{byte(i)})
+			}
+			sbuf.Close()
+		}()
+
+		actual, err := io.ReadAll(sbuf)
+		if err != nil {
+			t.Errorf("[spin %d] [error] [Stream Buffer] [ReadAll]: %v", spin, err)
+		}
+		for i := 0; i < 100; i++ {
+			if i >= len(actual) || actual[i] != byte(i) {
+				t.Fatalf("[spin %d] expected 100 bytes in order (got %v)", spin, actual)
+			}
+		}
+	}
+}
+
+// benchmarkSpin measures the round trip of one byte between two goroutines.
+// Spinning pays off only if each goroutine has its own core, so compare
+// the results with -cpu of at least 2 on an idle machine.
+func benchmarkSpin(b *testing.B, spin int) {
+	ping := ebuf.NewStreamBuf(1, ebuf.WithSpin(spin))
+	pong := ebuf.NewStreamBuf(1, ebuf.WithSpin(spin))
+	go func() {
+		p := make([]byte, 1)
+		for {
+			if _, err := ping.Read(p); err != nil {
+				pong.Close()
+				return
+			}
+			pong.Write(p)
+		}
+	}()
+
+	p := make([]byte, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ping.Write(p)
+		if _, err := pong.Read(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	ping.Close()
+}
+
+func BenchmarkStreamBufNoSpin(b *testing.B) {
+	benchmarkSpin(b, 0)
+}
+
+func BenchmarkStreamBufSpin(b *testing.B) {
+	benchmarkSpin(b, 1000)
+}
+
+func TestDatagramBufWriteNotify(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(2)
+	delivered, err := dbuf.WriteNotify([]byte("hello"))
+	if err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [WriteNotify]: %v", err)
+	}
+
+	// 読まれるまでは閉じられない
+	select {
+	case <-delivered:
+		t.Errorf("expected not to be delivered before Read")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if _, err := dbuf.Read(make([]byte, 5)); err != nil {
+		t.Errorf("[error] [Datagram Buffer] [Read]: %v", err)
+	}
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Errorf("expected to be delivered after Read")
+	}
+
+	dbuf.Close()
+	if ch, err := dbuf.WriteNotify([]byte("world")); ch != nil || err != ebuf.ErrClosed {
+		t.Errorf("expected (<nil>, %v) (got (%v, %v))", ebuf.ErrClosed, ch, err)
+	}
+}
+
+func TestStreamBufWaitNotEmpty(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(1)
+
+	// 空のまま取り消されると ctx.Err() を返す
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sbuf.WaitNotEmpty(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v (got %v)", context.DeadlineExceeded, err)
+	}
+
+	// 先にデータが届くと nil を返し, 何も消費しない
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sbuf.Write([]byte("hello"))
+	}()
+	if err := sbuf.WaitNotEmpty(context.Background()); err != nil {
+		t.Errorf("expected <nil> (got %v)", err)
+	}
+	if n := sbuf.Len(); n != 5 {
+		t.Errorf("expected 5 (got %d)", n)
+	}
+	if err := sbuf.WaitNotEmpty(context.Background()); err != nil {
+		t.Errorf("expected <nil> (got %v)", err)
+	}
+}
+
+func TestNewBufFrom(t *testing.T) {
+	initial := []byte("seed")
+	sbuf := ebuf.NewStreamBufFrom(1, initial)
+	// 元のスライスを変更しても影響しない
+	initial[0] = 'f'
+	sbuf.Write([]byte(" and more"))
+	sbuf.Close()
+	if actual, err := io.ReadAll(sbuf); string(actual) != "seed and more" || err != nil {
+		t.Errorf("expected seed and more, <nil> (got %s, %v)", actual, err)
+	}
+
+	// 書き込みのオプションは初期のデータグラムにはかからない
+	dbuf := ebuf.NewDatagramBufFrom(3, [][]byte{[]byte("a"), []byte("bc")}, ebuf.WithMaxWriteSize(1))
+	if _, err := dbuf.Write([]byte("de")); err != ebuf.ErrTooLarge {
+		t.Errorf("expected %v (got %v)", ebuf.ErrTooLarge, err)
+	}
+	dbuf.Write([]byte("f"))
+	dbuf.Close()
+	var actual []string
+	for d := range dbuf.All() {
+		actual = append(actual, string(d))
+	}
+	if !slices.Equal(actual, []string{"a", "bc", "f"}) {
+		t.Errorf("expected [a bc f] (got %v)", actual)
+	}
+
+	for _, test := range []struct {
+		nrDgrams int
+		msg      string
+	}{
+		{1, "ebuf: too many initial datagrams"},
+		{-1, "ebuf: " + ebuf.ErrNegativeCapacity.Error()},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r != test.msg {
+					t.Errorf("expected panic %q (got %v)", test.msg, r)
+				}
+			}()
+			ebuf.NewDatagramBufFrom(test.nrDgrams, [][]byte{[]byte("a"), []byte("b")})
+		}()
+	}
+}
+
+func TestWriteMulti(t *testing.T) {
+	full := ebuf.NewDatagramBuf(1)
+	full.Write([]byte("old"))
+	bufs := []*ebuf.DatagramBuf{ebuf.NewDatagramBuf(1), full, ebuf.NewDatagramBuf(1)}
+
+	// 満杯のバッファは飛ばされ, 残りの二つが受け取る
+	if written, err := ebuf.WriteMulti([]byte("hello"), bufs...); written != 2 || err != nil {
+		t.Errorf("expected (2, <nil>) (got (%d, %v))", written, err)
+	}
+	for i, expected := range []string{"hello", "old", "hello"} {
+		p := make([]byte, 5)
+		n, err := bufs[i].Read(p)
+		if err != nil || string(p[:n]) != expected {
+			t.Errorf("[%d] expected %s, <nil> (got %s, %v)", i, expected, p[:n], err)
+		}
+	}
+
+	// 閉じたバッファのエラーは返されるが, 他には書き込まれる
+	bufs[0].Close()
+	if written, err := ebuf.WriteMulti([]byte("world"), bufs...); written != 2 || err != ebuf.ErrClosed {
+		t.Errorf("expected (2, %v) (got (%d, %v))", ebuf.ErrClosed, written, err)
+	}
+}
+
+func TestStreamBufContext(t *testing.T) {
+	reason := errors.New("peer reset")
+	tests := []struct {
+		name  string
+		close func(*ebuf.StreamBuf)
+		cause error
+	}{
+		{"Close", func(b *ebuf.StreamBuf) { b.Close() }, ebuf.ErrClosed},
+		{"CloseWithError", func(b *ebuf.StreamBuf) { b.CloseWithError(reason) }, reason},
+	}
+	for _, test := range tests {
+		sbuf := ebuf.NewStreamBuf(1)
+		ctx := sbuf.Context()
+		if ctx.Err() != nil {
+			t.Errorf("[%s] expected <nil> before close (got %v)", test.name, ctx.Err())
+		}
+
+		// 閉じると取り消され, 理由が Cause になる
+		test.close(sbuf)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("[%s] expected the context to be canceled", test.name)
+		}
+		if ctx.Err() != context.Canceled || context.Cause(ctx) != test.cause {
+			t.Errorf("[%s] expected (%v, %v) (got (%v, %v))", test.name, context.Canceled, test.cause, ctx.Err(), context.Cause(ctx))
+		}
+		if sbuf.Context() != ctx {
+			t.Errorf("[%s] expected the same context", test.name)
+		}
+	}
+}
+
+func TestStreamBufReadUntilBytes(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(8)
+	// 区切りがチャンクの境界で分かれていても見つかる
+	for _, in := range []string{"HTTP/1.1 200\r", "\nA: b\r\n", "\r", "\nbody"} {
+		sbuf.WriteString(in)
+	}
+	sbuf.Close()
+
+	for i, expected := range []string{"HTTP/1.1 200\r\n", "A: b\r\n", "\r\n"} {
+		actual, err := sbuf.ReadUntilBytes([]byte("\r\n"))
+		if err != nil || string(actual) != expected {
+			t.Errorf("[%d] expected %q, <nil> (got %q, %v)", i, expected, actual, err)
+		}
+	}
+	if actual, err := sbuf.ReadUntilBytes([]byte("\r\n")); string(actual) != "body" || err != ebuf.ErrWriterClosed {
+		t.Errorf("expected %q, %v (got %q, %v)", "body", ebuf.ErrWriterClosed, actual, err)
+	}
+}
+
+func TestWithMaxTokenSize(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(4, ebuf.WithMaxTokenSize(8))
+	sbuf.WriteString("0123456")
+	sbuf.WriteString("789abc")
+	sbuf.WriteString("ok\n")
+	sbuf.Close()
+
+	// 区切りのないまま上限を超えると, 溜めたデータを捨ててエラーを返す
+	if actual, err := sbuf.ReadString('\n'); actual != "" || err != ebuf.ErrTokenTooLong {
+		t.Errorf("expected %q, %v (got %q, %v)", "", ebuf.ErrTokenTooLong, actual, err)
+	}
+	// 次の読み出しは, 捨てられたデータの後から続く
+	if actual, err := sbuf.ReadString('\n'); actual != "ok\n" || err != nil {
+		t.Errorf("expected %q, <nil> (got %q, %v)", "ok\n", actual, err)
+	}
+}
+
+func TestWithWriteInterceptor(t *testing.T) {
+	errOversized := errors.New("oversized")
+	dbuf := ebuf.NewDatagramBuf(3, ebuf.WithWriteInterceptor(func(p []byte) error {
+		if len(p) > 3 {
+			return errOversized
+		}
+		return nil
+	}))
+
+	for _, in := range []string{"ab", "hello", "cde"} {
+		n, err := dbuf.Write([]byte(in))
+		// 大きすぎるデータグラムは, そのエラーで拒否される
+		if len(in) > 3 && (n != 0 || err != errOversized) {
+			t.Errorf("expected (0, %v) (got (%d, %v))", errOversized, n, err)
+		}
+		if len(in) <= 3 && err != nil {
+			t.Errorf("[error] [Datagram Buffer] [Write]: %v", err)
+		}
+	}
+	dbuf.Close()
+
+	// 拒否されたデータグラムはバッファされない
+	var actual []string
+	for d := range dbuf.All() {
+		actual = append(actual, string(d))
+	}
+	if !slices.Equal(actual, []string{"ab", "cde"}) {
+		t.Errorf("expected [ab cde] (got %v)", actual)
+	}
+}
+
+func TestSingleWriterOrder(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	const count = 5000
+
+	tests := []struct {
+		name string
+		buf  interface {
+			Write([]byte) (int, error)
+			Read([]byte) (int, error)
+			Close() error
+		}
+	}{
+		{"DatagramBuf", ebuf.NewDatagramBuf(16)},
+		{"DatagramBuf unbuffered", ebuf.NewDatagramBuf(0)},
+		// 縮小と再拡大で内部のチャネルが置き換えられても順序は保たれる
+		{"DatagramBuf WithIdleShrink", ebuf.NewDatagramBuf(16, ebuf.WithIdleShrink(time.Microsecond, 1))},
+		{"StreamBuf", ebuf.NewStreamBuf(16)},
+		{"StreamBuf WithSpin", ebuf.NewStreamBuf(16, ebuf.WithSpin(100))},
+	}
+	for _, test := range tests {
+		go func() {
+			for i := 0; i < count; i++ {
+				p := make([]byte, 4)
+				binary.BigEndian.PutUint32(p, uint32(i))
+				if _, err := test.buf.Write(p); err != nil {
+					t.Errorf("[error] [%s] [Write %d]: %v", test.name, i, err)
+				}
+			}
+			test.buf.Close()
+		}()
+
+		// 一つの書き手の書き込みは, 抜けも重複もなく書いた順に読める
+		p := make([]byte, 4)
+		for i := 0; i < count; i++ {
+			if _, err := io.ReadFull(test.buf, p); err != nil {
+				t.Fatalf("[error] [%s] [Read %d]: %v", test.name, i, err)
+			}
+			if n := binary.BigEndian.Uint32(p); n != uint32(i) {
+				t.Fatalf("[%s] expected %d (got %d)", test.name, i, n)
+			}
+		}
+		if _, err := test.buf.Read(p); err != io.EOF {
+			t.Errorf("[%s] expected %v (got %v)", test.name, io.EOF, err)
+		}
+	}
+}
+
+func TestWithRequireReader(t *testing.T) {
+	// 読み手がいないまま満杯になると, ブロックせずに ErrNoReader を返す
+	dbuf := ebuf.NewDatagramBuf(1, ebuf.WithRequireReader())
+	if _, err := dbuf.Write([]byte("a")); err != nil {
+		t.Errorf("[error] [Datagram Buffer] [Write]: %v", err)
+	}
+	if n, err := dbuf.Write([]byte("b")); n != 0 || err != ebuf.ErrNoReader {
+		t.Errorf("expected (0, %v) (got (%d, %v))", ebuf.ErrNoReader, n, err)
+	}
+
+	// 読み手がいれば, 満杯でも読まれるまで待って成功する
+	sbuf := ebuf.NewStreamBuf(1, ebuf.WithRequireReader())
+	go func() {
+		p := make([]byte, 1)
+		for {
+			if _, err := sbuf.Read(p); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := sbuf.Write([]byte("a")); err != nil {
+			t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+		}
+	}
+	sbuf.Close()
+}
+
+func TestWithMaxAge(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(4, ebuf.WithMaxAge(20*time.Millisecond))
+	defer dbuf.Close()
+
+	for _, in := range []string{"a", "b", "c"} {
+		dbuf.Write([]byte(in))
+	}
+
+	// 読み出しが止まっている間に古いデータグラムは取り除かれる
+	time.Sleep(100 * time.Millisecond)
+	if n := dbuf.Available(); n != 4 {
+		t.Errorf("expected 4 (got %d)", n)
+	}
+	if n := dbuf.Expired(); n != 3 {
+		t.Errorf("expected 3 (got %d)", n)
+	}
+
+	// 読み出しを再開すると新しいデータグラムだけが返る
+	dbuf.Write([]byte("d"))
+	p := make([]byte, 1)
+	if n, err := dbuf.Read(p); err != nil || string(p[:n]) != "d" {
+		t.Errorf("expected d, <nil> (got %s, %v)", p[:n], err)
+	}
+}
+
+func TestStreamBufReadEx(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(2)
+	p := make([]byte, 8)
+
+	// バッファ済みのデータはブロックせずに読める
+	sbuf.Write([]byte("abc"))
+	if n, blocked, err := sbuf.ReadEx(p); err != nil || string(p[:n]) != "abc" || blocked {
+		t.Errorf("expected abc, false, <nil> (got %s, %v, %v)", p[:n], blocked, err)
+	}
+
+	// データが来るまで待った読み出しはブロックしたと報告する
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sbuf.Write([]byte("de"))
+	}()
+	if n, blocked, err := sbuf.ReadEx(p); err != nil || string(p[:n]) != "de" || !blocked {
+		t.Errorf("expected de, true, <nil> (got %s, %v, %v)", p[:n], blocked, err)
+	}
+}
+
+func TestStreamBufCloseHandoff(t *testing.T) {
+	src := ebuf.NewStreamBuf(4)
+	dst := ebuf.NewStreamBuf(4)
+	for _, in := range []string{"hello", " ", "ebuf"} {
+		src.Write([]byte(in))
+	}
+	// 一部を読み出して残りを引き継ぐ
+	p := make([]byte, 2)
+	src.Read(p)
+
+	if err := src.CloseHandoff(dst); err != nil {
+		t.Fatalf("[error] [Stream Buffer] [CloseHandoff]: %v", err)
+	}
+	if n, err := src.Read(p); n != 0 || err != io.EOF {
+		t.Errorf("expected 0, EOF (got %d, %v)", n, err)
+	}
+
+	// チャンクの境界を保ったまま dst から読める
+	dst.Close()
+	for _, want := range []string{"llo", " ", "ebuf"} {
+		c, err := dst.ReadChunk()
+		if err != nil || string(c) != want {
+			t.Errorf("expected %s, <nil> (got %s, %v)", want, c, err)
+		}
+	}
+}
+
+func TestStreamBufReadToWriter(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(4)
+	sbuf.Write([]byte("hello"))
+	sbuf.Write([]byte(" ebuf"))
+
+	var w bytes.Buffer
+	if n, err := sbuf.ReadToWriter(&w, 7); n != 7 || err != nil {
+		t.Errorf("expected 7, <nil> (got %d, %v)", n, err)
+	}
+	if s := w.String(); s != "hello e" {
+		t.Errorf("expected hello e (got %s)", s)
+	}
+
+	// 残りは StreamBuf から読める
+	p := make([]byte, 8)
+	if n, _ := sbuf.Read(p); string(p[:n]) != "buf" {
+		t.Errorf("expected buf (got %s)", p[:n])
+	}
+}
+
+func TestWithReadDelay(t *testing.T) {
+	const d = 20 * time.Millisecond
+	sbuf := ebuf.NewStreamBuf(1, ebuf.WithReadDelay(d))
+
+	// 小さいバッファでは遅い読み手に合わせて書き込みがブロックする
+	wrote := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		for i := 0; i < 4; i++ {
+			sbuf.Write([]byte{byte(i)})
+		}
+		wrote <- time.Since(start)
+	}()
+
+	var last time.Time
+	p := make([]byte, 1)
+	for i := 0; i < 4; i++ {
+		if _, err := sbuf.Read(p); err != nil || p[0] != byte(i) {
+			t.Fatalf("expected %d, <nil> (got %d, %v)", i, p[0], err)
+		}
+		now := time.Now()
+		// 読み出しは d 以上の間隔をあけて返る
+		if i > 0 && now.Sub(last) < d {
+			t.Errorf("expected reads spaced at least %v (got %v)", d, now.Sub(last))
+		}
+		last = now
+	}
+	if elapsed := <-wrote; elapsed < 2*d {
+		t.Errorf("expected writes blocked at least %v (got %v)", 2*d, elapsed)
+	}
+}
+
+func TestDatagramBufWriteAllOrNone(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(3)
+	dbuf.Write([]byte("x"))
+
+	// 3 つのうち 2 つしか入らないときは 1 つも書き込まない
+	if ok, err := dbuf.WriteAllOrNone([]byte("a"), []byte("b"), []byte("c")); ok || err != nil {
+		t.Errorf("expected false, <nil> (got %v, %v)", ok, err)
+	}
+	if n := dbuf.Available(); n != 2 {
+		t.Errorf("expected 2 (got %d)", n)
+	}
+
+	// 全部入るときはまとめて書き込む
+	if ok, err := dbuf.WriteAllOrNone([]byte("a"), []byte("b")); !ok || err != nil {
+		t.Errorf("expected true, <nil> (got %v, %v)", ok, err)
+	}
+	for _, want := range []string{"x", "a", "b"} {
+		p := make([]byte, 1)
+		if n, err := dbuf.Read(p); err != nil || string(p[:n]) != want {
+			t.Errorf("expected %s, <nil> (got %s, %v)", want, p[:n], err)
+		}
+	}
+
+	dbuf.Close()
+	if ok, err := dbuf.WriteAllOrNone([]byte("a")); ok || err != ebuf.ErrClosed {
+		t.Errorf("expected false, ErrClosed (got %v, %v)", ok, err)
+	}
+
+	// 空のデータグラムは WithAllowEmptyWrites(false) なら飛ばす
+	dbuf = ebuf.NewDatagramBuf(1, ebuf.WithAllowEmptyWrites(false))
+	if ok, err := dbuf.WriteAllOrNone([]byte("a"), nil); !ok || err != nil {
+		t.Errorf("expected true, <nil> (got %v, %v)", ok, err)
+	}
+
+	// 読み手がいなければ ErrNoReader を返す
+	dbuf = ebuf.NewDatagramBuf(1, ebuf.WithRequireReader())
+	if ok, err := dbuf.WriteAllOrNone([]byte("a"), []byte("b")); ok || err != ebuf.ErrNoReader {
+		t.Errorf("expected false, %v (got %v, %v)", ebuf.ErrNoReader, ok, err)
+	}
+
+	// observer には全体で 1 回の書き込みとして見える
+	obs := &recordingObserver{}
+	dbuf = ebuf.NewDatagramBuf(2, ebuf.WithObserver(obs))
+	dbuf.WriteAllOrNone([]byte("a"), []byte("bc"))
+	dbuf.WriteAllOrNone([]byte("d"), []byte("e"))
+	if len(obs.writes) != 2 || obs.writes[0].bytes != 3 || obs.writes[1].bytes != 0 {
+		t.Errorf("expected [{3 false} {0 false}] (got %v)", obs.writes)
+	}
+}
+
+func TestDatagramBufBufferedBytes(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(4)
+	for _, in := range []string{"a", "bcd", "efghij"} {
+		dbuf.Write([]byte(in))
+	}
+	if n := dbuf.BufferedBytes(); n != 10 {
+		t.Errorf("expected 10 (got %d)", n)
+	}
+
+	// 読み出すとその分だけ減る
+	p := make([]byte, 8)
+	dbuf.Read(p)
+	if n := dbuf.BufferedBytes(); n != 9 {
+		t.Errorf("expected 9 (got %d)", n)
+	}
+	dbuf.Read(p)
+	dbuf.Read(p)
+	if n := dbuf.BufferedBytes(); n != 0 {
+		t.Errorf("expected 0 (got %d)", n)
+	}
+}
+
+func TestWithAllowEmptyWrites(t *testing.T) {
+	// StreamBuf は既定で空の Write を捨てる
+	sbuf := ebuf.NewStreamBuf(1)
+	if n, err := sbuf.Write(nil); n != 0 || err != nil {
+		t.Errorf("expected 0, <nil> (got %d, %v)", n, err)
+	}
+	if n, err := sbuf.TryWrite([]byte("a")); n != 1 || err != nil {
+		t.Errorf("expected 1, <nil> (got %d, %v)", n, err)
+	}
+
+	sbuf = ebuf.NewStreamBuf(1, ebuf.WithAllowEmptyWrites(true))
+	sbuf.Write(nil)
+	if _, err := sbuf.TryWrite([]byte("a")); err != ebuf.ErrWouldBlock {
+		t.Errorf("expected %v (got %v)", ebuf.ErrWouldBlock, err)
+	}
+	if c, err := sbuf.ReadChunk(); len(c) != 0 || err != nil {
+		t.Errorf("expected empty, <nil> (got %q, %v)", c, err)
+	}
+
+	// DatagramBuf は既定で空のデータグラムを送る
+	dbuf := ebuf.NewDatagramBuf(1)
+	dbuf.Write(nil)
+	if n := dbuf.Available(); n != 0 {
+		t.Errorf("expected 0 (got %d)", n)
+	}
+	if n, err := dbuf.Read(make([]byte, 1)); n != 0 || err != nil {
+		t.Errorf("expected 0, <nil> (got %d, %v)", n, err)
+	}
+
+	dbuf = ebuf.NewDatagramBuf(1, ebuf.WithAllowEmptyWrites(false))
+	if n, err := dbuf.Write(nil); n != 0 || err != nil {
+		t.Errorf("expected 0, <nil> (got %d, %v)", n, err)
+	}
+	if n := dbuf.Available(); n != 1 {
+		t.Errorf("expected 1 (got %d)", n)
+	}
+
+	// 閉じた後は空の Write も失敗する
+	dbuf.Close()
+	if n, err := dbuf.Write(nil); n != 0 || err != ebuf.ErrClosed {
+		t.Errorf("expected 0, %v (got %d, %v)", ebuf.ErrClosed, n, err)
+	}
+	sbuf = ebuf.NewStreamBuf(1)
+	sbuf.Close()
+	if n, err := sbuf.Write(nil); n != 0 || err != ebuf.ErrClosed {
+		t.Errorf("expected 0, %v (got %d, %v)", ebuf.ErrClosed, n, err)
+	}
+	sbuf = ebuf.NewStreamBuf(1)
+	sbuf.CloseRead()
+	if n, err := sbuf.Write(nil); n != 0 || err != io.ErrClosedPipe {
+		t.Errorf("expected 0, %v (got %d, %v)", io.ErrClosedPipe, n, err)
+	}
+}
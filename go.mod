@@ -1,3 +1,3 @@
 module github.com/negli0/ebuf
 
-go 1.14
+go 1.23
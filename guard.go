@@ -0,0 +1,17 @@
+//go:build !ebuf_debug
+
+package ebuf
+
+// guard is empty in release builds, so the chunks not copied by WithNoCopy
+// or WithCopyThreshold are not checked. See guard_debug.go.
+type guard struct{}
+
+func seal([]byte) guard { return guard{} }
+
+func (guard) check([]byte) {}
+
+// checkReleased does nothing in release builds. See guard_debug.go.
+func checkReleased(bool) {}
+
+// poison does nothing in release builds. See guard_debug.go.
+func poison([]byte) {}
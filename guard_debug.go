@@ -0,0 +1,42 @@
+//go:build ebuf_debug
+
+package ebuf
+
+import "hash/maphash"
+
+var guardSeed = maphash.MakeSeed()
+
+// guard is the checksum of the data of a chunk which is sent without being
+// copied, taken at the write. The reader verifies it to detect the writers
+// which modify the slice given to Write with WithNoCopy or WithCopyThreshold.
+type guard struct {
+	sealed bool
+	sum    uint64
+}
+
+// seal returns the guard of p.
+func seal(p []byte) guard {
+	return guard{sealed: true, sum: maphash.Bytes(guardSeed, p)}
+}
+
+// check panics if p has been modified since g was sealed.
+func (g guard) check(p []byte) {
+	if g.sealed && maphash.Bytes(guardSeed, p) != g.sum {
+		panic("ebuf: the data passed to Write was modified before it was read")
+	}
+}
+
+// checkReleased panics if the PooledBytes has been released.
+func checkReleased(released bool) {
+	if released {
+		panic("ebuf: PooledBytes is used after Release")
+	}
+}
+
+// poison overwrites the released slice p, so that the caller which
+// still uses it reads garbage instead of the expected datagram.
+func poison(p []byte) {
+	for i := range p {
+		p[i] = 0xdb
+	}
+}
@@ -0,0 +1,81 @@
+//go:build ebuf_debug
+
+package ebuf_test
+
+import (
+	"testing"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestWithNoCopyDetectsModification(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify bool
+	}{
+		{"unchanged", false},
+		{"modified", true},
+	}
+	for _, test := range tests {
+		for _, buf := range []interface {
+			Write([]byte) (int, error)
+			Read([]byte) (int, error)
+		}{
+			ebuf.NewDatagramBuf(1, ebuf.WithNoCopy()),
+			ebuf.NewStreamBuf(1, ebuf.WithNoCopy()),
+		} {
+			in := []byte("hello")
+			if _, err := buf.Write(in); err != nil {
+				t.Errorf("[error] [%s] [Write]: %v", test.name, err)
+			}
+			// 書き込み後に変更すると, 読み出し時に panic する
+			if test.modify {
+				in[0] = 'j'
+			}
+
+			func() {
+				defer func() {
+					if r := recover(); (r != nil) != test.modify {
+						t.Errorf("[%s] expected panic %t (got %v)", test.name, test.modify, r)
+					}
+				}()
+				buf.Read(make([]byte, len(in)))
+			}()
+		}
+	}
+}
+
+func TestPooledBytesUseAfterRelease(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(1)
+	dbuf.Write([]byte("hello"))
+	p, err := dbuf.ReadPooled()
+	if err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [ReadPooled]: %v", err)
+	}
+	d := p.Bytes()
+	p.Release()
+
+	// 解放後の内容は壊される
+	if string(d) == "hello" {
+		t.Errorf("expected the released slice to be poisoned")
+	}
+
+	// 解放済みのハンドルが次の ReadPooled で使い回されることはない
+	dbuf.Write([]byte("world"))
+	q, err := dbuf.ReadPooled()
+	if err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [ReadPooled]: %v", err)
+	}
+	if q == p {
+		t.Errorf("expected a new PooledBytes")
+	}
+	q.Release()
+
+	// 解放後の Bytes は panic する
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic")
+		}
+	}()
+	p.Bytes()
+}
@@ -0,0 +1,83 @@
+package ebuf
+
+import "io"
+
+// history holds the bytes of a stream from the offset base.
+// Once the history exceeds max bytes, the oldest bytes are discarded.
+// max is never exceeded if it is positive, and unlimited otherwise.
+type history struct {
+	buf  []byte
+	base int64
+	max  int
+}
+
+// append appends p to the history, discarding the oldest bytes
+// beyond the limit.
+func (h *history) append(p []byte) {
+	h.buf = append(h.buf, p...)
+	if h.max > 0 && len(h.buf) > h.max {
+		drop := len(h.buf) - h.max
+		h.buf = h.buf[drop:]
+		h.base += int64(drop)
+	}
+}
+
+// IndexedStreamBuf is StreamBuf which retains the history of the stream
+// for random access by ReadAt, which enables parsers that backtrack.
+// Read advances its own cursor as StreamBuf.Read, independently of ReadAt.
+// The history costs the memory of all the bytes written so far, unless
+// it is bounded by maxHistory.
+type IndexedStreamBuf struct {
+	StreamBuf
+}
+
+// NewIndexedStreamBuf generates a new IndexedStreamBuf which can buffer
+// `nrChunks` chunks like NewStreamBuf. If maxHistory is positive,
+// IndexedStreamBuf retains only the latest maxHistory bytes, and ReadAt
+// returns ErrDiscarded for the older ones. Otherwise IndexedStreamBuf
+// retains all the bytes. NewIndexedStreamBuf panics if nrChunks is negative.
+func NewIndexedStreamBuf(nrChunks, maxHistory int, opts ...Option) *IndexedStreamBuf {
+	var b IndexedStreamBuf
+	b.setup(nrChunks, opts)
+	b.hist = &history{max: maxHistory}
+	return &b
+}
+
+// ReadAt implements io.ReaderAt. The offset off counts the bytes from
+// the beginning of the stream. ReadAt reads the history including
+// the bytes not read by Read yet, and is never blocked: if fewer than
+// len(p) bytes have been written after off, ReadAt returns them with io.EOF.
+// ReadAt returns ErrDiscarded if off is negative or the bytes at off
+// have been discarded beyond maxHistory.
+func (b *IndexedStreamBuf) ReadAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// the buffered chunks are fetched into the history,
+	// unless a blocked Read is receiving them
+L:
+	for !b.parked {
+		select {
+		case c, ok := <-b.chbuf:
+			if !ok {
+				break L
+			}
+			b.take(c)
+		default:
+			break L
+		}
+	}
+
+	h := b.hist
+	if off < h.base {
+		return 0, ErrDiscarded
+	}
+	if off-h.base >= int64(len(h.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.buf[off-h.base:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,193 @@
+package ebuf_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestIndexedStreamBufReadAt(t *testing.T) {
+	tests := []struct {
+		maxHistory int
+		off        int64
+		size       int
+		expected   []byte
+		err        error
+	}{
+		// 履歴を制限しない
+		{0, 0, 3, []byte("abc"), nil},
+		{0, 4, 3, []byte("efg"), nil},
+		{0, 7, 3, []byte("hi"), io.EOF},
+		{0, 9, 1, []byte{}, io.EOF},
+		{0, 20, 1, []byte{}, io.EOF},
+		{0, -1, 1, []byte{}, ebuf.ErrDiscarded},
+		// 最新の 4 バイトだけ保持する
+		{4, 5, 2, []byte("fg"), nil},
+		{4, 4, 2, []byte{}, ebuf.ErrDiscarded},
+	}
+
+	for i, test := range tests {
+		ibuf := ebuf.NewIndexedStreamBuf(3, test.maxHistory)
+		for j, in := range []string{"abc", "defg", "hi"} {
+			if _, err := ibuf.Write([]byte(in)); err != nil {
+				t.Errorf("[error] [Indexed Stream Buffer] [Write %d-%d]: %v", i, j, err)
+			}
+		}
+
+		actual := make([]byte, test.size)
+		n, err := ibuf.ReadAt(actual, test.off)
+		if err != test.err {
+			t.Errorf("[ReadAt %d] expected %v (got %v)", i, test.err, err)
+		}
+		if !bytes.Equal(test.expected, actual[:n]) {
+			t.Errorf("[ReadAt %d] expected %s (got %s)", i, test.expected, actual[:n])
+		}
+	}
+}
+
+func TestIndexedStreamBufRead(t *testing.T) {
+	ibuf := ebuf.NewIndexedStreamBuf(2, 0)
+	if _, err := ibuf.Write([]byte("abcdef")); err != nil {
+		t.Fatalf("[error] [Indexed Stream Buffer] [Write]: %v", err)
+	}
+
+	// Read はストリームを進めるが, ReadAt は読んだ後のバイトも読める
+	actual := make([]byte, 4)
+	if _, err := io.ReadFull(ibuf, actual); err != nil {
+		t.Errorf("[error] [Indexed Stream Buffer] [Read]: %v", err)
+	}
+	if !bytes.Equal([]byte("abcd"), actual) {
+		t.Errorf("expected abcd (got %s)", actual)
+	}
+	if _, err := ibuf.ReadAt(actual[:2], 1); err != nil {
+		t.Errorf("[error] [Indexed Stream Buffer] [ReadAt]: %v", err)
+	}
+	if !bytes.Equal([]byte("bc"), actual[:2]) {
+		t.Errorf("expected bc (got %s)", actual[:2])
+	}
+
+	// ReadAt は Read のカーソルを動かさない
+	n, err := ibuf.Read(actual)
+	if err != nil {
+		t.Errorf("[error] [Indexed Stream Buffer] [Read]: %v", err)
+	}
+	if !bytes.Equal([]byte("ef"), actual[:n]) {
+		t.Errorf("expected ef (got %s)", actual[:n])
+	}
+}
+
+func TestIndexedStreamBufReadAtWhileReadBlocked(t *testing.T) {
+	ibuf := ebuf.NewIndexedStreamBuf(2, 0)
+	ibuf.Write([]byte("abc"))
+	ibuf.Read(make([]byte, 3))
+
+	// Read がブロックしている間も ReadAt はブロックしない
+	read := make(chan string)
+	go func() {
+		p := make([]byte, 3)
+		n, _ := ibuf.Read(p)
+		read <- string(p[:n])
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	p := make([]byte, 3)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if n, err := ibuf.ReadAt(p, 0); n != 3 || err != nil || string(p) != "abc" {
+			t.Errorf("expected 3, <nil>, abc (got %d, %v, %s)", n, err, p)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ReadAt is blocked behind Read")
+	}
+
+	// ブロックしていた Read は次のデータを受け取る
+	ibuf.Write([]byte("def"))
+	if s := <-read; s != "def" {
+		t.Errorf("expected def (got %s)", s)
+	}
+	if n, err := ibuf.ReadAt(p, 3); n != 3 || err != nil || string(p) != "def" {
+		t.Errorf("expected 3, <nil>, def (got %d, %v, %s)", n, err, p)
+	}
+}
+
+func TestIndexedStreamBufReadAtWhileCopyBlocked(t *testing.T) {
+	ibuf := ebuf.NewIndexedStreamBuf(2, 0)
+	ibuf.Write([]byte("abc"))
+
+	// dst が詰まって Copy がブロックしている間も ReadAt と Bytes はブロックしない
+	dst := ebuf.NewStreamBuf(0)
+	copied := make(chan error)
+	go func() {
+		_, err := ebuf.Copy(dst, &ibuf.StreamBuf)
+		copied <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	p := make([]byte, 3)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if n, err := ibuf.ReadAt(p, 0); n != 3 || err != nil || string(p) != "abc" {
+			t.Errorf("expected 3, <nil>, abc (got %d, %v, %s)", n, err, p)
+		}
+		ibuf.Bytes()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ReadAt is blocked behind Copy")
+	}
+
+	// 読み出せば Copy は進み, 閉じれば返る
+	ibuf.Write([]byte("def"))
+	ibuf.Close()
+	for _, want := range []string{"abc", "def"} {
+		if c, err := dst.ReadChunk(); err != nil || string(c) != want {
+			t.Errorf("expected %s, <nil> (got %s, %v)", want, c, err)
+		}
+	}
+	if err := <-copied; err != nil {
+		t.Errorf("[error] [Stream Buffer] [Copy]: %v", err)
+	}
+}
+
+func TestIndexedStreamBufReadAtWhileCloseHandoffBlocked(t *testing.T) {
+	ibuf := ebuf.NewIndexedStreamBuf(2, 0)
+	ibuf.Write([]byte("abc"))
+
+	// dst が詰まって CloseHandoff がブロックしている間も ReadAt はブロックしない
+	dst := ebuf.NewStreamBuf(0)
+	handed := make(chan error)
+	go func() {
+		handed <- ibuf.CloseHandoff(dst)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	p := make([]byte, 3)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if n, err := ibuf.ReadAt(p, 0); n != 3 || err != nil || string(p) != "abc" {
+			t.Errorf("expected 3, <nil>, abc (got %d, %v, %s)", n, err, p)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ReadAt is blocked behind CloseHandoff")
+	}
+
+	if c, err := dst.ReadChunk(); err != nil || string(c) != "abc" {
+		t.Errorf("expected abc, <nil> (got %s, %v)", c, err)
+	}
+	if err := <-handed; err != nil {
+		t.Errorf("[error] [Stream Buffer] [CloseHandoff]: %v", err)
+	}
+}
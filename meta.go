@@ -0,0 +1,88 @@
+package ebuf
+
+import "time"
+
+// Envelope is a datagram with its metadata, such as the source address.
+type Envelope struct {
+	Data []byte
+	Meta any
+	Time time.Time
+}
+
+// MetaDatagramBuf is channel-based datagram buffer like DatagramBuf,
+// but each datagram carries its metadata in an Envelope.
+type MetaDatagramBuf struct {
+	core
+}
+
+// NewMetaDatagramBuf generates a new MetaDatagramBuf which can buffer
+// `nrDgrams` envelopes. Options work in the same way as NewDatagramBuf,
+// except WithLatencyTracking, which has no effect.
+// NewMetaDatagramBuf panics if nrDgrams is negative.
+func NewMetaDatagramBuf(nrDgrams int, opts ...Option) *MetaDatagramBuf {
+	var mbuf MetaDatagramBuf
+	mbuf.init(nrDgrams, opts)
+	// only DatagramBuf reports the latency, verifies the checksum,
+	// and expires the datagrams by WithMaxAge
+	mbuf.cfg.latency = false
+	mbuf.cfg.checksum = false
+	mbuf.cfg.maxAge = 0
+	mbuf.watch()
+	return &mbuf
+}
+
+// WriteEnvelope writes e to MetaDatagramBuf. WriteEnvelope copies e.Data,
+// but not e.Meta, which is passed to the reader as it is.
+// WriteEnvelope will be blocked when the inner channel is full, and
+// returns the same errors as DatagramBuf.Write.
+func (b *MetaDatagramBuf) WriteEnvelope(e Envelope) error {
+	cp := make([]byte, len(e.Data))
+	copy(cp, e.Data)
+	_, err := b.writeOwned(chunk{data: cp, meta: &Envelope{Meta: e.Meta, Time: e.Time}}, nil)
+	return err
+}
+
+// ReadEnvelope reads one envelope. ReadEnvelope will be blocked when
+// the inner channel is empty. After Close, ReadEnvelope returns
+// the remaining envelopes, and then ErrWriterClosed. Otherwise ReadEnvelope
+// returns the same errors as DatagramBuf.Read.
+func (b *MetaDatagramBuf) ReadEnvelope() (Envelope, error) {
+	if b.cfg.observer == nil {
+		e, _, err := b.recv()
+		return e, err
+	}
+
+	start := time.Now()
+	e, blocked, err := b.recv()
+	b.cfg.observer.ObserveRead(len(e.Data), blocked, time.Since(start))
+	return e, err
+}
+
+// recv is the body of ReadEnvelope.
+func (b *MetaDatagramBuf) recv() (e Envelope, blocked bool, err error) {
+	c, blocked, err := b.recvChunk(nil)
+	if err != nil {
+		return Envelope{}, blocked, writerClosed(b.canceled(err))
+	}
+	e = *c.meta
+	e.Data = c.data
+	return e, blocked, nil
+}
+
+// Close implements io.Closer. Close is the same as CloseWrite,
+// so the remaining envelopes are still readable after Close.
+func (b *MetaDatagramBuf) Close() error {
+	return b.close()
+}
+
+// CloseWrite shuts down the writing side of MetaDatagramBuf
+// in the same way as DatagramBuf.CloseWrite.
+func (b *MetaDatagramBuf) CloseWrite() error {
+	return b.close()
+}
+
+// CloseRead shuts down the reading side of MetaDatagramBuf
+// in the same way as DatagramBuf.CloseRead.
+func (b *MetaDatagramBuf) CloseRead() error {
+	return b.closeRead()
+}
@@ -0,0 +1,52 @@
+package ebuf_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestMetaDatagramBuf(t *testing.T) {
+	now := time.Now()
+	tests := []ebuf.Envelope{
+		{Data: []byte("hello"), Meta: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, Time: now},
+		{Data: []byte("ebuf"), Meta: "source", Time: now.Add(time.Second)},
+		{Data: nil, Meta: 42},
+	}
+
+	mbuf := ebuf.NewMetaDatagramBuf(len(tests))
+	for i, test := range tests {
+		if err := mbuf.WriteEnvelope(test); err != nil {
+			t.Errorf("[error] [Meta Datagram Buffer] [WriteEnvelope %d]: %v", i, err)
+		}
+	}
+	// 書き込み後に Data を変更しても影響しない
+	tests[0].Data[0] = 'j'
+	mbuf.Close()
+
+	expected := []string{"hello", "ebuf", ""}
+	for i, test := range tests {
+		e, err := mbuf.ReadEnvelope()
+		if err != nil {
+			t.Errorf("[error] [Meta Datagram Buffer] [ReadEnvelope %d]: %v", i, err)
+		}
+		if !bytes.Equal([]byte(expected[i]), e.Data) {
+			t.Errorf("[ReadEnvelope %d] expected %s (got %s)", i, expected[i], e.Data)
+		}
+		if e.Meta != test.Meta {
+			t.Errorf("[ReadEnvelope %d] expected %v (got %v)", i, test.Meta, e.Meta)
+		}
+		if !e.Time.Equal(test.Time) {
+			t.Errorf("[ReadEnvelope %d] expected %v (got %v)", i, test.Time, e.Time)
+		}
+	}
+
+	if _, err := mbuf.ReadEnvelope(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected %v (got %v)", io.EOF, err)
+	}
+}
@@ -0,0 +1,57 @@
+package ebuf
+
+import "io"
+
+// datagramReader is the io.Reader returned by DatagramBuf.OpenDatagram.
+type datagramReader struct {
+	b    *DatagramBuf
+	c    chunk
+	off  int
+	done chan struct{} // closed when the datagram is exhausted
+}
+
+// OpenDatagram reads one datagram like Read, but returns an io.Reader over
+// it instead of copying it to p, so that the caller can read a large
+// datagram piecemeal with a small buffer, without truncating it.
+// The returned reader reads the datagram like a bytes.Reader, and then
+// returns io.EOF. The following reads of DatagramBuf, including
+// OpenDatagram, wait until the returned reader is exhausted, that is,
+// the last byte of the datagram is read from it. OpenDatagram is blocked
+// until a datagram arrives, and returns the same errors as Read.
+func (b *DatagramBuf) OpenDatagram() (io.Reader, error) {
+	c, _, err := b.nextChunk(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &datagramReader{b: b, c: c, done: make(chan struct{})}
+	for !b.opened.CompareAndSwap(nil, &r.done) {
+		// another OpenDatagram has taken a datagram at the same time
+		if p := b.opened.Load(); p != nil {
+			<-*p
+		}
+	}
+	if len(c.data) == 0 {
+		r.finish()
+	}
+	return r, nil
+}
+
+// Read implements io.Reader.
+func (r *datagramReader) Read(p []byte) (int, error) {
+	if r.off >= len(r.c.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.c.data[r.off:])
+	if r.off += n; r.off == len(r.c.data) {
+		r.finish()
+	}
+	return n, nil
+}
+
+// finish lets the following reads of DatagramBuf go.
+func (r *datagramReader) finish() {
+	r.b.release(r.c)
+	r.b.opened.Store(nil)
+	close(r.done)
+}
@@ -0,0 +1,56 @@
+package ebuf_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestDatagramBufOpenDatagram(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(2)
+	dbuf.Write([]byte("0123456789"))
+	dbuf.Write([]byte("next"))
+
+	r, err := dbuf.OpenDatagram()
+	if err != nil {
+		t.Fatalf("[error] [Datagram Buffer] [OpenDatagram]: %v", err)
+	}
+
+	// 読み切るまで, 次の Read は待たされる
+	next := make(chan string)
+	go func() {
+		p := make([]byte, 4)
+		n, _ := dbuf.Read(p)
+		next <- string(p[:n])
+	}()
+
+	// 3 バイトずつ読んでも, 切り捨てられずに全て読める
+	var actual []byte
+	p := make([]byte, 3)
+	for i := 0; i < 3; i++ {
+		n, err := r.Read(p)
+		if err != nil {
+			t.Errorf("[error] [Datagram Reader] [Read %d]: %v", i, err)
+		}
+		actual = append(actual, p[:n]...)
+	}
+	select {
+	case d := <-next:
+		t.Errorf("expected Read to wait (got %s)", d)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	n, err := r.Read(p)
+	actual = append(actual, p[:n]...)
+	if string(actual) != "0123456789" || err != nil {
+		t.Errorf("expected 0123456789, <nil> (got %s, %v)", actual, err)
+	}
+	if n, err := r.Read(p); n != 0 || err != io.EOF {
+		t.Errorf("expected (0, %v) (got (%d, %v))", io.EOF, n, err)
+	}
+	if d := <-next; d != "next" {
+		t.Errorf("expected next (got %s)", d)
+	}
+}
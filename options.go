@@ -0,0 +1,425 @@
+package ebuf
+
+import (
+	"context"
+	"time"
+)
+
+// Option configures a DatagramBuf or a StreamBuf at construction.
+type Option func(*config)
+
+// config holds the settings given by Options.
+type config struct {
+	onBlock  func(queued, cap int)
+	fairness int
+	observer Observer
+	overflow OverflowPolicy
+	latency  bool
+
+	writeTimeout time.Duration
+	readTimeout  time.Duration
+	ctx          context.Context
+
+	elide         bool // enabled by WithCopyThreshold
+	copyThreshold int
+
+	minRead int
+
+	autoCompact bool
+
+	maxWrite int // set by WithMaxWriteSize
+
+	idleAfter time.Duration // set by WithIdleShrink
+	idleTo    int
+
+	maxAge time.Duration // set by WithMaxAge
+
+	rate int // set by WithWriteRateLimit
+
+	checksum bool
+
+	spin int // set by WithSpin
+
+	readDelay time.Duration // set by WithReadDelay
+
+	traceName string // set by WithTraceRegion
+
+	maxToken int // set by WithMaxTokenSize
+
+	intercept func(p []byte) error // set by WithWriteInterceptor
+
+	requireReader bool
+
+	// allowEmpty is set by WithAllowEmptyWrites, and emptySet reports
+	// whether it is given, since its default differs by the buffer
+	allowEmpty bool
+	emptySet   bool
+
+	alloc func(n int) []byte // set by WithAllocator
+	free  func([]byte)
+}
+
+// elides reports whether a write of n bytes is sent without copying.
+func (cfg *config) elides(n int) bool {
+	return cfg.elide && n > cfg.copyThreshold
+}
+
+func newConfig(opts []Option) config {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if !cfg.emptySet {
+		cfg.allowEmpty = true
+	}
+	return cfg
+}
+
+// WithOnBlock sets fn, which is called when a Write is about to be blocked
+// because the inner channel is full. queued and cap are the number of
+// buffered elements and the capacity of the inner channel at that moment.
+// fn is called on the writer's goroutine before it blocks, without holding
+// any lock of the buffer.
+func WithOnBlock(fn func(queued, cap int)) Option {
+	return func(cfg *config) {
+		cfg.onBlock = fn
+	}
+}
+
+// WithFairness lets a PriorityDatagramBuf pass one low-priority datagram
+// through after every ratio consecutive high-priority datagrams, so that
+// the low-priority queue is not starved. A ratio of zero or less, which
+// is the default, always prefers the high-priority queue.
+// WithFairness has no effect on the other buffers.
+func WithFairness(ratio int) Option {
+	return func(cfg *config) {
+		cfg.fairness = ratio
+	}
+}
+
+// Observer receives the measurements of each Read and Write.
+// bytes is the number of bytes transferred, blocked reports whether
+// the operation had to wait for the inner channel, and d is the duration
+// of the operation. The methods are called synchronously on the goroutine
+// of the operation, so they should return quickly.
+type Observer interface {
+	ObserveWrite(bytes int, blocked bool, d time.Duration)
+	ObserveRead(bytes int, blocked bool, d time.Duration)
+}
+
+// WithObserver sets obs, which observes every Read and Write of the buffer.
+// It lets the caller connect the buffer to metrics or tracing systems.
+func WithObserver(obs Observer) Option {
+	return func(cfg *config) {
+		cfg.observer = obs
+	}
+}
+
+// OverflowPolicy decides what a Write does when the inner channel is full.
+type OverflowPolicy int
+
+const (
+	// BlockOnFull blocks the Write until the inner channel has room.
+	// This is the default.
+	BlockOnFull OverflowPolicy = iota
+	// DropNewest discards the datagram being written, and
+	// the Write returns immediately as if it succeeded.
+	DropNewest
+	// DropOldest discards the oldest buffered datagram to make room
+	// for the datagram being written.
+	DropOldest
+)
+
+// WithOverflowPolicy sets the overflow policy of a DatagramBuf.
+// The number of discarded datagrams is reported by DatagramBuf.Dropped.
+// WithOverflowPolicy has no effect on the other buffers, because dropping
+// chunks would corrupt a byte-stream.
+func WithOverflowPolicy(p OverflowPolicy) Option {
+	return func(cfg *config) {
+		cfg.overflow = p
+	}
+}
+
+// WithLatencyTracking makes a DatagramBuf record the time each datagram
+// spends in the buffer, which is reported by DatagramBuf.LatencyStats.
+// WithLatencyTracking has no effect on the other buffers.
+func WithLatencyTracking() Option {
+	return func(cfg *config) {
+		cfg.latency = true
+	}
+}
+
+// WithWriteTimeout sets the default timeout of writes as a backstop
+// against a reader which has gone away: a write blocked longer than d
+// returns a *TimeoutError instead of hanging forever. d bounds the whole
+// write, including the waits for WithWriteRateLimit and for the budget of
+// NewStreamBufBudgeted. WriteTimeout uses its own duration instead.
+// A non-positive d means no timeout.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.writeTimeout = d
+	}
+}
+
+// WithReadTimeout sets the default timeout of Read of DatagramBuf, and of
+// every blocking read of StreamBuf, such as Read, ReadChunk, ReadString,
+// ReadVectored and ReadSlice, as a liveness guard, like WithWriteTimeout
+// on the read side: a read blocked longer than d returns a *TimeoutError
+// instead of hanging forever. ReadTimeout uses its own duration instead.
+// Copy, which waits for src to be closed, and the other reads of
+// DatagramBuf, such as All and ReadInto, are not bounded.
+// A non-positive d means no timeout.
+func WithReadTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.readTimeout = d
+	}
+}
+
+// WithCancel ties a DatagramBuf or a StreamBuf to ctx. When ctx is done,
+// the buffer is closed for both writing and reading, discarding the buffered
+// data: the blocked and the following reads and writes return ctx.Err().
+// WithCancel has no effect on PriorityDatagramBuf.
+func WithCancel(ctx context.Context) Option {
+	return func(cfg *config) {
+		cfg.ctx = ctx
+	}
+}
+
+// WithCopyThreshold makes writes larger than n bytes hand off the ownership
+// of the data, instead of copying it as usual: such a Write sends the slice
+// given by the caller as it is, so the caller must not modify its contents
+// afterwards, even after Write returns, since the reader receives the same
+// backing array. Writes of n bytes or less are copied as usual, so small
+// buffers can still be reused. WithCopyThreshold applies to Write,
+// WriteTimeout, and the writes of PriorityDatagramBuf.
+func WithCopyThreshold(n int) Option {
+	return func(cfg *config) {
+		cfg.elide = true
+		cfg.copyThreshold = n
+	}
+}
+
+// WithNoCopy makes all writes hand off the ownership of the data, like
+// WithCopyThreshold(-1): Write enqueues the slice given by the caller as it
+// is, so the caller must pass a freshly allocated slice to each Write, and
+// must not modify it afterwards. Building with `-tags ebuf_debug` enables
+// a safety net for such misuse: each write records a checksum of the slice,
+// and the read of it panics if the contents have been changed since then.
+func WithNoCopy() Option {
+	return WithCopyThreshold(-1)
+}
+
+// WithMinRead makes StreamBuf.Read return at least n bytes, or len(p) bytes
+// if p is shorter: Read is blocked until enough bytes arrive, instead of
+// returning the bytes buffered at the moment, like io.ReadAtLeast. After
+// Close, Read returns the remaining bytes even if they are fewer than n.
+// Since StreamBuf keeps fetching chunks into its own memory while Read waits,
+// n is not limited by the capacity of StreamBuf. On a timeout of
+// ReadTimeout or WithReadTimeout, or on a cancel of ReadOrCancel, Read returns
+// the bytes fetched so far together with the error. WithMinRead has no effect
+// on the other buffers and on NewStreamBufFramed. WithMinRead panics
+// if n is negative.
+func WithMinRead(n int) Option {
+	if n < 0 {
+		panic("ebuf: negative minimum read size")
+	}
+	return func(cfg *config) {
+		cfg.minRead = n
+	}
+}
+
+// WithAutoCompact makes StreamBuf call Compact after a read leaves its
+// backing array of at least 64 KiB less than a quarter used, so that
+// a long-lived StreamBuf does not keep the memory of a past burst.
+// Smaller backing arrays are reused as usual. WithAutoCompact has no
+// effect on the other buffers.
+func WithAutoCompact() Option {
+	return func(cfg *config) {
+		cfg.autoCompact = true
+	}
+}
+
+// WithAllocator makes the buffers allocate the copies of the written data
+// by alloc instead of make, and give them back to free once they are no
+// longer referenced, for experiments with arenas or off-heap memory.
+// alloc must return a slice of length n. The lifecycle of a slice
+// returned by alloc is the following:
+//
+//   - Write copies the data into it, and sends it to the inner channel.
+//     If the data is not buffered, because Write fails or drops it by
+//     WithOverflowPolicy, it is given to free before Write returns.
+//   - StreamBuf hands it to free as soon as a read moves it from the inner
+//     channel to its own memory, and DatagramBuf and PriorityDatagramBuf
+//     hand it to free after a Read or ReadInto copies the datagram to p,
+//     or the datagram is discarded by DropOldest or its TTL.
+//   - The reads which hand the datagrams to the caller, such as All,
+//     Datagrams, C, and AsStream, copy them to the memory owned by
+//     the caller, and hand the slices to free.
+//   - The data left in a buffer which is never drained are never given
+//     to free.
+//
+// So free is called at most once for each slice returned by alloc, and
+// exactly once if the buffer is drained. free may be nil, then
+// the slices are left to the garbage collector. WithAllocator has no
+// effect on the writes whose copy is elided by WithCopyThreshold or
+// WithNoCopy, and on MetaDatagramBuf.
+func WithAllocator(alloc func(n int) []byte, free func([]byte)) Option {
+	return func(cfg *config) {
+		cfg.alloc = alloc
+		cfg.free = free
+	}
+}
+
+// WithMaxWriteSize makes the writes of more than n bytes fail with
+// ErrTooLarge, without buffering anything, so that a misbehaving writer
+// cannot make the buffer hold huge chunks. A non-positive n, which is
+// the default, means no limit.
+func WithMaxWriteSize(n int) Option {
+	return func(cfg *config) {
+		cfg.maxWrite = n
+	}
+}
+
+// WithIdleShrink makes DatagramBuf release the memory of its inner channel
+// while it is idle: once fewer than to datagrams have been buffered for
+// a whole period of after, the inner channel is replaced with a smaller one
+// of capacity to, in the same way as DatagramBuf.Grow. A write which finds
+// the smaller channel full regrows it to the original capacity, instead of
+// blocking or dropping the datagram. WithIdleShrink starts a goroutine,
+// which exits when DatagramBuf is closed. WithIdleShrink has no effect
+// on the other buffers, and if after is not positive.
+func WithIdleShrink(after time.Duration, to int) Option {
+	return func(cfg *config) {
+		cfg.idleAfter = after
+		cfg.idleTo = to
+	}
+}
+
+// WithMaxAge makes DatagramBuf discard the datagrams which have been
+// buffered longer than d, and count them in DatagramBuf.Expired, like
+// the datagrams expired by DatagramBuf.WriteTTL. Reads never return such
+// a datagram, and a goroutine also sweeps them out of the inner channel
+// every period of d, even if no read occurs, in the same way as
+// DatagramBuf.Grow. The goroutine exits when DatagramBuf is closed.
+// WithMaxAge has no effect on the other buffers, and if d is not positive.
+func WithMaxAge(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxAge = d
+	}
+}
+
+// WithWriteRateLimit makes writes keep the throughput of the buffer under
+// bytesPerSec bytes per second by a token bucket, which starts empty and
+// holds at most the tokens of one second: a write is blocked until the
+// bucket has the tokens of its length, before it is sent to the inner channel.
+// The wait ends early with the same errors as a write blocked by a full
+// buffer, such as by Close, the context given by WithCancel, WriteTimeout,
+// or WithWriteTimeout, and TryWrite returns ErrWouldBlock instead of waiting.
+// A non-positive bytesPerSec means no limit.
+func WithWriteRateLimit(bytesPerSec int) Option {
+	return func(cfg *config) {
+		cfg.rate = bytesPerSec
+	}
+}
+
+// WithChecksum makes DatagramBuf record the CRC-32 of each datagram at
+// the write, beside the datagram rather than in it, and verify it at the read,
+// which returns ErrChecksumMismatch instead of a modified datagram and
+// discards it. It is a debugging aid which validates the ownership
+// contracts, such as of WithNoCopy, at the cost of hashing every datagram.
+// WithChecksum has no effect on the other buffers.
+func WithChecksum() Option {
+	return func(cfg *config) {
+		cfg.checksum = true
+	}
+}
+
+// WithSpin makes a StreamBuf.Read which finds StreamBuf empty poll
+// the inner channel up to iterations times before it blocks, which saves
+// the latency of parking and waking up the reader when data arrives soon,
+// such as in single-producer single-consumer pipelines of high frequency.
+// Spinning wastes CPU while StreamBuf stays empty, so it should be used only
+// when the reader has a dedicated core. Zero, which is the default,
+// disables spinning. WithSpin has no effect on the other buffers.
+func WithSpin(iterations int) Option {
+	return func(cfg *config) {
+		cfg.spin = iterations
+	}
+}
+
+// WithAllowEmptyWrites sets whether a Write of an empty slice sends
+// an empty chunk to the inner channel. If allow is false, such a Write
+// is a no-op which returns (0, nil) without taking the room of the inner
+// channel, though it still fails after Close or CloseRead like the others.
+// An empty datagram may be meaningful, such as a keepalive, so DatagramBuf
+// and the other datagram buffers allow empty writes by default, while
+// StreamBuf does not, where an empty chunk carries no data but wastes
+// the room. With WithAllowEmptyWrites(true), StreamBuf.ReadChunk returns
+// the empty chunks, while Read skips them.
+func WithAllowEmptyWrites(allow bool) Option {
+	return func(cfg *config) {
+		cfg.allowEmpty = allow
+		cfg.emptySet = true
+	}
+}
+
+// WithTraceRegion makes the reads and writes blocked on the inner channel
+// emit regions of runtime/trace, whose types are name followed by ".Read"
+// or ".Write", such as "conn.Read", so that the contention of the buffer
+// is visible in execution traces, such as by `go tool trace`. The regions
+// cost little while no trace is running. An empty name, which is
+// the default, emits no regions.
+func WithTraceRegion(name string) Option {
+	return func(cfg *config) {
+		cfg.traceName = name
+	}
+}
+
+// WithReadDelay makes each successful Read of DatagramBuf and StreamBuf
+// sleep for d before it returns, which simulates a slow reader
+// deterministically. It is intended for testing: the tests of writers can
+// exercise their handling of backpressure, since the buffer fills up and
+// the writes block, time out, or drop datagrams by the overflow policy.
+// The reads which fail are not delayed. Zero, which is the default,
+// disables the delay.
+func WithReadDelay(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.readDelay = d
+	}
+}
+
+// WithMaxTokenSize limits the data accumulated by StreamBuf.ReadString and
+// StreamBuf.ReadUntilBytes while they look for the delimiter, so that an
+// unterminated input cannot exhaust the memory: once more than n bytes are
+// accumulated without the delimiter, the read discards them and returns
+// ErrTokenTooLong, and the next read continues with the following data.
+// A non-positive n, which is the default, means no limit.
+// WithMaxTokenSize has no effect on the other buffers.
+func WithMaxTokenSize(n int) Option {
+	return func(cfg *config) {
+		cfg.maxToken = n
+	}
+}
+
+// WithWriteInterceptor sets fn, which inspects each chunk written to
+// the buffer, for validation, accounting, or filtering: if fn returns
+// an error, the write is rejected with the error, and nothing is buffered.
+// fn is called synchronously on the writer's goroutine before the chunk is
+// sent to the inner channel, with the data to be buffered, which is usually
+// a copy of the data given to the write. fn must not modify nor retain p.
+func WithWriteInterceptor(fn func(p []byte) error) Option {
+	return func(cfg *config) {
+		cfg.intercept = fn
+	}
+}
+
+// WithRequireReader makes a write which would block because the buffer is
+// full return ErrNoReader instead, if no one has ever read the buffer,
+// which catches the common bug of forgetting to start the consumer.
+// A read counts once it is called, even if it is still blocked, so
+// the consumer must start reading before the buffer fills up.
+func WithRequireReader() Option {
+	return func(cfg *config) {
+		cfg.requireReader = true
+	}
+}
@@ -0,0 +1,121 @@
+package ebuf
+
+import (
+	"io"
+	"sync"
+)
+
+// pipe is the state shared by PipeReader and PipeWriter.
+type pipe struct {
+	buf *StreamBuf
+
+	mu   sync.Mutex // guards rerr and werr
+	rerr error      // given by PipeReader.CloseWithError
+	werr error      // given by PipeWriter.CloseWithError
+}
+
+// NewPipe generates a pipe like io.Pipe, but the pipe can buffer `nrChunks`
+// chunks in a StreamBuf, so Write is blocked only while the buffer is full.
+// If nrChunks is zero, the pipe buffers nothing like io.Pipe.
+// Unlike io.Pipe, the data written before PipeWriter.Close is not lost:
+// PipeReader reads the remaining data, and then the error of the close.
+// NewPipe panics if nrChunks is negative.
+func NewPipe(nrChunks int) (*PipeReader, *PipeWriter) {
+	p := &pipe{buf: NewStreamBuf(nrChunks)}
+	return &PipeReader{p}, &PipeWriter{p}
+}
+
+// setErr stores err to *dst unless an error is already stored.
+func (p *pipe) setErr(dst *error, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if *dst == nil {
+		*dst = err
+	}
+}
+
+// getErr returns the error stored in *src, or def if nothing is stored.
+func (p *pipe) getErr(src *error, def error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if *src == nil {
+		return def
+	}
+	return *src
+}
+
+// PipeReader is the read half of a pipe generated by NewPipe.
+type PipeReader struct {
+	p *pipe
+}
+
+// Read implements io.Reader in the same way as io.PipeReader.Read.
+// After the writer is closed, Read returns the remaining data, and then
+// the error given to CloseWithError, or io.EOF.
+// Read returns io.ErrClosedPipe after the reader is closed.
+func (r *PipeReader) Read(data []byte) (int, error) {
+	n, err := r.p.buf.Read(data)
+	switch err {
+	case io.EOF:
+		err = r.p.getErr(&r.p.werr, io.EOF)
+	case ErrClosed:
+		err = io.ErrClosedPipe
+	}
+	return n, err
+}
+
+// Close closes the reader. The following writes return io.ErrClosedPipe.
+func (r *PipeReader) Close() error {
+	return r.CloseWithError(nil)
+}
+
+// CloseWithError closes the reader. The following writes return err,
+// or io.ErrClosedPipe if err is nil. Like io.PipeReader.CloseWithError,
+// CloseWithError never overwrites the previous error, and always returns nil.
+func (r *PipeReader) CloseWithError(err error) error {
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	r.p.setErr(&r.p.rerr, err)
+	r.p.buf.CloseRead()
+	return nil
+}
+
+// PipeWriter is the write half of a pipe generated by NewPipe.
+type PipeWriter struct {
+	p *pipe
+}
+
+// Write implements io.Writer in the same way as io.PipeWriter.Write,
+// but Write returns as soon as data is buffered.
+// Write returns io.ErrClosedPipe after the writer is closed, and
+// the error given to PipeReader.CloseWithError after the reader is closed.
+func (w *PipeWriter) Write(data []byte) (int, error) {
+	n, err := w.p.buf.Write(data)
+	switch err {
+	case ErrClosed:
+		err = io.ErrClosedPipe
+	case io.ErrClosedPipe:
+		err = w.p.getErr(&w.p.rerr, io.ErrClosedPipe)
+	}
+	return n, err
+}
+
+// Close closes the writer. The reader reads the remaining data, and then io.EOF.
+func (w *PipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError closes the writer. The reader reads the remaining data,
+// and then err, or io.EOF if err is nil. Like io.PipeWriter.CloseWithError,
+// CloseWithError never overwrites the previous error, and always returns nil.
+func (w *PipeWriter) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+	w.p.setErr(&w.p.werr, err)
+	w.p.buf.CloseWrite()
+	return nil
+}
@@ -0,0 +1,134 @@
+package ebuf_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestPipeClose(t *testing.T) {
+	r, w := ebuf.NewPipe(2)
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatalf("[error] [Pipe] [Write]: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("[error] [Pipe] [Close]: %v", err)
+	}
+
+	// Close の前に書き込んだデータを読んでから io.EOF を返す
+	actual, err := io.ReadAll(r)
+	if err != nil {
+		t.Errorf("[error] [Pipe] [Read]: %v", err)
+	}
+	if !bytes.Equal([]byte("hello"), actual) {
+		t.Errorf("expected hello (got %s)", actual)
+	}
+
+	// 閉じた後の書き込みは io.ErrClosedPipe を返す
+	if _, err := w.Write([]byte("a")); err != io.ErrClosedPipe {
+		t.Errorf("expected %v (got %v)", io.ErrClosedPipe, err)
+	}
+}
+
+func TestPipeCloseWithError(t *testing.T) {
+	errWriter := errors.New("writer error")
+	errReader := errors.New("reader error")
+
+	tests := []struct {
+		name     string
+		close    func(r *ebuf.PipeReader, w *ebuf.PipeWriter)
+		readErr  error
+		writeErr error
+	}{
+		{"PipeWriter.CloseWithError", func(r *ebuf.PipeReader, w *ebuf.PipeWriter) {
+			w.CloseWithError(errWriter)
+		}, errWriter, io.ErrClosedPipe},
+		{"PipeWriter.CloseWithError(nil)", func(r *ebuf.PipeReader, w *ebuf.PipeWriter) {
+			w.CloseWithError(nil)
+		}, io.EOF, io.ErrClosedPipe},
+		{"PipeReader.CloseWithError", func(r *ebuf.PipeReader, w *ebuf.PipeWriter) {
+			r.CloseWithError(errReader)
+		}, io.ErrClosedPipe, errReader},
+		{"PipeReader.Close", func(r *ebuf.PipeReader, w *ebuf.PipeWriter) {
+			r.Close()
+		}, io.ErrClosedPipe, io.ErrClosedPipe},
+		// 先に与えたエラーは上書きされない
+		{"PipeWriter.CloseWithError twice", func(r *ebuf.PipeReader, w *ebuf.PipeWriter) {
+			w.CloseWithError(errWriter)
+			w.CloseWithError(errReader)
+		}, errWriter, io.ErrClosedPipe},
+	}
+
+	for _, test := range tests {
+		r, w := ebuf.NewPipe(1)
+		test.close(r, w)
+		if _, err := r.Read(make([]byte, 1)); err != test.readErr {
+			t.Errorf("[%s] [Read] expected %v (got %v)", test.name, test.readErr, err)
+		}
+		if _, err := w.Write([]byte("a")); err != test.writeErr {
+			t.Errorf("[%s] [Write] expected %v (got %v)", test.name, test.writeErr, err)
+		}
+	}
+}
+
+func TestPipeCloseWhileBlocked(t *testing.T) {
+	errReader := errors.New("reader error")
+
+	// 読み手が閉じると, ブロック中の書き込みはエラーを返す
+	r, w := ebuf.NewPipe(0)
+	done := make(chan error)
+	go func() {
+		_, err := w.Write([]byte("a"))
+		done <- err
+	}()
+	r.CloseWithError(errReader)
+	if err := <-done; err != errReader {
+		t.Errorf("[Write] expected %v (got %v)", errReader, err)
+	}
+
+	// 書き手が閉じると, ブロック中の読み出しは io.EOF を返す
+	r, w = ebuf.NewPipe(0)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		done <- err
+	}()
+	w.Close()
+	if err := <-done; err != io.EOF {
+		t.Errorf("[Read] expected %v (got %v)", io.EOF, err)
+	}
+}
+
+func TestPipeConcurrent(t *testing.T) {
+	const nrWriters = 8
+	const input = "0123456789"
+
+	r, w := ebuf.NewPipe(4)
+	var wg sync.WaitGroup
+	for i := 0; i < nrWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := w.Write([]byte(input)); err != nil {
+				t.Errorf("[error] [Pipe] [Write %d]: %v", i, err)
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		w.Close()
+	}()
+
+	// 各書き込みは混ざらずに読み出される
+	actual, err := io.ReadAll(r)
+	if err != nil {
+		t.Errorf("[error] [Pipe] [Read]: %v", err)
+	}
+	expected := bytes.Repeat([]byte(input), nrWriters)
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("expected %s (got %s)", expected, actual)
+	}
+}
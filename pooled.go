@@ -0,0 +1,60 @@
+package ebuf
+
+import "sync"
+
+// pooledPool holds the backing arrays of the released PooledBytes,
+// which are reused by the following ReadPooled. The handles themselves
+// are never reused, so that a stale handle cannot alias a later datagram.
+var pooledPool = sync.Pool{
+	New: func() any { return new([]byte) },
+}
+
+// PooledBytes is a datagram read by DatagramBuf.ReadPooled into a slice
+// taken from an internal pool. Release gives the slice back to the pool,
+// so that a consumer which releases each datagram after using it reads
+// without allocating a slice for each datagram. The caller must not use
+// PooledBytes nor the slice returned by Bytes after Release. Building with
+// `-tags ebuf_debug` makes Bytes panic after Release, and overwrites
+// the released slice with garbage, so that such misuse shows up.
+type PooledBytes struct {
+	data     []byte
+	buf      *[]byte // the pooled backing array of data
+	released bool
+}
+
+// Bytes returns the datagram. The returned slice is valid until Release.
+func (p *PooledBytes) Bytes() []byte {
+	checkReleased(p.released)
+	return p.data
+}
+
+// Release gives the datagram back to the pool. The calls after
+// the first one do nothing.
+func (p *PooledBytes) Release() {
+	if p.released {
+		return
+	}
+	p.released = true
+	poison(p.data)
+	*p.buf = p.data[:0]
+	pooledPool.Put(p.buf)
+	p.data, p.buf = nil, nil
+}
+
+// ReadPooled is like Read, but returns the datagram as a whole in
+// PooledBytes, whose slice is reused from the datagrams released before.
+// The caller should call Release of the returned PooledBytes after using it.
+// ReadPooled returns the same errors as Read.
+func (b *DatagramBuf) ReadPooled() (*PooledBytes, error) {
+	c, _, err := b.nextChunk(nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := pooledPool.Get().(*[]byte)
+	if cap(*buf) < len(c.data) {
+		*buf = make([]byte, len(c.data))
+	}
+	p := &PooledBytes{data: (*buf)[:copy((*buf)[:len(c.data)], c.data)], buf: buf}
+	b.release(c)
+	return p, nil
+}
@@ -0,0 +1,42 @@
+package ebuf_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestDatagramBufReadPooled(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(1)
+
+	// sync.Pool は要素を捨てることがあるので, 何度か試して再利用を確認する
+	reused := false
+	var prev *byte
+	for i := 0; i < 10 && !reused; i++ {
+		if _, err := dbuf.Write([]byte("hello")); err != nil {
+			t.Fatalf("[error] [Datagram Buffer] [Write %d]: %v", i, err)
+		}
+		p, err := dbuf.ReadPooled()
+		if err != nil {
+			t.Fatalf("[error] [Datagram Buffer] [ReadPooled %d]: %v", i, err)
+		}
+		if string(p.Bytes()) != "hello" {
+			t.Errorf("expected hello (got %s)", p.Bytes())
+		}
+		first := &p.Bytes()[0]
+		reused = first == prev
+		prev = first
+		p.Release()
+		// 二度目の Release は何もしない
+		p.Release()
+	}
+	if !reused {
+		t.Errorf("expected the slice to be reused")
+	}
+
+	dbuf.Close()
+	if _, err := dbuf.ReadPooled(); err != io.EOF {
+		t.Errorf("expected %v (got %v)", io.EOF, err)
+	}
+}
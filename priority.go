@@ -0,0 +1,129 @@
+package ebuf
+
+import (
+	"sync"
+	"time"
+)
+
+// PriorityDatagramBuf is channel-based datagram buffer
+// with a high-priority queue and a low-priority queue.
+type PriorityDatagramBuf struct {
+	hi, lo core
+
+	mu       sync.Mutex // guards nrHi
+	fairness int
+	nrHi     int // the number of consecutive high-priority reads
+}
+
+// NewPriorityDatagramBuf generates a new PriorityDatagramBuf whose queues
+// can buffer `nrDgrams` datagrams each. It panics if nrDgrams is negative.
+func NewPriorityDatagramBuf(nrDgrams int, opts ...Option) *PriorityDatagramBuf {
+	var pbuf PriorityDatagramBuf
+	cfg := newConfig(opts)
+	// each queue must block to keep the fairness meaningful
+	cfg.overflow = BlockOnFull
+	// only DatagramBuf reports the latency, verifies the checksum,
+	// and expires the datagrams by WithMaxAge
+	cfg.latency = false
+	cfg.checksum = false
+	cfg.maxAge = 0
+	pbuf.hi.init(nrDgrams, opts)
+	pbuf.hi.cfg = cfg
+	pbuf.lo.init(nrDgrams, opts)
+	pbuf.lo.cfg = cfg
+	pbuf.fairness = cfg.fairness
+	return &pbuf
+}
+
+// WriteHi writes p to the high-priority queue as one datagram.
+// WriteHi will be blocked when the high-priority queue is full.
+// WriteHi returns ErrBrokenBuffer if the buffer is broken. It also
+// returns ErrTooLarge with WithMaxWriteSize, ErrNoReader with
+// WithRequireReader, a *TimeoutError with WithWriteTimeout, and the error
+// of the interceptor given by WithWriteInterceptor.
+func (b *PriorityDatagramBuf) WriteHi(p []byte) (n int, err error) {
+	return b.hi.write(p, nil)
+}
+
+// WriteLo writes p to the low-priority queue as one datagram.
+// WriteLo will be blocked when the low-priority queue is full.
+// WriteLo returns the same errors as WriteHi.
+func (b *PriorityDatagramBuf) WriteLo(p []byte) (n int, err error) {
+	return b.lo.write(p, nil)
+}
+
+// Read reads one datagram and stores it to p in the same way
+// as DatagramBuf.Read. Read returns a high-priority datagram
+// if any, otherwise a low-priority one, unless WithFairness lets
+// a low-priority datagram through. Read will be blocked when
+// both queues are empty. Read returns ErrBrokenBuffer
+// if the buffer is broken.
+func (b *PriorityDatagramBuf) Read(p []byte) (n int, err error) {
+	obs := b.hi.cfg.observer
+	if obs == nil {
+		n, _, err = b.recv(p)
+		return n, err
+	}
+
+	start := time.Now()
+	n, blocked, err := b.recv(p)
+	obs.ObserveRead(n, blocked, time.Since(start))
+	return n, err
+}
+
+// recv is the body of Read. blocked reports whether recv had to wait for a datagram.
+func (b *PriorityDatagramBuf) recv(p []byte) (n int, blocked bool, err error) {
+	b.hi.attach()
+	b.lo.attach()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fairness > 0 && b.nrHi >= b.fairness {
+		select {
+		case c, ok := <-b.lo.chbuf:
+			n, err = b.fetched(p, c, ok, false)
+			return n, false, err
+		default:
+		}
+	}
+
+	select {
+	case c, ok := <-b.hi.chbuf:
+		n, err = b.fetched(p, c, ok, true)
+		return n, false, err
+	default:
+	}
+
+	select {
+	case c, ok := <-b.lo.chbuf:
+		n, err = b.fetched(p, c, ok, false)
+		return n, false, err
+	default:
+	}
+
+	// both queues are empty
+	select {
+	case c, ok := <-b.hi.chbuf:
+		n, err = b.fetched(p, c, ok, true)
+	case c, ok := <-b.lo.chbuf:
+		n, err = b.fetched(p, c, ok, false)
+	}
+	return n, true, err
+}
+
+// fetched copies the datagram of the received chunk c to p
+// and updates the fairness counter.
+func (b *PriorityDatagramBuf) fetched(p []byte, c chunk, ok, hi bool) (int, error) {
+	if !ok {
+		return 0, ErrBrokenBuffer
+	}
+	if hi {
+		b.nrHi++
+	} else {
+		b.nrHi = 0
+	}
+	c.guard.check(c.data)
+	n := copy(p, c.data)
+	b.hi.release(c)
+	return n, nil
+}
@@ -0,0 +1,86 @@
+package ebuf_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestPriorityDatagramBuf(t *testing.T) {
+	type input struct {
+		hi    bool
+		value []byte
+	}
+	tests := []struct {
+		opts     []ebuf.Option
+		inputs   []input
+		expected [][]byte
+	}{
+		{
+			// 高優先度のデータグラムが先に読まれる
+			nil,
+			[]input{
+				{false, []byte("lo1")}, {false, []byte("lo2")},
+				{true, []byte("hi1")}, {true, []byte("hi2")},
+			},
+			[][]byte{[]byte("hi1"), []byte("hi2"), []byte("lo1"), []byte("lo2")},
+		},
+		{
+			// 高優先度を 2 つ読むごとに低優先度を 1 つ読む
+			[]ebuf.Option{ebuf.WithFairness(2)},
+			[]input{
+				{true, []byte("hi1")}, {true, []byte("hi2")}, {true, []byte("hi3")},
+				{true, []byte("hi4")}, {true, []byte("hi5")},
+				{false, []byte("lo1")}, {false, []byte("lo2")},
+			},
+			[][]byte{
+				[]byte("hi1"), []byte("hi2"), []byte("lo1"),
+				[]byte("hi3"), []byte("hi4"), []byte("lo2"), []byte("hi5"),
+			},
+		},
+	}
+
+	for i, test := range tests {
+		pbuf := ebuf.NewPriorityDatagramBuf(len(test.inputs), test.opts...)
+		for j, in := range test.inputs {
+			write := pbuf.WriteLo
+			if in.hi {
+				write = pbuf.WriteHi
+			}
+			if _, err := write(in.value); err != nil {
+				t.Fatalf("[error] [Priority Datagram Buffer] [Write %d-%d]: %v", i, j, err)
+			}
+		}
+
+		for j, ex := range test.expected {
+			actual := make([]byte, 10)
+			n, err := pbuf.Read(actual)
+			if err != nil {
+				t.Errorf("[error] [Priority Datagram Buffer] [Read %d-%d]: %v", i, j, err)
+			}
+			if !bytes.Equal(ex, actual[:n]) {
+				t.Errorf("[%d-%d] expected %s (got %s)", i, j, ex, actual[:n])
+			}
+		}
+	}
+}
+
+func TestPriorityDatagramBufBlockingRead(t *testing.T) {
+	pbuf := ebuf.NewPriorityDatagramBuf(1)
+	go func() {
+		if _, err := pbuf.WriteLo([]byte("lo")); err != nil {
+			t.Errorf("[error] [Priority Datagram Buffer] [Write]: %v", err)
+		}
+	}()
+
+	// 両方のキューが空の場合はブロックし, 届いたデータグラムを返す
+	actual := make([]byte, 10)
+	n, err := pbuf.Read(actual)
+	if err != nil {
+		t.Errorf("[error] [Priority Datagram Buffer] [Read]: %v", err)
+	}
+	if !bytes.Equal([]byte("lo"), actual[:n]) {
+		t.Errorf("expected lo (got %s)", actual[:n])
+	}
+}
@@ -0,0 +1,92 @@
+package ebuf
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is the token bucket of WithWriteRateLimit. The bucket starts
+// empty, and fills with rate tokens per second up to rate tokens, one token
+// per byte. A write takes the tokens of its length even if they are not
+// enough, so that the writes larger than the bucket are not starved,
+// and the following writes wait for the bucket to recover from the debt.
+type rateLimiter struct {
+	mu     sync.Mutex // guards tokens and last
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter of bytesPerSec.
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSec), last: time.Now()}
+}
+
+// reserve takes n tokens, and returns how long the caller must wait
+// until they are available.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel gives back n tokens taken by reserve, for a write given up.
+func (l *rateLimiter) cancel(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens += float64(n)
+}
+
+// throttle waits for the tokens of a write of n bytes, if WithWriteRateLimit
+// is given, in the way described in send, by the deadline given by
+// writeDeadline. blocked reports whether throttle had to wait for the tokens.
+// If the write is given up, its tokens are given back.
+func (c *core) throttle(n int, timeout <-chan time.Time, deadline time.Time) (blocked bool, err error) {
+	if c.limiter == nil {
+		return false, nil
+	}
+	d := c.limiter.reserve(n)
+	if d <= 0 {
+		return false, nil
+	}
+	if timeout == noWait {
+		c.limiter.cancel(n)
+		return false, ErrWouldBlock
+	}
+
+	timeout, stop := until(timeout, deadline)
+	defer stop()
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true, nil
+	case <-timeout:
+		err = &TimeoutError{}
+	case <-c.done:
+		err = ErrClosed
+	case <-c.rdone:
+		err = io.ErrClosedPipe
+	}
+	c.limiter.cancel(n)
+	return true, err
+}
+
+// unthrottle gives back the tokens of a write of n bytes taken by throttle,
+// for the write which fails after throttle.
+func (c *core) unthrottle(n int) {
+	if c.limiter != nil {
+		c.limiter.cancel(n)
+	}
+}
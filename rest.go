@@ -0,0 +1,117 @@
+package ebuf
+
+// restBuf holds the bytes which StreamBuf has fetched from its inner channel
+// but not provided yet. The unread bytes are buf[head:]. Instead of
+// re-slicing the unread bytes, which leaves the consumed bytes in the
+// backing array, restBuf advances head, and reuses the backing array
+// from the front once all the bytes are consumed or more room is needed.
+// The lengths of the chunks in the unread bytes are kept in
+// bounds[bhead:] in the same way, where the first one is reduced
+// as the bytes of the chunk are consumed.
+type restBuf struct {
+	buf  []byte
+	head int
+
+	bounds []int
+	bhead  int
+}
+
+// len returns the number of unread bytes.
+func (r *restBuf) len() int {
+	return len(r.buf) - r.head
+}
+
+// bytes returns the unread bytes. The returned slice aliases the backing
+// array, and is valid only until the next call of append or consume.
+func (r *restBuf) bytes() []byte {
+	return r.buf[r.head:]
+}
+
+// append appends p to the unread bytes.
+func (r *restBuf) append(p []byte) {
+	if r.head > 0 && len(r.buf)+len(p) > cap(r.buf) {
+		// reclaim the room of the consumed bytes before growing the backing array
+		n := copy(r.buf, r.buf[r.head:])
+		r.buf = r.buf[:n]
+		r.head = 0
+	}
+	r.buf = append(r.buf, p...)
+
+	if len(p) == 0 {
+		return
+	}
+	if r.bhead > 0 && len(r.bounds) == cap(r.bounds) {
+		n := copy(r.bounds, r.bounds[r.bhead:])
+		r.bounds = r.bounds[:n]
+		r.bhead = 0
+	}
+	r.bounds = append(r.bounds, len(p))
+}
+
+// consume discards the first n unread bytes.
+func (r *restBuf) consume(n int) {
+	r.head += n
+	if r.head == len(r.buf) {
+		r.buf = r.buf[:0]
+		r.head = 0
+		r.bounds = r.bounds[:0]
+		r.bhead = 0
+		return
+	}
+
+	for n > 0 {
+		m := min(n, r.bounds[r.bhead])
+		r.bounds[r.bhead] -= m
+		n -= m
+		if r.bounds[r.bhead] == 0 {
+			r.bhead++
+		}
+	}
+}
+
+// boundary returns the number of the unread bytes before the next
+// chunk boundary, which is 0 if there are no unread bytes.
+func (r *restBuf) boundary() int {
+	if r.bhead == len(r.bounds) {
+		return 0
+	}
+	return r.bounds[r.bhead]
+}
+
+// compact moves the unread bytes to a new backing array of their size,
+// so that the old one, which may have grown large, can be collected.
+func (r *restBuf) compact() {
+	var buf []byte
+	if n := r.len(); n > 0 {
+		buf = make([]byte, n)
+		copy(buf, r.bytes())
+	}
+	r.buf = buf
+	r.head = 0
+	r.bounds = append([]int(nil), r.bounds[r.bhead:]...)
+	r.bhead = 0
+}
+
+// sparse reports whether the unread bytes occupy less than a quarter of
+// the backing array of at least autoCompactSize bytes.
+func (r *restBuf) sparse() bool {
+	return cap(r.buf) >= autoCompactSize && r.len() < cap(r.buf)/4
+}
+
+// autoCompactSize is the size of the backing array from which
+// WithAutoCompact compacts restBuf. Smaller ones are kept for reuse.
+const autoCompactSize = 64 << 10
+
+// boundaries returns the offsets of the chunk boundaries within
+// the first n unread bytes, that is, where each chunk ends.
+func (r *restBuf) boundaries(n int) []int {
+	var offs []int
+	off := 0
+	for _, l := range r.bounds[r.bhead:] {
+		if off += l; off > n {
+			break
+		}
+		offs = append(offs, off)
+	}
+	return offs
+}
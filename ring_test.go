@@ -0,0 +1,119 @@
+package ebuf_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestRingDatagramBufReadWrite(t *testing.T) {
+	tests := []struct {
+		input    []byte
+		size     int
+		expected []byte
+	}{
+		{
+			// the receiving size is the same as the datagram size
+			[]byte("hello"),
+			5,
+			[]byte("hello"),
+		},
+		{
+			// the receiving size is less than the datagram size
+			[]byte("hello"),
+			1,
+			[]byte("h"),
+		},
+		{
+			// the receiving size is larger than the datagram size
+			[]byte("hello"),
+			10,
+			[]byte("hello\x00\x00\x00\x00\x00"),
+		},
+	}
+
+	rbuf := ebuf.NewRingDatagramBuf(1)
+
+	go func() {
+		for i, test := range tests {
+			// バッファに書き込み
+			if _, err := rbuf.Write(test.input); err != nil {
+				t.Errorf("[error] [Ring Datagram Buffer] [Write %d]: %v", i, err)
+			}
+		}
+		rbuf.Close()
+	}()
+
+	for i, test := range tests {
+		actual := make([]byte, test.size)
+		if _, err := rbuf.Read(actual); err != nil {
+			t.Errorf("[error] [Ring Datagram Buffer] [Read %d]: %v", i, err)
+		}
+		if !bytes.Equal(test.expected, actual) {
+			t.Errorf("expected %v (got %v)", test.expected, actual)
+		}
+	}
+
+	// 閉じた後は読み切ると io.EOF を返し, 書き込みは ErrClosed を返す
+	if _, err := rbuf.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected %v (got %v)", io.EOF, err)
+	}
+	if _, err := rbuf.Write([]byte("a")); err != ebuf.ErrClosed {
+		t.Errorf("expected %v (got %v)", ebuf.ErrClosed, err)
+	}
+	if err := rbuf.Close(); err != ebuf.ErrAlreadyClosed {
+		t.Errorf("expected %v (got %v)", ebuf.ErrAlreadyClosed, err)
+	}
+}
+
+func TestRingDatagramBufReuse(t *testing.T) {
+	rbuf := ebuf.NewRingDatagramBuf(2)
+
+	// スロットを再利用しても, 前のデータグラムが混ざらない
+	inputs := []string{"abcdef", "gh", "i", "jklm", "", "n"}
+	for i, in := range inputs {
+		if _, err := rbuf.Write([]byte(in)); err != nil {
+			t.Errorf("[error] [Ring Datagram Buffer] [Write %d]: %v", i, err)
+		}
+		actual := make([]byte, 10)
+		n, err := rbuf.Read(actual)
+		if err != nil {
+			t.Errorf("[error] [Ring Datagram Buffer] [Read %d]: %v", i, err)
+		}
+		if !bytes.Equal([]byte(in), actual[:n]) {
+			t.Errorf("expected %s (got %s)", in, actual[:n])
+		}
+	}
+}
+
+// benchmarkSPSC writes datagrams of 64 bytes from one goroutine,
+// and reads them from another one.
+func benchmarkSPSC(b *testing.B, buf io.ReadWriteCloser) {
+	b.ReportAllocs()
+	in := make([]byte, 64)
+	b.SetBytes(int64(len(in)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			buf.Write(in)
+		}
+		buf.Close()
+	}()
+
+	p := make([]byte, len(in))
+	for {
+		if _, err := buf.Read(p); err != nil {
+			return
+		}
+	}
+}
+
+func BenchmarkDatagramBufSPSC(b *testing.B) {
+	benchmarkSPSC(b, ebuf.NewDatagramBuf(1024))
+}
+
+func BenchmarkRingDatagramBufSPSC(b *testing.B) {
+	benchmarkSPSC(b, ebuf.NewRingDatagramBuf(1024))
+}
@@ -0,0 +1,71 @@
+package ebuf
+
+import "sync"
+
+// SlotBuf is a fixed number of equal-sized slots, which are written and
+// read at random by their indices, such as frame ids for double or triple
+// buffering. Like DoubleBuf, SlotBuf is not channel-based, so WriteSlot
+// is never blocked: writing a slot which has not been read yet overwrites
+// it, and the latest data wins.
+type SlotBuf struct {
+	mu          sync.Mutex // guards the following fields
+	slots       [][]byte
+	unread      []bool
+	overwritten uint64
+}
+
+// NewSlotBuf generates a new SlotBuf which has `nrSlots` slots of
+// `slotSize` bytes. NewSlotBuf panics if nrSlots or slotSize is negative.
+func NewSlotBuf(nrSlots, slotSize int) *SlotBuf {
+	if nrSlots < 0 || slotSize < 0 {
+		panic("ebuf: " + ErrNegativeCapacity.Error())
+	}
+	b := &SlotBuf{
+		slots:  make([][]byte, nrSlots),
+		unread: make([]bool, nrSlots),
+	}
+	for i := range b.slots {
+		b.slots[i] = make([]byte, 0, slotSize)
+	}
+	return b
+}
+
+// WriteSlot copies p to the i-th slot. If the slot has not been read since
+// the previous write, WriteSlot overwrites it, and counts it in Overwritten.
+// WriteSlot returns ErrTooLarge if p is larger than the slot size.
+// WriteSlot panics if i is out of range.
+func (b *SlotBuf) WriteSlot(i int, p []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.slots[i]
+	if len(p) > cap(s) {
+		return ErrTooLarge
+	}
+	if b.unread[i] {
+		b.overwritten++
+	}
+	b.slots[i] = append(s[:0], p...)
+	b.unread[i] = true
+	return nil
+}
+
+// ReadSlot returns a copy of the data last written to the i-th slot,
+// which is empty if the slot has never been written.
+// ReadSlot panics if i is out of range.
+func (b *SlotBuf) ReadSlot(i int) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.unread[i] = false
+	return append([]byte{}, b.slots[i]...)
+}
+
+// Overwritten returns the number of the writes which overwrote
+// a slot before it was read.
+func (b *SlotBuf) Overwritten() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.overwritten
+}
@@ -0,0 +1,88 @@
+package ebuf_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestSlotBuf(t *testing.T) {
+	sbuf := ebuf.NewSlotBuf(3, 4)
+
+	// 書き込んでいないスロットは空
+	if actual := sbuf.ReadSlot(0); len(actual) != 0 {
+		t.Errorf("expected empty (got %s)", actual)
+	}
+
+	tests := []struct {
+		slot  int
+		input []byte
+		err   error
+	}{
+		{0, []byte("ab"), nil},
+		{2, []byte("cdef"), nil},
+		// 読む前に上書きすると最新のデータが残る
+		{0, []byte("ghi"), nil},
+		{1, []byte("jklmn"), ebuf.ErrTooLarge},
+	}
+	for i, test := range tests {
+		if err := sbuf.WriteSlot(test.slot, test.input); err != test.err {
+			t.Errorf("[WriteSlot %d] expected %v (got %v)", i, test.err, err)
+		}
+	}
+
+	expected := [][]byte{[]byte("ghi"), {}, []byte("cdef")}
+	for i, ex := range expected {
+		if actual := sbuf.ReadSlot(i); !bytes.Equal(ex, actual) {
+			t.Errorf("[ReadSlot %d] expected %s (got %s)", i, ex, actual)
+		}
+	}
+	if o := sbuf.Overwritten(); o != 1 {
+		t.Errorf("expected 1 (got %d)", o)
+	}
+
+	// 読んだ後の書き込みは上書きとして数えない
+	if err := sbuf.WriteSlot(0, []byte("o")); err != nil {
+		t.Errorf("[error] [Slot Buffer] [WriteSlot]: %v", err)
+	}
+	if o := sbuf.Overwritten(); o != 1 {
+		t.Errorf("expected 1 (got %d)", o)
+	}
+}
+
+func TestSlotBufConcurrent(t *testing.T) {
+	const nrSlots = 4
+	const nrWrites = 100
+	sbuf := ebuf.NewSlotBuf(nrSlots, 2)
+
+	// 各スロットに並行して書き込み, 読むたびに壊れていないことを確かめる
+	var wg sync.WaitGroup
+	for i := 0; i < nrSlots; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < nrWrites; j++ {
+				if err := sbuf.WriteSlot(i, []byte{byte(i), byte(j)}); err != nil {
+					t.Errorf("[error] [Slot Buffer] [WriteSlot %d-%d]: %v", i, j, err)
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < nrWrites; j++ {
+				if actual := sbuf.ReadSlot(i); len(actual) != 0 && (len(actual) != 2 || actual[0] != byte(i)) {
+					t.Errorf("[ReadSlot %d] unexpected %v", i, actual)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < nrSlots; i++ {
+		if expected := []byte{byte(i), nrWrites - 1}; !bytes.Equal(expected, sbuf.ReadSlot(i)) {
+			t.Errorf("[ReadSlot %d] expected %v", i, expected)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+//go:build ebuf_debug
+
+package ebuf
+
+// debugState returns the internal state of StreamBuf for white-box tests
+// and troubleshooting: the number of the bytes fetched for Read but not
+// read yet, the sizes of the chunks in the inner channel in order, and
+// whether the inner channel has been closed. debugState never consumes
+// data. It holds the buffer like Grow, so the reads and writes wait for it.
+func (b *StreamBuf) debugState() (rest int, chunks []int, closed bool) {
+	b.rmu.Lock()
+	defer b.unlockRead()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.chMu.Lock()
+	defer b.chMu.Unlock()
+
+	// wake up the blocked writers, and wait for all of them to leave,
+	// so that the inner channel can be replaced with a copy
+	close(b.moved)
+	b.inflight.Wait()
+	b.moved = make(chan struct{})
+
+	q := make(chbuf, cap(b.chbuf))
+L:
+	for {
+		select {
+		case c, ok := <-b.chbuf:
+			if !ok {
+				closed = true
+				break L
+			}
+			chunks = append(chunks, len(c.data))
+			q <- c
+		default:
+			break L
+		}
+	}
+	if closed {
+		close(q)
+	}
+	b.chbuf = q
+	return b.rest.len(), chunks, closed
+}
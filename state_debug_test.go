@@ -0,0 +1,46 @@
+//go:build ebuf_debug
+
+package ebuf
+
+import (
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestStreamBufDebugState(t *testing.T) {
+	sbuf := NewStreamBuf(4)
+	for _, in := range []string{"hello", "ab", "xyz"} {
+		sbuf.Write([]byte(in))
+	}
+
+	tests := []struct {
+		name   string
+		read   func()
+		rest   int
+		chunks []int
+		closed bool
+	}{
+		{"none", func() {}, 0, []int{5, 2, 3}, false},
+		// 途中まで読むと, 残りだけが取り込み済みになる
+		{"Read", func() { sbuf.Read(make([]byte, 3)) }, 2, []int{2, 3}, false},
+		// 状態を見るだけでは何も消費しない
+		{"debugState", func() { sbuf.debugState() }, 2, []int{2, 3}, false},
+		{"ReadChunk", func() { sbuf.ReadChunk() }, 0, []int{2, 3}, false},
+		// 必要な分のチャンクだけが取り込まれる
+		{"Read one byte", func() { sbuf.Read(make([]byte, 1)) }, 1, []int{3}, false},
+		{"Close", func() { sbuf.Close() }, 1, []int{3}, true},
+		{"Bytes", func() { sbuf.Bytes() }, 4, nil, true},
+	}
+	for _, test := range tests {
+		test.read()
+		rest, chunks, closed := sbuf.debugState()
+		if rest != test.rest || !slices.Equal(chunks, test.chunks) || closed != test.closed {
+			t.Errorf("[%s] expected (%d, %v, %t) (got (%d, %v, %t))", test.name, test.rest, test.chunks, test.closed, rest, chunks, closed)
+		}
+	}
+
+	if actual, err := io.ReadAll(sbuf); string(actual) != "bxyz" || err != nil {
+		t.Errorf("expected bxyz, <nil> (got %s, %v)", actual, err)
+	}
+}
@@ -0,0 +1,109 @@
+package ebuf
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// TeeWriter is StreamBuf whose writes also copy the written bytes to
+// another writer, for logging or auditing the byte stream. It is returned
+// by StreamBuf.TeeTo. All the write methods of StreamBuf are overridden
+// to copy the bytes, and the other methods are the ones of StreamBuf.
+type TeeWriter struct {
+	*StreamBuf
+	w io.Writer
+
+	mu  sync.Mutex // serializes the writes, so that w receives the bytes in order
+	err error      // the error of w, returned by the next write
+}
+
+// TeeTo returns a TeeWriter, which writes to b and w.
+// The writes to b itself are not copied to w.
+func (b *StreamBuf) TeeTo(w io.Writer) *TeeWriter {
+	return &TeeWriter{StreamBuf: b, w: w}
+}
+
+// Write enqueues p into StreamBuf first, and then copies the enqueued bytes
+// to w, so w never receives the bytes which StreamBuf refused. The writes
+// are serialized, so w receives the bytes in the same order as StreamBuf.
+// If the copy to w fails, Write still succeeds since p has been enqueued,
+// and the next write returns the error of w without writing anything.
+// Write returns the same errors as StreamBuf.Write otherwise.
+func (t *TeeWriter) Write(p []byte) (int, error) {
+	return t.tee(func() (int, error) { return t.StreamBuf.Write(p) }, t.mirror(p))
+}
+
+// TryWrite is like Write, but never blocks, like StreamBuf.TryWrite.
+func (t *TeeWriter) TryWrite(p []byte) (int, error) {
+	return t.tee(func() (int, error) { return t.StreamBuf.TryWrite(p) }, t.mirror(p))
+}
+
+// WriteTimeout is like Write, but gives up after the duration d,
+// like StreamBuf.WriteTimeout.
+func (t *TeeWriter) WriteTimeout(p []byte, d time.Duration) (int, error) {
+	return t.tee(func() (int, error) { return t.StreamBuf.WriteTimeout(p, d) }, t.mirror(p))
+}
+
+// WriteString is like Write, but writes s, like StreamBuf.WriteString.
+func (t *TeeWriter) WriteString(s string) (int, error) {
+	return t.tee(func() (int, error) { return t.StreamBuf.WriteString(s) }, func(n int) error {
+		_, err := io.WriteString(t.w, s[:n])
+		return err
+	})
+}
+
+// WriteVectored is like Write, but writes the concatenation of bufs
+// as one chunk, like StreamBuf.WriteVectored.
+func (t *TeeWriter) WriteVectored(bufs ...[]byte) (int, error) {
+	return t.tee(func() (int, error) { return t.StreamBuf.WriteVectored(bufs...) }, func(int) error {
+		// WriteVectored writes all of bufs or nothing
+		for _, p := range bufs {
+			if _, err := t.w.Write(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteMessage is like Write, but writes p as one message,
+// like StreamBuf.WriteMessage. w receives the message with its prefix.
+func (t *TeeWriter) WriteMessage(p []byte) (int, error) {
+	msg, err := message(p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := t.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// tee calls write, and then calls mirror with the number of bytes written,
+// in the way described in Write.
+func (t *TeeWriter) tee(write func() (int, error), mirror func(n int) error) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.err; err != nil {
+		t.err = nil
+		return 0, err
+	}
+
+	n, err := write()
+	if n > 0 {
+		if werr := mirror(n); werr != nil {
+			t.err = werr
+		}
+	}
+	return n, err
+}
+
+// mirror returns the function copying the first n bytes of p to w.
+func (t *TeeWriter) mirror(p []byte) func(n int) error {
+	return func(n int) error {
+		_, err := t.w.Write(p[:n])
+		return err
+	}
+}
@@ -0,0 +1,106 @@
+package ebuf_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestStreamBufTeeTo(t *testing.T) {
+	var mirror bytes.Buffer
+	sbuf := ebuf.NewStreamBuf(3)
+	tee := sbuf.TeeTo(&mirror)
+
+	inputs := []string{"hello", " ", "ebuf"}
+	for i, in := range inputs {
+		if _, err := tee.Write([]byte(in)); err != nil {
+			t.Errorf("[error] [Tee Writer] [Write %d]: %v", i, err)
+		}
+	}
+	tee.Close()
+
+	// w にも書き込んだものと同じバイト列が届く
+	actual, err := io.ReadAll(tee)
+	if err != nil {
+		t.Errorf("[error] [Tee Writer] [Read]: %v", err)
+	}
+	if string(actual) != "hello ebuf" {
+		t.Errorf("expected hello ebuf (got %s)", actual)
+	}
+	if mirror.String() != "hello ebuf" {
+		t.Errorf("expected hello ebuf (got %s)", mirror.String())
+	}
+
+	// 閉じた後に書き込めなかったバイトは w にも書き込まれない
+	if _, err := tee.Write([]byte("!")); err != ebuf.ErrClosed {
+		t.Errorf("expected %v (got %v)", ebuf.ErrClosed, err)
+	}
+	if mirror.String() != "hello ebuf" {
+		t.Errorf("expected hello ebuf (got %s)", mirror.String())
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestStreamBufTeeToError(t *testing.T) {
+	errMirror := errors.New("mirror")
+	sbuf := ebuf.NewStreamBuf(3)
+	tee := sbuf.TeeTo(failingWriter{errMirror})
+
+	// w の失敗は次の Write で返され, その Write は何も書き込まない
+	tests := []struct {
+		n   int
+		err error
+	}{
+		{1, nil},
+		{0, errMirror},
+		{1, nil},
+	}
+	for i, test := range tests {
+		n, err := tee.Write([]byte("a"))
+		if n != test.n || err != test.err {
+			t.Errorf("[Write %d] expected %d, %v (got %d, %v)", i, test.n, test.err, n, err)
+		}
+	}
+	if actual := sbuf.Bytes(); string(actual) != "aa" {
+		t.Errorf("expected aa (got %s)", actual)
+	}
+}
+
+func TestTeeWriterWriteMethods(t *testing.T) {
+	var mirror bytes.Buffer
+	sbuf := ebuf.NewStreamBuf(8)
+	tee := sbuf.TeeTo(&mirror)
+
+	// Write 以外の書き込みも w に届く
+	tests := []struct {
+		name  string
+		write func() (int, error)
+		n     int
+		sent  string
+	}{
+		{"WriteString", func() (int, error) { return io.WriteString(tee, "ab") }, 2, "ab"},
+		{"TryWrite", func() (int, error) { return tee.TryWrite([]byte("cd")) }, 2, "cd"},
+		{"WriteTimeout", func() (int, error) { return tee.WriteTimeout([]byte("ef"), time.Second) }, 2, "ef"},
+		{"WriteVectored", func() (int, error) { return tee.WriteVectored([]byte("g"), []byte("h")) }, 2, "gh"},
+		{"WriteMessage", func() (int, error) { return tee.WriteMessage([]byte("ij")) }, 2, "\x00\x00\x00\x02ij"},
+	}
+	for _, test := range tests {
+		mirror.Reset()
+		if n, err := test.write(); n != test.n || err != nil {
+			t.Errorf("[%s] expected %d, <nil> (got %d, %v)", test.name, test.n, n, err)
+		}
+		if s := mirror.String(); s != test.sent {
+			t.Errorf("[%s] expected %q (got %q)", test.name, test.sent, s)
+		}
+	}
+	if n := sbuf.Len(); n != 14 {
+		t.Errorf("expected 14 (got %d)", n)
+	}
+}
@@ -0,0 +1,19 @@
+package ebuf
+
+import (
+	"context"
+	"runtime/trace"
+)
+
+// region starts a region of runtime/trace for a read or write blocked on
+// the inner channel, if WithTraceRegion is given and a trace is running,
+// and returns the function which ends it.
+func (c *core) region(op string) func() {
+	if c.cfg.traceName == "" || !trace.IsEnabled() {
+		return nop
+	}
+	return trace.StartRegion(context.Background(), c.cfg.traceName+"."+op).End
+}
+
+// nop does nothing.
+func nop() {}
@@ -0,0 +1,47 @@
+package ebuf_test
+
+import (
+	"bytes"
+	"runtime/trace"
+	"testing"
+	"time"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestWithTraceRegion(t *testing.T) {
+	var out bytes.Buffer
+	if err := trace.Start(&out); err != nil {
+		t.Skipf("trace is not available: %v", err)
+	}
+
+	dbuf := ebuf.NewDatagramBuf(1, ebuf.WithTraceRegion("ebuftest"))
+	sbuf := ebuf.NewStreamBuf(1, ebuf.WithTraceRegion("ebuftest"))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		dbuf.Write([]byte("a"))
+		sbuf.Write([]byte("b"))
+		sbuf.Write([]byte("c"))
+	}()
+
+	// 読み手はデータを待ってブロックする
+	p := make([]byte, 1)
+	if _, err := dbuf.Read(p); err != nil || p[0] != 'a' {
+		t.Errorf("expected a, <nil> (got %c, %v)", p[0], err)
+	}
+	// 書き手は読まれるのを待ってブロックする
+	time.Sleep(10 * time.Millisecond)
+	for _, want := range []byte("bc") {
+		if _, err := sbuf.Read(p); err != nil || p[0] != want {
+			t.Errorf("expected %c, <nil> (got %c, %v)", want, p[0], err)
+		}
+	}
+	trace.Stop()
+
+	// トレースに領域の名前が記録されている
+	for _, name := range []string{"ebuftest.Read", "ebuftest.Write"} {
+		if !bytes.Contains(out.Bytes(), []byte(name)) {
+			t.Errorf("expected a region %s in the trace", name)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package ebuf
+
+import "time"
+
+// WithReadTransform makes the reads of StreamBuf apply fn to each chunk
+// as it is fetched from the inner channel, such as for decoding, so that
+// the reads return the concatenation of the results of fn instead of
+// the written bytes. fn may modify its argument in place and return it,
+// or return another slice, which may be of another length, but it must
+// not retain its argument after it returns. The chunks already fetched
+// for Read are not transformed. WithReadTransform must be called before
+// StreamBuf is used, and returns b for chaining.
+func (b *StreamBuf) WithReadTransform(fn func([]byte) []byte) *StreamBuf {
+	b.rtransform = fn
+	return b
+}
+
+// WithWriteTransform makes the writes of StreamBuf apply fn to each chunk
+// before it is sent to the inner channel, such as for encoding. fn receives
+// the copy of the written data made by Write, unless WithCopyThreshold or
+// WithNoCopy hands off the slice of the caller, so fn can modify it in
+// place; the same rules as WithReadTransform apply to fn otherwise.
+// The writes return the length of the data given to them,
+// not the length of the result of fn, as io.Writer requires.
+// WithWriteTransform must be called before StreamBuf is used, and
+// returns b for chaining.
+func (b *StreamBuf) WithWriteTransform(fn func([]byte) []byte) *StreamBuf {
+	b.wtransform = fn
+	return b
+}
+
+// writeTransformed is writeOwned with the write transform.
+func (c *core) writeTransformed(ch chunk, timeout <-chan time.Time) (int, error) {
+	n := len(ch.data)
+	tc := c.transform(ch)
+
+	start := time.Now()
+	_, blocked, err := c.send(tc, timeout)
+	if err != nil {
+		n = 0
+	}
+	if c.cfg.observer != nil {
+		c.cfg.observer.ObserveWrite(n, blocked, time.Since(start))
+	}
+	return n, c.canceled(err)
+}
+
+// transform applies the write transform to the data of ch, and returns
+// the chunk of the result. The result is sealed again for debug builds,
+// and copied to the memory of WithAllocator if ch is allocated by it.
+func (c *core) transform(ch chunk) chunk {
+	data := c.wtransform(ch.data)
+	if !ch.alloced {
+		return chunk{data: data, guard: seal(data)}
+	}
+	out := c.alloc(len(data))
+	copy(out.data, data)
+	c.release(ch)
+	return out
+}
@@ -0,0 +1,52 @@
+package ebuf_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/negli0/ebuf"
+)
+
+// invert はバイトを反転する変換で, 二度適用すると元に戻る
+func invert(p []byte) []byte {
+	for i := range p {
+		p[i] = ^p[i]
+	}
+	return p
+}
+
+func TestStreamBufTransform(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(3).WithWriteTransform(invert).WithReadTransform(invert)
+
+	in := []byte("hello")
+	for i, p := range [][]byte{in, []byte(" "), []byte("ebuf")} {
+		if n, err := sbuf.Write(p); n != len(p) || err != nil {
+			t.Errorf("[error] [Stream Buffer] [Write %d]: %d, %v", i, n, err)
+		}
+	}
+	sbuf.Close()
+
+	// 書き込み側の変換は Write のコピーに適用され, 呼び出し元のスライスは変わらない
+	if string(in) != "hello" {
+		t.Errorf("expected hello (got %s)", in)
+	}
+	actual, err := io.ReadAll(sbuf)
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [ReadAll]: %v", err)
+	}
+	if string(actual) != "hello ebuf" {
+		t.Errorf("expected hello ebuf (got %s)", actual)
+	}
+}
+
+func TestStreamBufTransformOneSide(t *testing.T) {
+	// 片側だけの変換は, 反転したバイト列として読める
+	sbuf := ebuf.NewStreamBuf(1).WithWriteTransform(invert)
+	sbuf.Write([]byte("ab"))
+	sbuf.Close()
+
+	p, err := sbuf.ReadChunk()
+	if err != nil || string(p) != string(invert([]byte("ab"))) {
+		t.Errorf("expected %q, <nil> (got %q, %v)", invert([]byte("ab")), p, err)
+	}
+}
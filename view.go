@@ -0,0 +1,62 @@
+package ebuf
+
+import "io"
+
+// AsStream returns a StreamBuf which presents the datagrams of b as
+// a byte-stream of their concatenation, losing the boundaries. AsStream
+// starts a goroutine which moves the datagrams of b to the StreamBuf,
+// which can buffer as many chunks as b can buffer datagrams, so a datagram
+// taken by the goroutine is not returned by the reads of b. When b is closed
+// and drained, the StreamBuf is closed, and its reads return io.EOF after
+// the remaining data; if the reads of b fail otherwise, the StreamBuf is
+// closed with the error by CloseWithError. The goroutine also exits when
+// the StreamBuf is closed for reading.
+func (b *DatagramBuf) AsStream() *StreamBuf {
+	_, capacity := b.lenCap()
+	sb := NewStreamBuf(capacity)
+	go func() {
+		for {
+			d, _, err := b.next(nil)
+			if err == io.EOF {
+				sb.Close()
+				return
+			}
+			if err != nil {
+				sb.CloseWithError(err)
+				return
+			}
+			// d is owned by the goroutine, so it need not be copied again
+			if _, err := sb.writeOwned(chunk{data: d}, nil); err != nil {
+				return
+			}
+		}
+	}()
+	return sb
+}
+
+// AsDatagrams returns a DatagramBuf which presents the byte-stream of b as
+// frameSize-byte datagrams, like WriteFromReader. The last frame shorter
+// than frameSize is presented as a shorter datagram. AsDatagrams starts
+// a goroutine which moves the data of b to the DatagramBuf, which can buffer
+// as many datagrams as b can buffer chunks, so the data taken by
+// the goroutine is not returned by the reads of b. When b is closed and
+// drained, the DatagramBuf is closed, and its reads return io.EOF after
+// the remaining datagrams; if the reads of b fail otherwise, the reads of
+// the DatagramBuf return the error instead. The goroutine also exits when
+// the DatagramBuf is closed for reading. AsDatagrams panics if frameSize
+// is not positive.
+func (b *StreamBuf) AsDatagrams(frameSize int) *DatagramBuf {
+	if frameSize <= 0 {
+		panic("ebuf: non-positive frame size")
+	}
+	dbuf := NewDatagramBuf(cap(b.chbuf))
+	go func() {
+		_, err := dbuf.WriteFromReader(b, frameSize)
+		if err == ErrClosed || err == io.ErrClosedPipe {
+			// the DatagramBuf is closed by its user
+			return
+		}
+		dbuf.closeWithError(err)
+	}()
+	return dbuf
+}
@@ -0,0 +1,64 @@
+package ebuf_test
+
+import (
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/negli0/ebuf"
+)
+
+func TestDatagramBufAsStream(t *testing.T) {
+	dbuf := ebuf.NewDatagramBuf(2)
+	sbuf := dbuf.AsStream()
+	go func() {
+		for i, in := range []string{"hello", " ", "", "ebuf"} {
+			if _, err := dbuf.Write([]byte(in)); err != nil {
+				t.Errorf("[error] [Datagram Buffer] [Write %d]: %v", i, err)
+			}
+		}
+		dbuf.Close()
+	}()
+
+	// データグラムが連結されたバイト列として読め, 閉じると io.EOF が伝わる
+	actual, err := io.ReadAll(sbuf)
+	if err != nil {
+		t.Errorf("[error] [Stream Buffer] [ReadAll]: %v", err)
+	}
+	if string(actual) != "hello ebuf" {
+		t.Errorf("expected hello ebuf (got %s)", actual)
+	}
+	if _, err := sbuf.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected %v (got %v)", io.EOF, err)
+	}
+}
+
+func TestStreamBufAsDatagrams(t *testing.T) {
+	sbuf := ebuf.NewStreamBuf(2)
+	dbuf := sbuf.AsDatagrams(4)
+	go func() {
+		for i, in := range []string{"hel", "lo eb", "uf!"} {
+			if _, err := sbuf.Write([]byte(in)); err != nil {
+				t.Errorf("[error] [Stream Buffer] [Write %d]: %v", i, err)
+			}
+		}
+		sbuf.Close()
+	}()
+
+	// 4 バイトずつのデータグラムになり, 末尾の短いフレームも一つのデータグラムになる
+	var actual []string
+	p := make([]byte, 8)
+	for {
+		n, err := dbuf.Read(p)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("[error] [Datagram Buffer] [Read]: %v", err)
+		}
+		actual = append(actual, string(p[:n]))
+	}
+	if !slices.Equal(actual, []string{"hell", "o eb", "uf!"}) {
+		t.Errorf("expected [hell o eb uf!] (got %q)", actual)
+	}
+}